@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+)
+
+// what a request is allowed to do. Login tokens have every scope, api keys
+// only the ones chosen when they were created.
+const (
+	ScopeDownload = "download" // create and cancel jobs
+	ScopeRead     = "read"     // see jobs and their logs
+	ScopeAccount  = "account"  // manage api keys and (admins) users, never for api keys
+)
+
+var (
+	allScopes    = []string{ScopeDownload, ScopeRead, ScopeAccount}
+	apiKeyScopes = []string{ScopeDownload, ScopeRead}
+
+	ErrApiKeyNotFound = errors.New("api key not found")
+	ErrInvalidApiKey  = errors.New("invalid api key")
+)
+
+// how often the last use of a key is written to the database
+const apiKeyTouchInterval = time.Minute
+
+// ApiKey is a long lived credential of an user. Only the hash of its secret
+// is stored.
+type ApiKey struct {
+	Id       string
+	Username string
+	Name     string
+	Hash     string // sha256 of the secret, hex
+	Scopes   []string
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// NewApiKey creates a key for username, returning it with the secret to
+// give to the user (id.secret), which can't be recovered later
+func NewApiKey(username string, name string, scopes []string) (*ApiKey, string, error) {
+	for _, scope := range scopes {
+		if !containsString(apiKeyScopes, scope) {
+			return nil, "", fmt.Errorf("invalid scope %q", scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, "", errors.New("missing scopes")
+	}
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	key := &ApiKey{}
+	key.Id = hex.EncodeToString(id)
+	key.Username = username
+	key.Name = name
+	key.Hash = hashSecret(hex.EncodeToString(secret))
+	key.Scopes = scopes
+	key.Created = time.Now()
+	return key, key.Id + "." + hex.EncodeToString(secret), nil
+}
+
+// hashSecret hashes the random secrets of api keys and refresh tokens (a
+// fast hash is enough, they aren't passwords)
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type ApiKeyRepository interface {
+	CreateApiKey(key *ApiKey) error
+	GetApiKey(id string) (*ApiKey, error) // nil if not found
+	ListApiKeys(username string) ([]*ApiKey, error)
+	DeleteApiKey(id string) error // ErrApiKeyNotFound if it doesn't exist
+	DeleteUserApiKeys(username string) error
+	TouchApiKey(id string, t time.Time) error
+}
+
+// BoltApiKeyRepository stores the api keys, as json, in a bolt database
+type BoltApiKeyRepository struct {
+	DB *bolt.DB
+}
+
+var apiKeysBucket = []byte("apikeys")
+
+func NewBoltApiKeyRepository(db *bolt.DB) (*BoltApiKeyRepository, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(apiKeysBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltApiKeyRepository{db}, nil
+}
+
+func (repo *BoltApiKeyRepository) CreateApiKey(key *ApiKey) error {
+	return repo.DB.Update(func(tx *bolt.Tx) error {
+		return putApiKey(tx.Bucket(apiKeysBucket), key)
+	})
+}
+
+func (repo *BoltApiKeyRepository) GetApiKey(id string) (*ApiKey, error) {
+	var key *ApiKey
+	err := repo.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		key, err = getApiKey(tx.Bucket(apiKeysBucket), id)
+		return err
+	})
+	return key, err
+}
+
+func (repo *BoltApiKeyRepository) ListApiKeys(username string) ([]*ApiKey, error) {
+	keys := []*ApiKey{}
+	err := repo.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiKeysBucket).ForEach(func(k, v []byte) error {
+			key := &ApiKey{}
+			if err := json.Unmarshal(v, key); err != nil {
+				return err
+			}
+			if key.Username == username {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (repo *BoltApiKeyRepository) DeleteApiKey(id string) error {
+	return repo.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(apiKeysBucket)
+		if bucket.Get([]byte(id)) == nil {
+			return ErrApiKeyNotFound
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func (repo *BoltApiKeyRepository) DeleteUserApiKeys(username string) error {
+	return deleteUserValues(repo.DB, apiKeysBucket, username)
+}
+
+func (repo *BoltApiKeyRepository) TouchApiKey(id string, t time.Time) error {
+	return repo.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(apiKeysBucket)
+		key, err := getApiKey(bucket, id)
+		if err != nil || key == nil {
+			return err
+		}
+		key.LastUsed = t
+		return putApiKey(bucket, key)
+	})
+}
+
+func getApiKey(bucket *bolt.Bucket, id string) (*ApiKey, error) {
+	v := bucket.Get([]byte(id))
+	if v == nil {
+		return nil, nil
+	}
+	key := &ApiKey{}
+	return key, json.Unmarshal(v, key)
+}
+
+func putApiKey(bucket *bolt.Bucket, key *ApiKey) error {
+	v, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key.Id), v)
+}
+
+// RequestApiKey returns the api key sent in the X-API-Key header or as
+// "Authorization: ApiKey ...", if any
+func RequestApiKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "ApiKey ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// AuthenticateApiKey checks an id.secret api key, recording its use
+func (s *HttpServer) AuthenticateApiKey(value string) (*ApiKey, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidApiKey
+	}
+	key, err := s.ApiKeys.GetApiKey(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, ErrInvalidApiKey
+	}
+	hash := hashSecret(parts[1])
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(key.Hash)) != 1 {
+		return nil, ErrInvalidApiKey
+	}
+	if now := time.Now(); now.Sub(key.LastUsed) > apiKeyTouchInterval {
+		if err := s.ApiKeys.TouchApiKey(key.Id, now); err != nil {
+			log.Error("error recording use of api key %s: %s", key.Id, err)
+		}
+	}
+	return key, nil
+}
+
+// RequireScope returns a middleware (after AuthenticationHandler) that only
+// lets through requests with scope
+func (s *HttpServer) RequireScope(scope string) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			scopes, _ := context.Get(r, "scopes").([]string)
+			if !containsString(scopes, scope) {
+				http.Error(w, fmt.Sprintf("%s scope required", scope), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// api key representation in the http api (the secret only on creation)
+type ApiKeyInfo struct {
+	Id       string     `json:"id"`
+	Name     string     `json:"name"`
+	Username string     `json:"username"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	Key      string     `json:"key,omitempty"`
+}
+
+func NewApiKeyInfo(key *ApiKey) *ApiKeyInfo {
+	info := &ApiKeyInfo{Id: key.Id, Name: key.Name, Username: key.Username, Scopes: key.Scopes, Created: key.Created}
+	if !key.LastUsed.IsZero() {
+		lastUsed := key.LastUsed
+		info.LastUsed = &lastUsed
+	}
+	return info
+}
+
+// HandleListApiKeys lists the api keys of the authenticated user
+func (s *HttpServer) HandleListApiKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.ApiKeys.ListApiKeys(context.Get(r, "sub").(string))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := make([]*ApiKeyInfo, len(keys))
+	for i, key := range keys {
+		response[i] = NewApiKeyInfo(key)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HttpServer) HandleCreateApiKey(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json message.", http.StatusBadRequest)
+		return
+	}
+	key, secret, err := NewApiKey(context.Get(r, "sub").(string), req.Name, req.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.ApiKeys.CreateApiKey(key); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	info := NewApiKeyInfo(key)
+	info.Key = secret
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/apikeys/"+key.Id)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
+
+// HandleDeleteApiKey revokes an api key of the user (admins can revoke
+// anyone's)
+func (s *HttpServer) HandleDeleteApiKey(w http.ResponseWriter, r *http.Request) {
+	key, err := s.ApiKeys.GetApiKey(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if key == nil || (key.Username != context.Get(r, "sub").(string) && !HasRole(r, RoleAdmin)) {
+		http.Error(w, ErrApiKeyNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err := s.ApiKeys.DeleteApiKey(key.Id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
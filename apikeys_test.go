@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewApiKey(t *testing.T) {
+	key, secret, err := NewApiKey("oskar", "cron", []string{ScopeRead})
+	assert.Nil(t, err)
+	assert.Equal(t, key.Id, secret[:len(key.Id)])
+	assert.NotContains(t, key.Hash, secret[len(key.Id)+1:])
+	assert.Equal(t, key.Hash, hashSecret(secret[len(key.Id)+1:]))
+
+	_, _, err = NewApiKey("oskar", "cron", []string{ScopeAccount})
+	assert.Equal(t, "invalid scope \"account\"", err.Error())
+	_, _, err = NewApiKey("oskar", "cron", nil)
+	assert.Equal(t, "missing scopes", err.Error())
+}
+
+func TestBoltApiKeyRepository(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	repo, err := NewBoltApiKeyRepository(db)
+	require.Nil(t, err)
+
+	key, _, err := NewApiKey("oskar", "cron", []string{ScopeDownload, ScopeRead})
+	assert.Nil(t, err)
+	assert.Nil(t, repo.CreateApiKey(key))
+	other, _, err := NewApiKey("charles", "bot", []string{ScopeRead})
+	assert.Nil(t, err)
+	assert.Nil(t, repo.CreateApiKey(other))
+
+	keys, err := repo.ListApiKeys("oskar")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(keys))
+	assert.Equal(t, key.Id, keys[0].Id)
+
+	used := time.Now().Round(0)
+	assert.Nil(t, repo.TouchApiKey(key.Id, used))
+	found, err := repo.GetApiKey(key.Id)
+	assert.Nil(t, err)
+	assert.True(t, used.Equal(found.LastUsed))
+
+	assert.Nil(t, repo.DeleteApiKey(key.Id))
+	assert.Equal(t, ErrApiKeyNotFound, repo.DeleteApiKey(key.Id))
+	found, err = repo.GetApiKey(key.Id)
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+}
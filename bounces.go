@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/gorilla/schema"
+)
+
+// ErrBounced is returned when sending to an address that bounced, the outbox
+// doesn't retry it
+var ErrBounced = errors.New("address bounced or complained, not mailed")
+
+// bounceAddress returns the address of an email in lowercase, keeping the
+// +tag: a bounce of alice+foo@example.com doesn't stop the mail to
+// alice@example.com, unlike the NormalizeEmail of the accounts
+func bounceAddress(email string) (string, error) {
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(address.Address), nil
+}
+
+// IsBounced tells if email, one of the addresses of the account, bounced
+func (account *ConfigUser) IsBounced(email string) bool {
+	email, err := bounceAddress(email)
+	if err != nil {
+		return false
+	}
+	for _, bounced := range account.Bounced {
+		if address, _ := bounceAddress(bounced); address == email {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAddress tells if email is exactly (but the case) one of the addresses
+// of the account
+func (account *ConfigUser) HasAddress(email string) bool {
+	email, err := bounceAddress(email)
+	if err != nil {
+		return false
+	}
+	for _, other := range account.Emails() {
+		if address, _ := bounceAddress(other); address == email {
+			return true
+		}
+	}
+	return false
+}
+
+// PruneBounced forgets the bounced addresses the account doesn't have
+// anymore
+func (account *ConfigUser) PruneBounced() {
+	var bounced []string
+	for _, email := range account.Bounced {
+		if account.HasAddress(email) {
+			bounced = append(bounced, email)
+		}
+	}
+	account.Bounced = bounced
+}
+
+// MailgunEvent is a delivery event posted by Mailgun, from a webhook (json)
+// or a legacy one (form)
+type MailgunEvent struct {
+	Timestamp string
+	Token     string
+	Signature string
+	Event     string // bounced, dropped, failed or complained
+	Severity  string // of failed events, permanent or temporary
+	Recipient string
+	Reason    string
+}
+
+// Permanent tells if the event means the recipient shouldn't be mailed
+// again: bounces, permanent failures and complaints (spam reports)
+func (event *MailgunEvent) Permanent() bool {
+	switch event.Event {
+	case "bounced", "dropped", "complained":
+		return true
+	case "failed":
+		return event.Severity != "temporary"
+	}
+	return false
+}
+
+// mailgunWebhook is the json body of the webhooks
+type mailgunWebhook struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+	EventData struct {
+		Event          string `json:"event"`
+		Severity       string `json:"severity"`
+		Recipient      string `json:"recipient"`
+		Reason         string `json:"reason"`
+		DeliveryStatus struct {
+			Code        int    `json:"code"`
+			Message     string `json:"message"`
+			Description string `json:"description"`
+		} `json:"delivery-status"`
+	} `json:"event-data"`
+}
+
+// mailgunLegacyEvent is the form of the legacy webhooks
+type mailgunLegacyEvent struct {
+	Timestamp   string `schema:"timestamp"`
+	Token       string `schema:"token"`
+	Signature   string `schema:"signature"`
+	Event       string `schema:"event"`
+	Recipient   string `schema:"recipient"`
+	Code        string `schema:"code"`
+	Error       string `schema:"error"`
+	Reason      string `schema:"reason"`
+	Description string `schema:"description"`
+}
+
+// ParseMailgunEvent reads the event of a webhook request
+func ParseMailgunEvent(r *http.Request) (*MailgunEvent, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		webhook := &mailgunWebhook{}
+		if err := json.NewDecoder(r.Body).Decode(webhook); err != nil {
+			return nil, err
+		}
+		data := webhook.EventData
+		event := &MailgunEvent{webhook.Signature.Timestamp, webhook.Signature.Token, webhook.Signature.Signature,
+			data.Event, data.Severity, data.Recipient, data.Reason}
+		status := data.DeliveryStatus
+		if description := firstNonEmpty(status.Description, status.Message); description != "" {
+			event.Reason = fmt.Sprintf("%s: %d %s", event.Reason, status.Code, description)
+		}
+		return event, nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	legacy := &mailgunLegacyEvent{}
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	if err := decoder.Decode(legacy, r.PostForm); err != nil {
+		return nil, err
+	}
+	event := &MailgunEvent{legacy.Timestamp, legacy.Token, legacy.Signature, legacy.Event, "", legacy.Recipient, legacy.Reason}
+	if description := firstNonEmpty(legacy.Error, legacy.Description); description != "" {
+		event.Reason = strings.TrimSpace(fmt.Sprintf("%s %s %s", legacy.Reason, legacy.Code, description))
+	}
+	return event, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// HandleMailgunEvent marks the addresses that bounced or complained, so
+// they aren't mailed anymore, until an admin fixes them
+func (s *HttpServer) HandleMailgunEvent(w http.ResponseWriter, r *http.Request) {
+	event, err := ParseMailgunEvent(r)
+	if err != nil {
+		http.Error(w, "invalid Mailgun event", http.StatusBadRequest)
+		return
+	}
+	if err := s.Mailgun.VerifySignature(event.Timestamp, event.Token, event.Signature); err != nil {
+		audit.Warning("event from Mailgun (%s of %s) rejected: %s", event.Event, event.Recipient, err)
+		// Mailgun doesn't retry a 406
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	if !event.Permanent() {
+		log.Debug("ignoring Mailgun event %s (%s) of %s", event.Event, event.Severity, event.Recipient)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	account, err := s.Accounts.GetUserByEmail(event.Recipient)
+	if err != nil {
+		// Mailgun retries it later
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if account == nil || !account.HasAddress(event.Recipient) {
+		log.Info("Mailgun event %s of %s, which isn't an account address", event.Event, event.Recipient)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !account.IsBounced(event.Recipient) {
+		account.Bounced = append(account.Bounced, event.Recipient)
+		if err := s.Accounts.SaveUser(account); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit.Warning("email %s of user %s %s, not mailing it anymore: %s", event.Recipient, account.Username, event.Event, event.Reason)
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func signMailgunEvent(key string, timestamp string, token string) string {
+	msg := &MailgunMessage{Timestamp: timestamp, Token: token}
+	SignMailgunMessage(key, msg)
+	return msg.Signature
+}
+
+func TestMailgunEvents(t *testing.T) {
+	repo, cleanup := newTestUserRepository(t)
+	defer cleanup()
+	assert.Nil(t, repo.CreateUser(&ConfigUser{Username: "alma", Email: "alma@wien.at", Aliases: []string{"alma@gmail.com"}}))
+	server := &HttpServer{Accounts: repo, Mailgun: NewMailgunVerifier(&MailgunConfig{SigningKey: "signing-key"})}
+	timestamp := fmt.Sprint(time.Now().Unix())
+	post := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		server.HandleMailgunEvent(w, r)
+		return w.Code
+	}
+	webhook := func(token string, event string, severity string, recipient string) *http.Request {
+		body := fmt.Sprintf(`{"signature": {"timestamp": "%s", "token": "%s", "signature": "%s"},
+			"event-data": {"event": "%s", "severity": "%s", "recipient": "%s", "reason": "bounce",
+				"delivery-status": {"code": 550, "message": "5.1.1 mailbox does not exist"}}}`,
+			timestamp, token, signMailgunEvent("signing-key", timestamp, token), event, severity, recipient)
+		r := httptest.NewRequest("POST", "/mailgun/events", bytes.NewBufferString(body))
+		r.Header.Set("Content-Type", "application/json")
+		return r
+	}
+
+	// temporary failures are retried by Mailgun
+	assert.Equal(t, http.StatusOK, post(webhook("token1", "failed", "temporary", "alma@wien.at")))
+	account, _ := repo.GetUser("alma")
+	assert.Empty(t, account.Bounced)
+
+	assert.Equal(t, http.StatusOK, post(webhook("token2", "failed", "permanent", "Alma@wien.at")))
+	account, _ = repo.GetUser("alma")
+	assert.Equal(t, []string{"Alma@wien.at"}, account.Bounced)
+	assert.True(t, account.IsBounced("alma@wien.at"))
+	assert.False(t, account.IsBounced("alma@gmail.com"))
+
+	// a tagged address isn't the account address
+	assert.Equal(t, http.StatusOK, post(webhook("token4", "failed", "permanent", "alma+news@gmail.com")))
+	account, _ = repo.GetUser("alma")
+	assert.Equal(t, []string{"Alma@wien.at"}, account.Bounced)
+	assert.False(t, account.IsBounced("alma@gmail.com"))
+	assert.False(t, account.IsBounced("alma+news@wien.at"))
+
+	// legacy webhooks, as forms
+	form := url.Values{"timestamp": {timestamp}, "token": {"token3"}, "event": {"complained"}, "recipient": {"alma@gmail.com"}}
+	form.Set("signature", signMailgunEvent("signing-key", timestamp, "token3"))
+	r := httptest.NewRequest("POST", "/mailgun/events", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assert.Equal(t, http.StatusOK, post(r))
+	account, _ = repo.GetUser("alma")
+	assert.True(t, account.IsBounced("alma@gmail.com"))
+
+	// replayed or forged
+	assert.Equal(t, http.StatusNotAcceptable, post(webhook("token2", "failed", "permanent", "alma@wien.at")))
+	forged := httptest.NewRequest("POST", "/mailgun/events", strings.NewReader(
+		`{"signature": {"timestamp": "`+timestamp+`", "token": "token5", "signature": "00"}, "event-data": {"event": "complained"}}`))
+	forged.Header.Set("Content-Type", "application/json")
+	assert.Equal(t, http.StatusNotAcceptable, post(forged))
+
+	// fixing the address, or clearing it, mails it again
+	email := "alma@kunst.at"
+	assert.Nil(t, (&UserRequest{Email: &email}).Apply(account))
+	assert.Equal(t, []string{"alma@gmail.com"}, account.Bounced)
+	assert.NotNil(t, (&UserRequest{Bounced: &[]string{"kurt@wien.at"}}).Apply(account))
+	assert.Nil(t, (&UserRequest{Bounced: &[]string{}}).Apply(account))
+	assert.Empty(t, account.Bounced)
+}
+
+func TestOutboxBounced(t *testing.T) {
+	outbox, _, cleanup := newTestOutbox(t)
+	defer cleanup()
+	sent := 0
+	outbox.Sender = func(n *Notification) (string, error) {
+		sent++
+		return "", ErrBounced
+	}
+	assert.Nil(t, outbox.Enqueue(&Notification{To: "alma@wien.at", Subject: "listo"}))
+	outbox.DeliverDue()
+	failed, err := outbox.Repo.ListNotifications(NotificationFailed)
+	assert.Nil(t, err)
+	assert.Len(t, failed, 1)
+	assert.Equal(t, 1, sent)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ChatConfig struct {
+	Channels map[string]string "channels" // incoming webhook urls of the team channels, by name
+	Timeout  int               "timeout"  // seconds to post a message, 10 by default
+}
+
+var validChannel = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// ValidChatWebhook tells if webhook, of an account, is an https url or the
+// name of a team channel
+func ValidChatWebhook(webhook string) bool {
+	if !strings.Contains(webhook, "://") {
+		return validChannel.MatchString(webhook)
+	}
+	u, err := url.ParseRequestURI(webhook)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+// ValidChannelWebhook tells if webhook, of a team channel, is an http(s)
+// url. Being in the config, it can be in the local network.
+func ValidChannelWebhook(webhook string) bool {
+	u, err := url.ParseRequestURI(webhook)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// CheckChatWebhooks checks that the url policy allows the hosts of the
+// webhooks of an account (they're posted by the server)
+func (s *HttpServer) CheckChatWebhooks(webhooks []string) error {
+	for _, webhook := range webhooks {
+		if !strings.Contains(webhook, "://") {
+			continue
+		}
+		u, err := url.Parse(webhook)
+		if err != nil {
+			return err
+		}
+		if err := s.URLPolicy.CheckHost(urlHost(u)); err != nil {
+			return fmt.Errorf("chat webhook: %s", err)
+		}
+	}
+	return nil
+}
+
+// ChatMessage is the body of Slack and Mattermost incoming webhooks
+type ChatMessage struct {
+	Text        string           `json:"text"`
+	Attachments []ChatAttachment `json:"attachments,omitempty"`
+}
+
+type ChatAttachment struct {
+	Fallback  string `json:"fallback"`
+	Color     string `json:"color,omitempty"`
+	Title     string `json:"title,omitempty"`
+	TitleLink string `json:"title_link,omitempty"`
+	ThumbUrl  string `json:"thumb_url,omitempty"`
+	Text      string `json:"text,omitempty"`
+}
+
+// most jobs listed in the message of a digest
+const maxChatAttachments = 20
+
+// ChatNotifier posts the notifications of the jobs to the chat webhooks of
+// the accounts. The texts are the subjects of the emails, so they come in the
+// language of the user. Replies and confirmations are only sent by email.
+type ChatNotifier struct {
+	Client    *http.Client // to the webhooks of the accounts, only where the url policy allows
+	Trusted   *http.Client // to the team channels of the config
+	Templates *MailTemplates
+	Accounts  UserRepository
+
+	mu       sync.RWMutex
+	channels map[string]string
+}
+
+// chatWebhook is a webhook url and the client posting to it
+type chatWebhook struct {
+	url    string
+	client *http.Client
+}
+
+func NewChatNotifier(config *ChatConfig, templates *MailTemplates, accounts UserRepository, policy *URLPolicy) *ChatNotifier {
+	notifier := &ChatNotifier{Templates: templates, Accounts: accounts}
+	timeout := 10 * time.Second
+	if config.Timeout != 0 {
+		timeout = time.Duration(config.Timeout) * time.Second
+	}
+	notifier.Client = policy.HttpClient(timeout)
+	notifier.Client.Timeout = timeout
+	// webhooks answer, they don't redirect
+	notifier.Client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	notifier.Trusted = &http.Client{Timeout: timeout}
+	notifier.Update(config)
+	return notifier
+}
+
+// Update applies the channels of config (on reload)
+func (notifier *ChatNotifier) Update(config *ChatConfig) {
+	notifier.mu.Lock()
+	notifier.channels = config.Channels
+	notifier.mu.Unlock()
+}
+
+func (notifier *ChatNotifier) Notify(video *DownloadVideo) {
+	webhooks := notifier.webhooks(video.Username)
+	if len(webhooks) == 0 {
+		return
+	}
+	name := TemplateSuccess
+	if video.Status == JobCancelled {
+		name = TemplateCancelled
+	} else if video.Error != nil {
+		name = TemplateError
+	}
+	content, err := notifier.Templates.Render(name, video.Language, video)
+	if err != nil {
+		log.Error("error rendering %s chat message of job %s: %s", name, video.Id, err)
+		return
+	}
+	notifier.post(webhooks, &ChatMessage{Text: content.Subject, Attachments: []ChatAttachment{NewChatAttachment(video)}})
+}
+
+func (notifier *ChatNotifier) Digest(digest *NotificationDigest) {
+	if len(digest.Jobs) == 0 {
+		return
+	}
+	webhooks := notifier.webhooks(digest.Jobs[0].Username)
+	if len(webhooks) == 0 {
+		return
+	}
+	content, err := notifier.Templates.Render(TemplateDigest, digest.Language, digest)
+	if err != nil {
+		log.Error("error rendering digest chat message to %s: %s", digest.Email, err)
+		return
+	}
+	msg := &ChatMessage{Text: content.Subject}
+	for i, job := range digest.Jobs {
+		if i == maxChatAttachments {
+			break
+		}
+		msg.Attachments = append(msg.Attachments, NewChatAttachment(job))
+	}
+	notifier.post(webhooks, msg)
+}
+
+func (notifier *ChatNotifier) Reply(reply *MailReply) {}
+
+func (notifier *ChatNotifier) ConfirmEmail(confirmation *EmailConfirmation) {}
+
+// NewChatAttachment describes a finished job: its link, thumbnail, duration
+// and size, or its error
+func NewChatAttachment(video *DownloadVideo) ChatAttachment {
+	attachment := ChatAttachment{Title: video.Title, ThumbUrl: video.Thumbnail}
+	if attachment.Title == "" {
+		attachment.Title = video.SrcUrl.String()
+	}
+	if video.Error != nil {
+		attachment.Color = "danger"
+		attachment.TitleLink = video.SrcUrl.String()
+		attachment.Text = video.Error.Error()
+	} else {
+		attachment.Color = "good"
+		var details []string
+		if video.DstUrl != nil {
+			attachment.TitleLink = video.DstUrl.String()
+		}
+		if video.Duration > 0 {
+			details = append(details, FormatTimestamp(int64(video.Duration.Seconds())))
+		}
+		if video.FileSize > 0 {
+			details = append(details, FormatSize(video.FileSize))
+		}
+		attachment.Text = strings.Join(details, " · ")
+	}
+	attachment.Fallback = attachment.Title
+	if attachment.TitleLink != "" {
+		attachment.Fallback += " " + attachment.TitleLink
+	}
+	return attachment
+}
+
+// webhooks returns the urls the notifications of username go to, its own
+// and those of its team channels
+func (notifier *ChatNotifier) webhooks(username string) []chatWebhook {
+	account, err := notifier.Accounts.GetUser(username)
+	if err != nil {
+		log.Error("error looking for account %s: %s", username, err)
+		return nil
+	}
+	if account == nil {
+		return nil
+	}
+	notifier.mu.RLock()
+	defer notifier.mu.RUnlock()
+	var webhooks []chatWebhook
+	for _, webhook := range account.Chat {
+		if strings.Contains(webhook, "://") {
+			webhooks = append(webhooks, chatWebhook{webhook, notifier.Client})
+			continue
+		}
+		channel, ok := notifier.channels[webhook]
+		if !ok {
+			log.Warning("account %s has unknown chat channel %s", username, webhook)
+			continue
+		}
+		webhooks = append(webhooks, chatWebhook{channel, notifier.Trusted})
+	}
+	return webhooks
+}
+
+func (notifier *ChatNotifier) post(webhooks []chatWebhook, msg *ChatMessage) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		log.Error("error encoding chat message: %s", err)
+		return
+	}
+	for _, webhook := range webhooks {
+		if err := webhook.post(body); err != nil {
+			// the url is a secret, only its host is logged
+			host := webhook.url
+			if u, err := url.Parse(webhook.url); err == nil {
+				host = u.Host
+			}
+			log.Error("error posting chat message to %s: %s", host, err)
+		}
+	}
+}
+
+func (webhook chatWebhook) post(body []byte) error {
+	res, err := webhook.client.Post(webhook.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("status %s", res.Status)
+	}
+	return nil
+}
+
+// MultiMailer sends the notifications through several mailers, so a job can
+// notify by email and chat
+type MultiMailer []Mailer
+
+func (mailers MultiMailer) Notify(video *DownloadVideo) {
+	for _, mailer := range mailers {
+		mailer.Notify(video)
+	}
+}
+
+func (mailers MultiMailer) Digest(digest *NotificationDigest) {
+	for _, mailer := range mailers {
+		mailer.Digest(digest)
+	}
+}
+
+func (mailers MultiMailer) Reply(reply *MailReply) {
+	for _, mailer := range mailers {
+		mailer.Reply(reply)
+	}
+}
+
+func (mailers MultiMailer) ConfirmEmail(confirmation *EmailConfirmation) {
+	for _, mailer := range mailers {
+		mailer.ConfirmEmail(confirmation)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChatNotifier(t *testing.T) {
+	var posted []string
+	var messages []*ChatMessage
+	webhook := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg := &ChatMessage{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(msg))
+		posted = append(posted, r.URL.Path)
+		messages = append(messages, msg)
+	}))
+	defer webhook.Close()
+
+	repo, cleanup := newTestUserRepository(t)
+	defer cleanup()
+	assert.Nil(t, repo.CreateUser(&ConfigUser{Username: "alma", Email: "alma@wien.at",
+		Chat: []string{webhook.URL + "/hooks/alma", "wien", "nowhere"}}))
+	assert.Nil(t, repo.CreateUser(&ConfigUser{Username: "kurt", Email: "kurt@wien.at"}))
+	templates, err := NewMailTemplates("templates", "es")
+	assert.Nil(t, err)
+	channels := &ChatConfig{Channels: map[string]string{"wien": webhook.URL + "/hooks/wien"}}
+	notifier := NewChatNotifier(channels, templates, repo, NewURLPolicy(&URLPolicyConfig{AllowPrivate: true}))
+	trustTestServer(notifier, webhook)
+
+	srcUrl, _ := url.Parse("https://www.youtube.com/watch?v=bS5P_LAqiVg")
+	dstUrl, _ := url.Parse("https://s3.amazonaws.com/videos/bS5P_LAqiVg.mp4")
+	video := &DownloadVideo{Id: "1", Username: "alma", Name: "Alma", Language: "en", Status: JobDone, SrcUrl: srcUrl, DstUrl: dstUrl,
+		Title: "Schnee", Thumbnail: "https://i.ytimg.com/vi/bS5P_LAqiVg/hq.jpg", Duration: 90 * time.Second, FileSize: 3 << 20}
+	email := &RecordingMailer{}
+	MultiMailer{email, notifier}.Notify(video)
+	assert.Equal(t, []*DownloadVideo{video}, email.Notified)
+	assert.Equal(t, []string{"/hooks/alma", "/hooks/wien"}, posted)
+	assert.Equal(t, "Alma, your video Schnee is ready", messages[0].Text)
+	attachment := messages[0].Attachments[0]
+	assert.Equal(t, "Schnee", attachment.Title)
+	assert.Equal(t, dstUrl.String(), attachment.TitleLink)
+	assert.Equal(t, video.Thumbnail, attachment.ThumbUrl)
+	assert.Equal(t, "good", attachment.Color)
+	assert.Equal(t, "1:30 · 3.0 MB", attachment.Text)
+
+	// users without webhooks aren't notified
+	notifier.Notify(&DownloadVideo{Id: "2", Username: "kurt", Status: JobDone, SrcUrl: srcUrl, DstUrl: dstUrl})
+	assert.Len(t, posted, 2)
+
+	failed := &DownloadVideo{Id: "3", Username: "alma", Status: JobFailed, SrcUrl: srcUrl, Error: errors.New("exit status 1")}
+	notifier.Digest(&NotificationDigest{Name: "Alma", Language: "en", Jobs: []*DownloadVideo{video, failed}})
+	assert.Len(t, posted, 4)
+	assert.Equal(t, "Alma, 2 downloads finished", messages[2].Text)
+	assert.Len(t, messages[2].Attachments, 2)
+	attachment = messages[2].Attachments[1]
+	assert.Equal(t, "danger", attachment.Color)
+	assert.Equal(t, srcUrl.String(), attachment.TitleLink)
+	assert.Equal(t, "exit status 1", attachment.Text)
+
+	// the webhooks of the accounts can't post to private addresses, the
+	// channels of the config can
+	notifier = NewChatNotifier(channels, templates, repo, NewURLPolicy(&URLPolicyConfig{}))
+	trustTestServer(notifier, webhook)
+	notifier.Notify(video)
+	assert.Equal(t, []string{"/hooks/wien"}, posted[4:])
+}
+
+// trustTestServer makes the clients of notifier trust the certificate of a
+// TLS test server
+func trustTestServer(notifier *ChatNotifier, server *httptest.Server) {
+	tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig
+	notifier.Client.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+	notifier.Trusted.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+}
+
+func TestValidChatWebhook(t *testing.T) {
+	assert.True(t, ValidChatWebhook("https://hooks.slack.com/services/T000/B000/XXXX"))
+	assert.False(t, ValidChatWebhook("http://mattermost.local/hooks/xxx"))
+	assert.True(t, ValidChannelWebhook("http://mattermost.local/hooks/xxx"))
+	assert.False(t, ValidChannelWebhook("video-team"))
+	assert.True(t, ValidChatWebhook("video-team"))
+	assert.False(t, ValidChatWebhook("ftp://example.com/hook"))
+	assert.False(t, ValidChatWebhook("https://"))
+	assert.False(t, ValidChatWebhook("video team"))
+}
+
+func TestCheckChatWebhooks(t *testing.T) {
+	server := &HttpServer{URLPolicy: NewURLPolicy(&URLPolicyConfig{DenyHosts: []string{"evil.example.com"}})}
+	server.URLPolicy.LookupIP = func(host string) ([]net.IP, error) {
+		if host == "metadata.internal" {
+			return []net.IP{net.ParseIP("169.254.169.254")}, nil
+		}
+		return []net.IP{net.ParseIP("34.192.0.1")}, nil
+	}
+	assert.Nil(t, server.CheckChatWebhooks([]string{"https://hooks.slack.com/services/T000/B000/XXXX", "video-team"}))
+	assert.NotNil(t, server.CheckChatWebhooks([]string{"https://metadata.internal/latest"}))
+	assert.NotNil(t, server.CheckChatWebhooks([]string{"https://127.0.0.1:8080/admin"}))
+	assert.NotNil(t, server.CheckChatWebhooks([]string{"https://evil.example.com/hook"}))
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// the shortest hs256key, as long as the hash (RFC 7518, 3.2)
+const minHS256KeyLength = 32
+
+// ConfigErrors lists the problems found in a config
+type ConfigErrors []string
+
+func (errs ConfigErrors) Error() string {
+	return fmt.Sprintf("%d problems in the config:\n  %s", len(errs), strings.Join(errs, "\n  "))
+}
+
+func (errs *ConfigErrors) add(format string, args ...interface{}) {
+	*errs = append(*errs, fmt.Sprintf(format, args...))
+}
+
+// Validate checks the whole config, returning all its problems as
+// ConfigErrors (nil if there are none)
+func (config *Config) Validate() error {
+	errs := ConfigErrors{}
+	config.validateKeys(&errs)
+	config.validateAccounts(&errs)
+
+	mailgun := &config.MailgunConfig
+	if mailgun.From == "" {
+		errs.add("mailgun.from is required")
+	} else if _, err := mail.ParseAddress(mailgun.From); err != nil {
+		errs.add("mailgun.from: invalid email %q", mailgun.From)
+	}
+	if mailgun.Key == "" {
+		errs.add("mailgun.key is required")
+	}
+	if mailgun.Domain == "" {
+		errs.add("mailgun.domain is required")
+	}
+	if mailgun.Templates != "" {
+		checkDir(&errs, "mailgun.templates", mailgun.Templates)
+	}
+	if mailgun.Language != "" && !languageTag.MatchString(mailgun.Language) {
+		errs.add("mailgun.language: invalid language %q", mailgun.Language)
+	}
+
+	s3 := &config.S3Config
+	if s3.AccessKey == "" {
+		errs.add("s3.accessKey is required")
+	}
+	if s3.SecretKey == "" {
+		errs.add("s3.secretKey is required")
+	}
+	if s3.Bucket == "" {
+		errs.add("s3.bucket is required")
+	}
+	if s3.LinkLifetime < 0 {
+		errs.add("s3.linkLifetime can't be negative")
+	}
+
+	// created if missing, but their parents must be there
+	dbPath := config.Database.Path
+	if dbPath == "" {
+		dbPath = "yutubaas.db"
+	}
+	checkDir(&errs, "database.path", filepath.Dir(dbPath))
+	if config.JobsConfig.LogDir != "" {
+		checkMkdir(&errs, "jobs.logDir", config.JobsConfig.LogDir)
+	}
+	if config.Sandbox.WorkDir != "" {
+		checkMkdir(&errs, "sandbox.workDir", config.Sandbox.WorkDir)
+	}
+	if port := config.Sandbox.ProxyPort; port < 0 || port > 65535 {
+		errs.add("sandbox.proxyPort: invalid port %d", port)
+	}
+
+	// else anyone can send requests as our users
+	if inbound := &config.Inbound; inbound.Token != "" {
+		if !inbound.RequireSPF && !inbound.RequireDKIM {
+			errs.add("inbound.requireSpf or inbound.requireDkim is required with inbound.token")
+		}
+		if inbound.AuthservID == "" {
+			errs.add("inbound.authservId is required with inbound.token")
+		}
+	}
+	for role := range config.Roles {
+		if !ValidRole(role) {
+			errs.add("roles: unknown role %s", role)
+		}
+	}
+	for i, pattern := range config.Direct.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs.add("direct.patterns %d: %s", i, err)
+		}
+	}
+	for _, name := range sortedKeys(config.Chat.Channels) {
+		webhook := config.Chat.Channels[name]
+		if !validChannel.MatchString(name) {
+			errs.add("chat.channels: invalid channel name %q", name)
+		}
+		if !ValidChannelWebhook(webhook) {
+			errs.add("chat.channels %s: invalid webhook url", name)
+		}
+	}
+	if oidc := &config.OIDC; oidc.Issuer != "" {
+		if u, err := url.Parse(oidc.Issuer); err != nil || u.Scheme != "https" {
+			errs.add("oidc.issuer must be an https url")
+		}
+		if oidc.ClientId == "" {
+			errs.add("oidc.clientId is required with an issuer")
+		}
+		if oidc.RedirectURL == "" {
+			errs.add("oidc.redirectUrl is required with an issuer")
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateKeys checks the keys signing the tokens: the hs256key, or the
+// signing keys and their PEM files
+func (config *Config) validateKeys(errs *ConfigErrors) {
+	if config.HS256key == "" && len(config.Signing.Keys) == 0 {
+		errs.add("hs256key or signing.keys is required")
+	} else if config.HS256key != "" && len(config.HS256key) < minHS256KeyLength {
+		errs.add("hs256key must have at least %d bytes, it has %d", minHS256KeyLength, len(config.HS256key))
+	}
+	kids := make(map[string]bool)
+	for i, keyConfig := range config.Signing.Keys {
+		if keyConfig.Kid == "" {
+			errs.add("signing.keys %d: kid is required", i)
+			continue
+		}
+		if kids[keyConfig.Kid] {
+			errs.add("signing.keys %d: duplicated kid %s", i, keyConfig.Kid)
+		}
+		kids[keyConfig.Kid] = true
+		if _, err := LoadSigningKey(&keyConfig); err != nil {
+			errs.add("signing.keys %s: %s", keyConfig.Kid, err)
+		}
+	}
+	if config.Signing.Current != "" && !kids[config.Signing.Current] {
+		errs.add("signing.current: unknown key %s", config.Signing.Current)
+	}
+}
+
+// validateAccounts checks the accounts like the /users api, and that no
+// address belongs to two of them
+func (config *Config) validateAccounts(errs *ConfigErrors) {
+	owners := make(map[string]string) // normalized address -> username
+	usernames := make([]string, 0, len(config.Accounts))
+	for username := range config.Accounts {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	for _, username := range usernames {
+		account := config.Accounts[username]
+		prefix := "accounts." + username
+		if !validUsername.MatchString(username) {
+			errs.add("%s: invalid username", prefix)
+		}
+		if account.Password == "" {
+			errs.add("%s: password is required", prefix)
+		}
+		if account.Email == "" {
+			errs.add("%s: email is required", prefix)
+		}
+		for _, email := range account.Emails() {
+			if email == "" {
+				continue
+			}
+			normalized, err := NormalizeEmail(email)
+			if err != nil {
+				errs.add("%s: invalid email %q", prefix, email)
+				continue
+			}
+			if owner, ok := owners[normalized]; ok {
+				if owner == username {
+					errs.add("%s: email %s is repeated", prefix, email)
+				} else {
+					errs.add("%s: email %s already belongs to %s", prefix, email, owner)
+				}
+				continue
+			}
+			owners[normalized] = username
+		}
+		if account.Role != "" && !ValidRole(account.Role) {
+			errs.add("%s: invalid role %q", prefix, account.Role)
+		}
+		if account.Language != "" && !languageTag.MatchString(account.Language) {
+			errs.add("%s: invalid language %q", prefix, account.Language)
+		}
+		if account.Notify != "" && !ValidNotify(account.Notify) {
+			errs.add("%s: invalid notify %q, must be immediate, digest or none", prefix, account.Notify)
+		}
+		for _, webhook := range account.Chat {
+			if !ValidChatWebhook(webhook) {
+				errs.add("%s: invalid chat webhook %q", prefix, webhook)
+			} else if _, ok := config.Chat.Channels[webhook]; !strings.Contains(webhook, "://") && !ok {
+				errs.add("%s: unknown chat channel %s", prefix, webhook)
+			}
+		}
+	}
+}
+
+// checkDir adds an error unless dir is an existing directory
+func checkDir(errs *ConfigErrors, field string, dir string) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		errs.add("%s: %s", field, err)
+	} else if !info.IsDir() {
+		errs.add("%s: %s isn't a directory", field, dir)
+	}
+}
+
+// checkMkdir adds an error unless dir is a directory or can be created in
+// an existing one
+func checkMkdir(errs *ConfigErrors, field string, dir string) {
+	for path := filepath.Clean(dir); ; path = filepath.Dir(path) {
+		info, err := os.Stat(path)
+		if err == nil {
+			if !info.IsDir() {
+				errs.add("%s: %s isn't a directory", field, path)
+			}
+			return
+		}
+		// a missing directory, or a file in the way found above
+		if pathErr, ok := err.(*os.PathError); !os.IsNotExist(err) && !(ok && pathErr.Err == syscall.ENOTDIR) {
+			errs.add("%s: %s", field, err)
+			return
+		}
+		if parent := filepath.Dir(path); parent == path {
+			return
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
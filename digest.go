@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// how an user hears about its finished jobs
+const (
+	NotifyImmediate = "immediate" // an email per job, the default
+	NotifyDigest    = "digest"    // the jobs finished in a window, in one email
+	NotifyNone      = "none"
+)
+
+func ValidNotify(notify string) bool {
+	return notify == NotifyImmediate || notify == NotifyDigest || notify == NotifyNone
+}
+
+func (account *ConfigUser) GetNotify() string {
+	if account.Notify == "" {
+		return NotifyImmediate
+	}
+	return account.Notify
+}
+
+type NotificationsConfig struct {
+	DigestWindow int "digestWindow" // seconds the jobs of a digest are collected, 1 hour by default
+}
+
+// NotificationDigest is the email with the jobs of an user finished in a
+// window
+type NotificationDigest struct {
+	Name     string
+	Email    string
+	Language string
+	Jobs     []*DownloadVideo
+}
+
+func (digest *NotificationDigest) Done() []*DownloadVideo {
+	var done []*DownloadVideo
+	for _, job := range digest.Jobs {
+		if job.Status == JobDone {
+			done = append(done, job)
+		}
+	}
+	return done
+}
+
+// Failed returns the failed and cancelled jobs
+func (digest *NotificationDigest) Failed() []*DownloadVideo {
+	var failed []*DownloadVideo
+	for _, job := range digest.Jobs {
+		if job.Status != JobDone {
+			failed = append(failed, job)
+		}
+	}
+	return failed
+}
+
+// DigestJob is what a digest keeps of a finished job, the fields the
+// notifications show
+type DigestJob struct {
+	Id         string
+	SrcUrl     string
+	DstUrl     string
+	Title      string
+	Name       string
+	Username   string
+	Email      string
+	Language   string
+	Duration   time.Duration
+	Thumbnail  string
+	FileSize   int64
+	Expires    time.Time
+	Error      string
+	ErrorLines []string
+	Status     JobStatus
+	Created    time.Time
+}
+
+func NewDigestJob(video *DownloadVideo) *DigestJob {
+	job := &DigestJob{Id: video.Id, Title: video.Title, Name: video.Name, Username: video.Username, Email: video.Email,
+		Language: video.Language, Duration: video.Duration, Thumbnail: video.Thumbnail, FileSize: video.FileSize,
+		Expires: video.Expires, ErrorLines: video.ErrorLines, Status: video.Status, Created: video.Created}
+	if video.SrcUrl != nil {
+		job.SrcUrl = video.SrcUrl.String()
+	}
+	if video.DstUrl != nil {
+		job.DstUrl = video.DstUrl.String()
+	}
+	if video.Error != nil {
+		job.Error = video.Error.Error()
+	}
+	return job
+}
+
+// Video returns the job as the notifications render it
+func (job *DigestJob) Video() *DownloadVideo {
+	video := &DownloadVideo{Id: job.Id, Title: job.Title, Name: job.Name, Username: job.Username, Email: job.Email,
+		Language: job.Language, Duration: job.Duration, Thumbnail: job.Thumbnail, FileSize: job.FileSize,
+		Expires: job.Expires, ErrorLines: job.ErrorLines, Status: job.Status, Created: job.Created}
+	video.SrcUrl, _ = url.Parse(job.SrcUrl)
+	if job.DstUrl != "" {
+		video.DstUrl, _ = url.Parse(job.DstUrl)
+	}
+	if job.Error != "" {
+		video.Error = errors.New(job.Error)
+	}
+	return video
+}
+
+// PendingDigest is a digest still collecting jobs, stored so a restart
+// doesn't lose it
+type PendingDigest struct {
+	Username string
+	Started  time.Time // its window ends Window after
+	Name     string
+	Email    string
+	Language string
+	Jobs     []*DigestJob
+}
+
+func (pending *PendingDigest) Digest() *NotificationDigest {
+	digest := &NotificationDigest{Name: pending.Name, Email: pending.Email, Language: pending.Language}
+	for _, job := range pending.Jobs {
+		digest.Jobs = append(digest.Jobs, job.Video())
+	}
+	return digest
+}
+
+type DigestRepository interface {
+	AddToDigest(job *DigestJob, now time.Time) (bool, error) // true if it started a digest
+	TakeDigest(username string) (*PendingDigest, error)      // removes it, nil if there isn't
+	ListDigests() ([]*PendingDigest, error)
+}
+
+// BoltDigestRepository stores the pending digests, as json by username, in a
+// bolt database
+type BoltDigestRepository struct {
+	DB *bolt.DB
+}
+
+var digestsBucket = []byte("digests")
+
+func NewBoltDigestRepository(db *bolt.DB) (*BoltDigestRepository, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(digestsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltDigestRepository{db}, nil
+}
+
+func (repo *BoltDigestRepository) AddToDigest(job *DigestJob, now time.Time) (bool, error) {
+	started := false
+	err := repo.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(digestsBucket)
+		digest := &PendingDigest{}
+		if v := b.Get([]byte(job.Username)); v != nil {
+			if err := json.Unmarshal(v, digest); err != nil {
+				return err
+			}
+		} else {
+			digest = &PendingDigest{Username: job.Username, Started: now, Name: job.Name, Email: job.Email, Language: job.Language}
+			started = true
+		}
+		digest.Jobs = append(digest.Jobs, job)
+		v, err := json.Marshal(digest)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(job.Username), v)
+	})
+	return started, err
+}
+
+func (repo *BoltDigestRepository) TakeDigest(username string) (*PendingDigest, error) {
+	var digest *PendingDigest
+	err := repo.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(digestsBucket)
+		v := b.Get([]byte(username))
+		if v == nil {
+			return nil
+		}
+		digest = &PendingDigest{}
+		if err := json.Unmarshal(v, digest); err != nil {
+			return err
+		}
+		return b.Delete([]byte(username))
+	})
+	return digest, err
+}
+
+func (repo *BoltDigestRepository) ListDigests() ([]*PendingDigest, error) {
+	digests := []*PendingDigest{}
+	err := repo.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(digestsBucket).ForEach(func(k, v []byte) error {
+			digest := &PendingDigest{}
+			if err := json.Unmarshal(v, digest); err != nil {
+				return err
+			}
+			digests = append(digests, digest)
+			return nil
+		})
+	})
+	return digests, err
+}
+
+// DigestMailer applies the notification preference of the accounts in front
+// of another Mailer: the jobs of users with digests are collected for a
+// window and sent together, replies and confirmations go straight through.
+// The digests are stored until sent, Resume schedules the ones pending when
+// the server stopped.
+type DigestMailer struct {
+	Mailer
+	Accounts UserRepository
+	Repo     DigestRepository
+	Window   time.Duration
+	Now      func() time.Time
+	Schedule func(d time.Duration, f func()) // runs the flush of a digest, time.AfterFunc
+}
+
+func NewDigestMailer(next Mailer, accounts UserRepository, repo DigestRepository, config *NotificationsConfig) *DigestMailer {
+	mailer := &DigestMailer{Mailer: next, Accounts: accounts, Repo: repo, Now: time.Now}
+	mailer.Window = time.Hour
+	if config.DigestWindow != 0 {
+		mailer.Window = time.Duration(config.DigestWindow) * time.Second
+	}
+	mailer.Schedule = func(d time.Duration, f func()) { time.AfterFunc(d, f) }
+	return mailer
+}
+
+// Resume schedules the flush of the stored digests, right away the ones whose
+// window already ended
+func (mailer *DigestMailer) Resume() error {
+	digests, err := mailer.Repo.ListDigests()
+	if err != nil {
+		return err
+	}
+	for _, digest := range digests {
+		wait := digest.Started.Add(mailer.Window).Sub(mailer.Now())
+		if wait < 0 {
+			wait = 0
+		}
+		username := digest.Username
+		mailer.Schedule(wait, func() { mailer.Flush(username) })
+	}
+	return nil
+}
+
+func (mailer *DigestMailer) Notify(video *DownloadVideo) {
+	switch mailer.preference(video.Username) {
+	case NotifyNone:
+		log.Debug("not notifying %s about job %s", video.Username, video.Id)
+	case NotifyDigest:
+		mailer.add(video)
+	default:
+		mailer.Mailer.Notify(video)
+	}
+}
+
+// preference returns the notifications of an user when its job finishes, so
+// changes apply to the running jobs
+func (mailer *DigestMailer) preference(username string) string {
+	account, err := mailer.Accounts.GetUser(username)
+	if err != nil {
+		log.Error("error looking for account %s: %s", username, err)
+		return NotifyImmediate
+	}
+	if account == nil {
+		return NotifyImmediate
+	}
+	return account.GetNotify()
+}
+
+// add puts video in the digest of its user, starting one if there isn't. If
+// the digest can't be stored the job is notified right away.
+func (mailer *DigestMailer) add(video *DownloadVideo) {
+	started, err := mailer.Repo.AddToDigest(NewDigestJob(video), mailer.Now())
+	if err != nil {
+		log.Error("error adding job %s to the digest of %s: %s", video.Id, video.Username, err)
+		mailer.Mailer.Notify(video)
+		return
+	}
+	if started {
+		username := video.Username
+		mailer.Schedule(mailer.Window, func() { mailer.Flush(username) })
+	}
+}
+
+// Flush sends the digest of username, a plain notification if it has only
+// one job
+func (mailer *DigestMailer) Flush(username string) {
+	pending, err := mailer.Repo.TakeDigest(username)
+	if err != nil {
+		log.Error("error reading the digest of %s: %s", username, err)
+		return
+	}
+	if pending == nil {
+		return
+	}
+	digest := pending.Digest()
+	if len(digest.Jobs) == 1 {
+		mailer.Mailer.Notify(digest.Jobs[0])
+		return
+	}
+	mailer.Mailer.Digest(digest)
+}
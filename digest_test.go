@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// RecordingMailer keeps what it's asked to send
+type RecordingMailer struct {
+	MockMailer
+	Notified []*DownloadVideo
+	Digests  []*NotificationDigest
+}
+
+func (m *RecordingMailer) Notify(video *DownloadVideo) {
+	m.Notified = append(m.Notified, video)
+}
+
+func (m *RecordingMailer) Digest(digest *NotificationDigest) {
+	m.Digests = append(m.Digests, digest)
+}
+
+func TestDigestMailer(t *testing.T) {
+	repo, cleanup := newTestUserRepository(t)
+	defer cleanup()
+	assert.Nil(t, repo.CreateUser(&ConfigUser{Username: "oskar", Email: "oskar@gmail.com"}))
+	assert.Nil(t, repo.CreateUser(&ConfigUser{Username: "alma", Email: "alma@wien.at", Notify: NotifyDigest}))
+	assert.Nil(t, repo.CreateUser(&ConfigUser{Username: "kurt", Email: "kurt@wien.at", Notify: NotifyNone}))
+
+	digests, err := NewBoltDigestRepository(repo.DB)
+	require.Nil(t, err)
+	next := &RecordingMailer{}
+	mailer := NewDigestMailer(next, repo, digests, &NotificationsConfig{DigestWindow: 600})
+	var flushes []func()
+	mailer.Schedule = func(d time.Duration, f func()) {
+		assert.Equal(t, 10*time.Minute, d)
+		flushes = append(flushes, f)
+	}
+
+	mailer.Notify(&DownloadVideo{Id: "1", Username: "oskar", Status: JobDone})
+	mailer.Notify(&DownloadVideo{Id: "2", Username: "kurt", Status: JobDone})
+	mailer.Notify(&DownloadVideo{Id: "3", Username: "alma", Name: "Alma", Email: "alma@wien.at", Status: JobDone})
+	mailer.Notify(&DownloadVideo{Id: "4", Username: "alma", Status: JobFailed, Error: errors.New("exit status 1")})
+	assert.Len(t, next.Notified, 1)
+	assert.Equal(t, "1", next.Notified[0].Id)
+	assert.Empty(t, next.Digests)
+
+	// one window per digest
+	assert.Len(t, flushes, 1)
+	flushes[0]()
+	assert.Len(t, next.Digests, 1)
+	digest := next.Digests[0]
+	assert.Equal(t, "alma@wien.at", digest.Email)
+	assert.Len(t, digest.Jobs, 2)
+	assert.Equal(t, "3", digest.Done()[0].Id)
+	assert.Equal(t, "Alma", digest.Name)
+	assert.Equal(t, "4", digest.Failed()[0].Id)
+	templates, err := NewMailTemplates("templates", "es")
+	assert.Nil(t, err)
+	content, err := templates.Render(TemplateDigest, "en", digest)
+	assert.Nil(t, err)
+	assert.Equal(t, "Alma, 2 downloads finished", content.Subject)
+	assert.Contains(t, content.Html, "exit status 1")
+
+	// a digest of one job is a plain notification
+	mailer.Notify(&DownloadVideo{Id: "5", Username: "alma", Status: JobDone})
+	assert.Len(t, flushes, 2)
+	flushes[1]()
+	assert.Len(t, next.Digests, 1)
+	assert.Equal(t, "5", next.Notified[1].Id)
+}
+
+func TestDigestMailerResume(t *testing.T) {
+	repo, cleanup := newTestUserRepository(t)
+	defer cleanup()
+	assert.Nil(t, repo.CreateUser(&ConfigUser{Username: "alma", Email: "alma@wien.at", Notify: NotifyDigest}))
+	assert.Nil(t, repo.CreateUser(&ConfigUser{Username: "gustav", Email: "gustav@wien.at", Notify: NotifyDigest}))
+	digests, err := NewBoltDigestRepository(repo.DB)
+	require.Nil(t, err)
+	now := time.Date(2016, 5, 8, 10, 0, 0, 0, time.UTC)
+	mailer := NewDigestMailer(&RecordingMailer{}, repo, digests, &NotificationsConfig{DigestWindow: 600})
+	mailer.Now = func() time.Time { return now }
+	mailer.Schedule = func(d time.Duration, f func()) {}
+	src, _ := url.Parse("https://www.youtube.com/watch?v=WGyEHwVO4YY")
+	dst, _ := url.Parse("https://s3.amazonaws.com/yutubaas/video.mp4")
+	mailer.Notify(&DownloadVideo{Id: "1", Username: "alma", Email: "alma@wien.at", SrcUrl: src, DstUrl: dst, Title: "Sinfonie", Status: JobDone})
+	mailer.Notify(&DownloadVideo{Id: "2", Username: "alma", SrcUrl: src, Status: JobFailed, Error: errors.New("exit status 1")})
+	now = now.Add(5 * time.Minute)
+	mailer.Notify(&DownloadVideo{Id: "3", Username: "gustav", Email: "gustav@wien.at", SrcUrl: src, Status: JobCancelled})
+
+	// after a restart, alma's window ended
+	now = now.Add(6 * time.Minute)
+	next := &RecordingMailer{}
+	mailer = NewDigestMailer(next, repo, digests, &NotificationsConfig{DigestWindow: 600})
+	mailer.Now = func() time.Time { return now }
+	waits := make(map[time.Duration]func())
+	mailer.Schedule = func(d time.Duration, f func()) { waits[d] = f }
+	assert.Nil(t, mailer.Resume())
+	assert.Len(t, waits, 2)
+	require.NotNil(t, waits[0])
+	require.NotNil(t, waits[4*time.Minute])
+
+	waits[0]()
+	require.Len(t, next.Digests, 1)
+	digest := next.Digests[0]
+	assert.Equal(t, "alma@wien.at", digest.Email)
+	require.Len(t, digest.Jobs, 2)
+	assert.Equal(t, "Sinfonie", digest.Done()[0].Title)
+	assert.Equal(t, dst, digest.Done()[0].DstUrl)
+	assert.Equal(t, "exit status 1", digest.Failed()[0].Error.Error())
+
+	waits[4*time.Minute]()
+	require.Len(t, next.Notified, 1)
+	assert.Equal(t, "3", next.Notified[0].Id)
+	assert.Equal(t, JobCancelled, next.Notified[0].Status)
+	pending, err := digests.ListDigests()
+	assert.Nil(t, err)
+	assert.Empty(t, pending)
+
+	// flushed once
+	waits[0]()
+	assert.Len(t, next.Digests, 1)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type DirectConfig struct {
+	Patterns []string "patterns" // regexps of urls downloaded without youtube-dl
+	Probe    bool     "probe"    // send a HEAD to the other urls, to find media files
+	Timeout  int      "timeout"  // seconds waiting for a response, 30 by default
+	Retries  int      "retries"  // resumed attempts after an error, 3 by default
+}
+
+// DirectDownloadError is a download error not worth retrying
+type DirectDownloadError struct {
+	Reason string
+}
+
+func (e *DirectDownloadError) Error() string {
+	return e.Reason
+}
+
+// HttpDownloader downloads direct links to media files, resuming the
+// download with Range requests after errors. It shares the job flow
+// (log, limits, upload and notification) with DefaultDownloader.
+type HttpDownloader struct {
+	*DefaultDownloader
+	Client  *http.Client
+	Retries int
+}
+
+func NewHttpDownloader(dwn *DefaultDownloader, client *http.Client, retries int) *HttpDownloader {
+	return &HttpDownloader{dwn, client, retries}
+}
+
+func (dwn *HttpDownloader) DownloadVideo(video *DownloadVideo) {
+	finish, err := dwn.StartJob(video, dwn.CompleteMetadata)
+	defer finish()
+	if err != nil {
+		dwn.Fail(video, err)
+		return
+	}
+
+	file := filepath.Join(video.Dir, video.File)
+	part := file + ".part"
+	log.Debug("downloading %s...", video.SrcUrl)
+	for attempt := 0; ; attempt++ {
+		err = dwn.Fetch(video, part)
+		if err == nil {
+			break
+		}
+		video.Log.WriteLine("stderr", fmt.Sprintf("ERROR: %s", err))
+		if video.IsCancelled() {
+			dwn.Fail(video, err)
+			return
+		}
+		if !retryable(err) || attempt >= dwn.Retries {
+			dwn.Fail(video, err)
+			return
+		}
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+	if video.Checksum != "" {
+		if err := VerifyChecksum(part, video.Checksum); err != nil {
+			dwn.Fail(video, err)
+			return
+		}
+		video.Log.WriteLine("direct", fmt.Sprintf("checksum %s verified", video.Checksum))
+	}
+	if err := os.Rename(part, file); err != nil {
+		dwn.Fail(video, err)
+		return
+	}
+
+	dwn.UploadVideo(video)
+}
+
+// retryable tells if a failed fetch is worth resuming: not after errors of
+// the file, its limits or the url policy (from the dialer or the redirects,
+// wrapped by the client)
+func retryable(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	switch err.(type) {
+	case *DirectDownloadError, *LimitError, *URLPolicyError:
+		return false
+	}
+	return true
+}
+
+// Fetch downloads the video to part, resuming from its current size
+func (dwn *HttpDownloader) Fetch(video *DownloadVideo, part string) error {
+	file, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", video.SrcUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Cancel = video.Cancelled
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		video.Log.WriteLine("direct", fmt.Sprintf("resuming download from byte %d", offset))
+	}
+	res, err := dwn.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body := bufio.NewReader(res.Body)
+	switch res.StatusCode {
+	case http.StatusOK:
+		// full content, the server ignored the range (or there was none)
+		if offset > 0 {
+			if err := file.Truncate(0); err != nil {
+				return err
+			}
+			if offset, err = file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		head, _ := body.Peek(512)
+		if err := CheckMediaType(res.Header.Get("Content-Type"), head); err != nil {
+			return err
+		}
+		if video.Checksum == "" {
+			video.Checksum = DigestChecksum(res.Header)
+		}
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return fmt.Errorf("unexpected Content-Range %q resuming from %d", res.Header.Get("Content-Range"), offset)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		if video.FileSize > 0 && offset == video.FileSize {
+			return nil // already complete
+		}
+		return fmt.Errorf("can't resume download from byte %d", offset)
+	default:
+		if res.StatusCode >= 500 {
+			return fmt.Errorf("unexpected response %s", res.Status)
+		}
+		return &DirectDownloadError{fmt.Sprintf("unexpected response %s", res.Status)}
+	}
+
+	var src io.Reader = body
+	if video.Limits.MaxFileSize > 0 {
+		// one byte more than allowed, to know it was exceeded
+		src = io.LimitReader(body, video.Limits.MaxFileSize-offset+1)
+	}
+	written, err := io.Copy(file, src)
+	video.Log.WriteLine("direct", fmt.Sprintf("%d bytes downloaded", offset+written))
+	if video.Limits.MaxFileSize > 0 && offset+written > video.Limits.MaxFileSize {
+		return &LimitError{fmt.Sprintf("download aborted after %d bytes, exceeding the limit of %d bytes", offset+written, video.Limits.MaxFileSize)}
+	}
+	return err
+}
+
+// CompleteMetadata gets the name, size and checksum of the file with a HEAD
+// request
+func (dwn *HttpDownloader) CompleteMetadata(video *DownloadVideo) error {
+	req, err := http.NewRequest("HEAD", video.SrcUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Cancel = video.Cancelled
+	res, err := dwn.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return &DirectDownloadError{fmt.Sprintf("unexpected response %s", res.Status)}
+	}
+	if err := CheckMediaType(res.Header.Get("Content-Type"), nil); err != nil {
+		return err
+	}
+	video.File = DirectFileName(res)
+	video.Title = strings.TrimSuffix(video.File, filepath.Ext(video.File))
+	video.Extractor = "Generic" // as youtube-dl calls them
+	if res.ContentLength > 0 {
+		video.FileSize = res.ContentLength
+	}
+	if video.Checksum == "" {
+		video.Checksum = DigestChecksum(res.Header)
+	}
+	return nil
+}
+
+// CheckMediaType accepts audio and video content types. Generic binary
+// content is sniffed from head, if available.
+func CheckMediaType(contentType string, head []byte) error {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "" || mediaType == "application/octet-stream" || mediaType == "binary/octet-stream" {
+		if head == nil {
+			return nil
+		}
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+		// DetectContentType doesn't know every container
+		if mediaType == "application/octet-stream" {
+			return nil
+		}
+	}
+	if strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/") {
+		return nil
+	}
+	return &DirectDownloadError{fmt.Sprintf("content type %s is not audio or video", mediaType)}
+}
+
+// DirectFileName returns the file name from the Content-Disposition or the
+// url of the response
+func DirectFileName(res *http.Response) string {
+	name := ""
+	if _, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		name = path.Base(res.Request.URL.Path)
+	}
+	name = filepath.Base(strings.Replace(name, "\\", "/", -1))
+	if name == "." || name == "/" || strings.HasPrefix(name, ".") {
+		name = "video" + name
+	}
+	return name
+}
+
+// DigestChecksum returns the checksum sent by the server in the Digest or
+// Content-MD5 headers, as algorithm:hex
+func DigestChecksum(header http.Header) string {
+	for _, digest := range strings.Split(header.Get("Digest"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(digest), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		algorithm := strings.Replace(strings.ToLower(parts[0]), "-", "", -1)
+		if _, ok := checksumHashes[algorithm]; !ok {
+			continue
+		}
+		if sum, err := base64.StdEncoding.DecodeString(parts[1]); err == nil {
+			return fmt.Sprintf("%s:%x", algorithm, sum)
+		}
+	}
+	if md5sum, err := base64.StdEncoding.DecodeString(header.Get("Content-MD5")); err == nil && len(md5sum) == md5.Size {
+		return fmt.Sprintf("md5:%x", md5sum)
+	}
+	return ""
+}
+
+var checksumHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// CheckChecksum checks the format of a checksum, algorithm:hex (md5, sha1
+// and sha256 supported)
+func CheckChecksum(checksum string) error {
+	_, err := parseChecksum(checksum)
+	return err
+}
+
+func parseChecksum(checksum string) (func() hash.Hash, error) {
+	parts := strings.SplitN(checksum, ":", 2)
+	newHash, ok := checksumHashes[strings.ToLower(parts[0])]
+	if len(parts) != 2 || !ok {
+		return nil, &DirectDownloadError{fmt.Sprintf("unsupported checksum %q", checksum)}
+	}
+	if sum, err := hex.DecodeString(parts[1]); err != nil || len(sum) != newHash().Size() {
+		return nil, &DirectDownloadError{fmt.Sprintf("invalid %s checksum %q", parts[0], parts[1])}
+	}
+	return newHash, nil
+}
+
+// VerifyChecksum checks the file against a checksum in the algorithm:hex
+// format
+func VerifyChecksum(file string, checksum string) error {
+	newHash, err := parseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(checksum, ":", 2)
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, parts[1]) {
+		return &DirectDownloadError{fmt.Sprintf("checksum mismatch, expected %s but got %s:%s", checksum, parts[0], sum)}
+	}
+	return nil
+}
+
+// DispatchDownloader sends every video to the right downloader: youtube-dl
+// by default, or the direct downloader for urls matching the patterns or
+// (with Probe) answering a HEAD with an audio or video content type, unless
+// the job has download options.
+type DispatchDownloader struct {
+	YoutubeDl Downloader
+	Direct    *HttpDownloader
+	Patterns  []*regexp.Regexp
+	Probe     bool
+}
+
+func NewDispatchDownloader(youtubeDl Downloader, direct *HttpDownloader, config *DirectConfig) (*DispatchDownloader, error) {
+	dispatcher := &DispatchDownloader{YoutubeDl: youtubeDl, Direct: direct, Probe: config.Probe}
+	for _, pattern := range config.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		dispatcher.Patterns = append(dispatcher.Patterns, re)
+	}
+	return dispatcher, nil
+}
+
+func (dispatcher *DispatchDownloader) DownloadVideo(video *DownloadVideo) {
+	dispatcher.Pick(video).DownloadVideo(video)
+}
+
+func (dispatcher *DispatchDownloader) CompleteMetadata(video *DownloadVideo) error {
+	return dispatcher.Pick(video).CompleteMetadata(video)
+}
+
+// Pick returns the downloader of video, remembering the choice in it
+func (dispatcher *DispatchDownloader) Pick(video *DownloadVideo) Downloader {
+	if video.Downloader == "" {
+		video.Downloader = dispatcher.choose(video)
+		log.Debug("%s downloaded with %s", video.SrcUrl, video.Downloader)
+	}
+	if video.Downloader == "direct" {
+		return dispatcher.Direct
+	}
+	return dispatcher.YoutubeDl
+}
+
+func (dispatcher *DispatchDownloader) choose(video *DownloadVideo) string {
+	if !video.Options.IsZero() {
+		// only youtube-dl converts or cuts videos
+		return "youtube-dl"
+	}
+	for _, pattern := range dispatcher.Patterns {
+		if pattern.MatchString(video.SrcUrl.String()) {
+			return "direct"
+		}
+	}
+	if dispatcher.Probe {
+		res, err := dispatcher.Direct.Client.Head(video.SrcUrl.String())
+		if err != nil {
+			log.Debug("error probing %s: %s", video.SrcUrl, err)
+			return "youtube-dl"
+		}
+		res.Body.Close()
+		mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if res.StatusCode == http.StatusOK && (strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/")) {
+			return "direct"
+		}
+	}
+	return "youtube-dl"
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHttpDownloaderResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "video.mp4", time.Now(), bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "yutubaas")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	dwn := NewHttpDownloader(nil, http.DefaultClient, 0)
+	video := &DownloadVideo{}
+	video.SrcUrl, err = url.ParseRequestURI(server.URL + "/files/video.mp4")
+	assert.Nil(t, err)
+	video.Log, err = OpenJobLog("job", filepath.Join(dir, "job.log"), 0, 0)
+	assert.Nil(t, err)
+	defer video.Log.Close()
+
+	assert.Nil(t, dwn.CompleteMetadata(video))
+	assert.Equal(t, "video.mp4", video.File)
+	assert.Equal(t, "video", video.Title)
+	assert.Equal(t, int64(len(content)), video.FileSize)
+
+	// resume a partial download
+	part := filepath.Join(dir, "video.mp4.part")
+	assert.Nil(t, ioutil.WriteFile(part, content[:1234], 0640))
+	assert.Nil(t, dwn.Fetch(video, part))
+	downloaded, err := ioutil.ReadFile(part)
+	assert.Nil(t, err)
+	assert.Equal(t, content, downloaded)
+	assert.Nil(t, VerifyChecksum(part, fmt.Sprintf("sha256:%x", sha256.Sum256(content))))
+	assert.NotNil(t, VerifyChecksum(part, fmt.Sprintf("sha256:%x", sha256.Sum256(content[1:]))))
+
+	// and abort when the file is too big
+	assert.Nil(t, os.Remove(part))
+	video.Limits.MaxFileSize = 5000
+	err = dwn.Fetch(video, part)
+	assert.IsType(t, &LimitError{}, err)
+}
+
+func TestHttpDownloaderRetryable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("private address reached by the direct downloader")
+	}))
+	defer server.Close()
+
+	// a public name resolving to a private address when dialed
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+	_, err := newTestURLPolicy(&URLPolicyConfig{}).HttpClient(time.Second).Get(fmt.Sprintf("http://localhost:%d/video.mp4", port))
+	assert.NotNil(t, err)
+	assert.False(t, retryable(err))
+	assert.False(t, retryable(&LimitError{"too big"}))
+	assert.True(t, retryable(errors.New("unexpected EOF")))
+
+	assert.Nil(t, CheckChecksum(fmt.Sprintf("sha256:%x", sha256.Sum256(nil))))
+	assert.NotNil(t, CheckChecksum("sha256:abc"))
+	assert.NotNil(t, CheckChecksum("md5:zz"))
+	assert.NotNil(t, CheckChecksum("crc32:cbf43926"))
+}
+
+func TestCheckMediaType(t *testing.T) {
+	assert.Nil(t, CheckMediaType("video/mp4", nil))
+	assert.Nil(t, CheckMediaType("audio/mpeg; charset=binary", nil))
+	assert.Nil(t, CheckMediaType("application/octet-stream", nil))
+	assert.Equal(t, "content type text/html is not audio or video", CheckMediaType("text/html; charset=utf-8", nil).Error())
+	assert.Equal(t, "content type text/html is not audio or video", CheckMediaType("application/octet-stream", []byte("<html><body>not found</body></html>")).Error())
+}
+
+func TestDigestChecksum(t *testing.T) {
+	header := http.Header{}
+	header.Set("Digest", "unixsum=30637, SHA-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=")
+	assert.Equal(t, "sha256:5f8f04f6a3a892aaabbddb6cf273894493773960d4a325b105fee46eef4304f1", DigestChecksum(header))
+	header = http.Header{}
+	header.Set("Content-MD5", "XrY7u+Ae7tCTyyK7j1rNww==")
+	assert.Equal(t, "md5:5eb63bbbe01eeed093cb22bb8f5acdc3", DigestChecksum(header))
+	assert.Equal(t, "", DigestChecksum(http.Header{}))
+}
+
+func TestDispatchDownloaderPatterns(t *testing.T) {
+	direct := NewHttpDownloader(nil, http.DefaultClient, 0)
+	youtubeDl := NewMockDownloader(t)
+	dispatcher, err := NewDispatchDownloader(youtubeDl, direct, &DirectConfig{Patterns: []string{`\.mp4$`}})
+	assert.Nil(t, err)
+
+	video := &DownloadVideo{}
+	video.SrcUrl, _ = url.ParseRequestURI("https://example.com/video.mp4")
+	assert.Equal(t, direct, dispatcher.Pick(video))
+	assert.Equal(t, "direct", video.Downloader)
+
+	video = &DownloadVideo{}
+	video.SrcUrl, _ = url.ParseRequestURI("https://www.youtube.com/watch?v=bS5P_LAqiVg")
+	assert.Equal(t, youtubeDl, dispatcher.Pick(video))
+	assert.Equal(t, "youtube-dl", video.Downloader)
+}
@@ -1,115 +1,307 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"net/url"
 	"os"
 	"os/exec"
-	"strings"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
 type DownloadVideo struct {
-	SrcUrl   *url.URL // youtube url
-	DstUrl   *url.URL // youtube url
-	Title    string   // video title
-	Name     string   // name of the user
-	Username string
-	Email    string
-	File     string
-	Error    error
+	Id         string   // job id
+	SrcUrl     *url.URL // youtube url
+	DstUrl     *url.URL // youtube url
+	Title      string   // video title
+	Name       string   // name of the user
+	Username   string
+	Email      string
+	Language   string // of the user, for the notifications
+	File       string // name of the downloaded file
+	Dir        string // working directory of the job
+	Duration   time.Duration
+	Thumbnail  string    // url of the thumbnail reported by youtube-dl
+	FileSize   int64     // estimated before downloading, the real one after uploading
+	IsLive     bool      // live or upcoming stream
+	Extractor  string    // youtube-dl extractor
+	Downloader string    // youtube-dl or direct, chosen by DispatchDownloader
+	Checksum   string    // algorithm:hex, verified by the direct downloader
+	Expires    time.Time // of DstUrl, zero if it doesn't expire
+	Options    DownloadOptions
+	Limits     Limits
+	Error      error
+	ErrorLines []string // last error lines reported by youtube-dl
+	MessageIds []string // of the notifications, given by the email provider
+	Status     JobStatus
+	Cancelled  chan struct{} // closed when the job is cancelled
+	Created    time.Time
+	LogFile    string  // path of the job log
+	Log        *JobLog // open while the job is running
 }
 
 type Downloader interface {
 	DownloadVideo(video *DownloadVideo)
+	CompleteMetadata(video *DownloadVideo) error
 }
 
 type DefaultDownloader struct {
 	VideoRepo VideoRepository
 	Mailer    Mailer
+	Jobs      JobRepository
+	LogConfig JobLogConfig
+	URLPolicy *URLPolicy
+	Sandbox   *Sandbox
+	Proxy     string // url of the EgressProxy youtube-dl connects through
 }
 
-func NewDefaultDownloader(videoRepo VideoRepository, mailer Mailer) *DefaultDownloader {
-	return &DefaultDownloader{videoRepo, mailer}
+type JobLogConfig struct {
+	Dir        string
+	MaxSize    int64
+	MaxBackups int
+}
+
+func NewDefaultDownloader(videoRepo VideoRepository, mailer Mailer, jobs JobRepository, logConfig *JobLogConfig, urlPolicy *URLPolicy, sandbox *Sandbox) *DefaultDownloader {
+	dwn := &DefaultDownloader{videoRepo, mailer, jobs, *logConfig, urlPolicy, sandbox, ""}
+	if dwn.LogConfig.Dir == "" {
+		dwn.LogConfig.Dir = filepath.Join(os.TempDir(), "yutubaas-logs")
+	}
+	if dwn.LogConfig.MaxSize == 0 {
+		dwn.LogConfig.MaxSize = 1 << 20
+	}
+	return dwn
 }
 
 func (dwn *DefaultDownloader) DownloadVideo(video *DownloadVideo) {
-	// get title and filename
-	var err error
-	err = dwn.CompleteMetadata(video)
+	finish, err := dwn.StartJob(video, dwn.CompleteMetadata)
+	defer finish()
 	if err != nil {
-		log.Error("error getting metadata for %s: %s", video.SrcUrl.String(), err)
-		video.Error = err
-		dwn.Mailer.Notify(video)
+		dwn.Fail(video, err)
 		return
 	}
 
 	// download video
-	cmd := exec.Command("youtube-dl", "--newline", video.SrcUrl.String())
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Error("error downloading %s: %s", video.SrcUrl.String(), err)
-		video.Error = err
-		dwn.Mailer.Notify(video)
-		return
-	}
-	if err := cmd.Start(); err != nil {
-		log.Error("error downloading %s: %s", video.SrcUrl.String(), err)
-		video.Error = err
-		dwn.Mailer.Notify(video)
-		return
+	args := append([]string{"--newline"}, video.Options.DownloadArgs()...)
+	if video.Limits.MaxFileSize > 0 {
+		args = append(args, "--max-filesize", strconv.FormatInt(video.Limits.MaxFileSize, 10))
 	}
+	cmd := dwn.Sandbox.Command(video.Dir, "youtube-dl", append(args, video.SrcUrl.String())...)
+	dwn.useProxy(cmd)
+	cmd.Stdout = video.Log.Stream("stdout")
+	cmd.Stderr = video.Log.Stream("stderr")
 	log.Debug("downloading %s...", video.SrcUrl)
-	ro := bufio.NewReader(stdout)
-	scanner := bufio.NewScanner(ro)
-	for scanner.Scan() {
-		log.Debug("[%s] %s\n", video.SrcUrl, scanner.Text())
-	}
-	if err := scanner.Err(); err != nil {
-		log.Error("error downloading %s: %s", video.SrcUrl.String(), err)
-		video.Error = err
-		dwn.Mailer.Notify(video)
+	if err := dwn.Sandbox.Start(cmd); err != nil {
+		dwn.Fail(video, err)
 		return
 	}
-	if err := cmd.Wait(); err != nil {
-		log.Error("error downloading %s: %s", video.SrcUrl.String(), err)
-		video.Error = err
-		dwn.Mailer.Notify(video)
+	stopCancel := watchCancel(video, cmd)
+	if video.Limits.MaxFileSize > 0 {
+		// the estimated size isn't always available (or right)
+		watcher := NewSizeWatcher(filepath.Join(video.Dir, video.File), video.Limits.MaxFileSize)
+		go watcher.Watch(cmd)
+		err = dwn.Sandbox.Wait(cmd)
+		watcher.Stop()
+		if limitErr := watcher.Err(); limitErr != nil {
+			err = limitErr
+		}
+	} else {
+		err = dwn.Sandbox.Wait(cmd)
+	}
+	stopCancel()
+	if err != nil {
+		dwn.Fail(video, err)
 		return
 	}
 
-	// put into S3
-	log.Debug("uploading %s to S3", video.Title)
-	if err = dwn.VideoRepo.SaveVideo(video); err != nil {
-		log.Error("error downloading %s: %s", video.SrcUrl.String(), err)
-		video.Error = err
-		dwn.Mailer.Notify(video)
-		return
+	dwn.UploadVideo(video)
+}
+
+// StartJob opens the job log and working directory, gets the metadata with
+// completeMetadata (unless the preflight already did) and checks the
+// extractor and limits. The returned function (never nil) releases the log
+// and directory once the job is done.
+func (dwn *DefaultDownloader) StartJob(video *DownloadVideo, completeMetadata func(*DownloadVideo) error) (func(), error) {
+	finish := func() {}
+	if video.IsCancelled() {
+		return finish, ErrJobCancelled
+	}
+
+	// job log
+	if err := os.MkdirAll(dwn.LogConfig.Dir, 0750); err != nil {
+		return finish, err
+	}
+	video.LogFile = filepath.Join(dwn.LogConfig.Dir, fmt.Sprintf("%s.log", video.Id))
+	jobLog, err := OpenJobLog(video.Id, video.LogFile, dwn.LogConfig.MaxSize, dwn.LogConfig.MaxBackups)
+	if err != nil {
+		return finish, err
+	}
+	video.Log = jobLog
+	finish = func() {
+		video.Log = nil
+		if err := jobLog.Close(); err != nil {
+			log.Error("error closing log of job %s: %s", video.Id, err)
+		}
+	}
+	dir, err := dwn.Sandbox.JobDir(video.Id)
+	if err != nil {
+		return finish, err
+	}
+	video.Dir = dir
+	closeLog := finish
+	finish = func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Error("error removing directory %s: %s", dir, err)
+		}
+		closeLog()
 	}
+	video.Status = JobDownloading
+	dwn.Jobs.SaveJob(video)
 
-	if err := os.Remove(video.File); err != nil {
-		log.Error("error removing file %s: %s", video.File, err)
+	// get title and filename (unless the preflight already did)
+	if video.File == "" {
+		if err := completeMetadata(video); err != nil {
+			return finish, err
+		}
+	}
+	if err := dwn.URLPolicy.CheckExtractor(video.SrcUrl, video.Extractor); err != nil {
+		return finish, err
+	}
+	return finish, video.Limits.Check(video)
+}
+
+// UploadVideo puts the downloaded video into the repository and notifies the
+// user
+func (dwn *DefaultDownloader) UploadVideo(video *DownloadVideo) {
+	if video.IsCancelled() {
+		dwn.Fail(video, ErrJobCancelled)
+		return
+	}
+	log.Debug("uploading %s to S3", video.Title)
+	video.Status = JobUploading
+	dwn.Jobs.SaveJob(video)
+	if err := dwn.VideoRepo.SaveVideo(video); err != nil {
+		dwn.Fail(video, err)
+		return
 	}
 
 	log.Debug("done with %s, sending success email", video.Title)
+	video.Status = JobDone
+	dwn.Jobs.SaveJob(video)
+	dwn.Mailer.Notify(video)
+}
+
+// Fail marks the job as failed (or cancelled) and notifies the user
+func (dwn *DefaultDownloader) Fail(video *DownloadVideo, err error) {
+	video.Status = JobFailed
+	if video.IsCancelled() {
+		// whatever the error, it comes from killing the download
+		err = ErrJobCancelled
+		video.Status = JobCancelled
+	}
+	log.Error("error downloading %s: %s", video.SrcUrl.String(), err)
+	video.Error = err
+	if video.Log != nil {
+		video.ErrorLines = video.Log.ErrorLines()
+	}
+	dwn.Jobs.SaveJob(video)
 	dwn.Mailer.Notify(video)
 }
 
+// watchCancel kills cmd if the job is cancelled, until the returned function
+// is called
+func watchCancel(video *DownloadVideo, cmd *exec.Cmd) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-video.Cancelled:
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// metadata printed by youtube-dl -j (only the fields we use)
+type videoMetadata struct {
+	Title            string           `json:"title"`
+	Thumbnail        string           `json:"thumbnail"`
+	Filename         string           `json:"_filename"`
+	Extractor        string           `json:"extractor_key"`
+	Duration         float64          `json:"duration"`
+	IsLive           bool             `json:"is_live"`
+	LiveStatus       string           `json:"live_status"`
+	RequestedFormats []formatMetadata `json:"requested_formats"`
+	formatMetadata
+}
+
+type formatMetadata struct {
+	Filesize       int64   `json:"filesize"`
+	FilesizeApprox float64 `json:"filesize_approx"`
+	Tbr            float64 `json:"tbr"` // kbit/s
+}
+
+// estimated size in bytes of a format lasting duration seconds
+func (format *formatMetadata) Size(duration float64) int64 {
+	if format.Filesize > 0 {
+		return format.Filesize
+	}
+	if format.FilesizeApprox > 0 {
+		return int64(format.FilesizeApprox)
+	}
+	return int64(format.Tbr * 1000 / 8 * duration)
+}
+
+// useProxy makes cmd (youtube-dl, and the ffmpeg it runs) connect through
+// the EgressProxy
+func (dwn *DefaultDownloader) useProxy(cmd *exec.Cmd) {
+	if dwn.Proxy != "" {
+		// the last value of a variable wins, over the passEnv ones
+		cmd.Env = append(cmd.Env, "http_proxy="+dwn.Proxy, "https_proxy="+dwn.Proxy, "no_proxy=")
+	}
+}
+
 func (dwn *DefaultDownloader) CompleteMetadata(video *DownloadVideo) error {
-	out, err := exec.Command("youtube-dl", "-e", "--get-filename", video.SrcUrl.String()).Output()
-	if err != nil {
+	args := append([]string{"-j", "--no-playlist"}, video.Options.FormatArgs()...)
+	cmd := dwn.Sandbox.Command(video.Dir, "youtube-dl", append(args, video.SrcUrl.String())...)
+	dwn.useProxy(cmd)
+	if video.Log != nil {
+		cmd.Stderr = video.Log.Stream("stderr")
+	}
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	if err := dwn.Sandbox.Start(cmd); err != nil {
 		return err
 	}
-	buffer := bytes.NewBuffer(out)
-	if sz, err := buffer.ReadString('\n'); err != nil {
+	stopCancel := watchCancel(video, cmd)
+	err := dwn.Sandbox.Wait(cmd)
+	stopCancel()
+	if video.IsCancelled() {
+		return ErrJobCancelled
+	}
+	if err != nil {
 		return err
-	} else {
-		video.Title = strings.TrimSpace(sz)
 	}
-	if sz, err := buffer.ReadString('\n'); err != nil {
+	metadata := &videoMetadata{}
+	if err := json.Unmarshal(stdout.Bytes(), metadata); err != nil {
 		return err
+	}
+	video.Title = metadata.Title
+	video.Thumbnail = metadata.Thumbnail
+	video.File = video.Options.File(metadata.Filename)
+	video.Extractor = metadata.Extractor
+	video.Duration = time.Duration(metadata.Duration * float64(time.Second))
+	video.IsLive = metadata.IsLive || metadata.LiveStatus == "is_live" || metadata.LiveStatus == "is_upcoming"
+	if len(metadata.RequestedFormats) > 0 {
+		// video and audio downloaded separately
+		video.FileSize = 0
+		for _, format := range metadata.RequestedFormats {
+			video.FileSize += format.Size(metadata.Duration)
+		}
 	} else {
-		video.File = strings.TrimSpace(sz)
+		video.FileSize = metadata.Size(metadata.Duration)
 	}
 	return nil
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// headers of a single hop, not forwarded by the proxy
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// EgressProxy is the http proxy youtube-dl connects through. youtube-dl
+// resolves the hosts again and follows redirects and the urls of the
+// extractors, so the url policy is enforced here, on every connection, and not
+// only on the submitted url. It listens on the loopback interface, with a
+// random password so other local users can't use it.
+type EgressProxy struct {
+	Policy    *URLPolicy
+	listener  net.Listener
+	password  string
+	dialer    *net.Dialer
+	transport *http.Transport
+}
+
+// user name in the credentials of the proxy
+const egressProxyUser = "yutubaas"
+
+// NewEgressProxy starts a proxy on port of 127.0.0.1 (a random one if 0)
+func NewEgressProxy(policy *URLPolicy, port int, timeout time.Duration) (*EgressProxy, error) {
+	password, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	dialer := policy.Dialer(timeout)
+	proxy := &EgressProxy{
+		Policy:   policy,
+		listener: listener,
+		password: password,
+		dialer:   dialer,
+		transport: &http.Transport{
+			Dial:                  dialer.Dial,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+		},
+	}
+	go http.Serve(listener, proxy)
+	return proxy, nil
+}
+
+// URL returns the url of the proxy, with the credentials. It goes in the
+// environment of youtube-dl (http_proxy), the command line is public.
+func (proxy *EgressProxy) URL() string {
+	u := url.URL{Scheme: "http", User: url.UserPassword(egressProxyUser, proxy.password), Host: proxy.listener.Addr().String()}
+	return u.String()
+}
+
+func (proxy *EgressProxy) Close() error {
+	return proxy.listener.Close()
+}
+
+func (proxy *EgressProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !proxy.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="yutubaas"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method == "CONNECT" {
+		proxy.tunnel(w, r)
+	} else {
+		proxy.forward(w, r)
+	}
+}
+
+// tunnel connects to the host:port of a CONNECT request (https) and copies
+// the bytes both ways
+func (proxy *EgressProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		http.Error(w, "invalid host", http.StatusBadRequest)
+		return
+	}
+	if !proxy.allowed(w, host) {
+		return
+	}
+	conn, err := proxy.dialer.Dial("tcp", r.Host)
+	if err != nil {
+		proxy.dialError(w, r.Host, err)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		conn.Close()
+		http.Error(w, "can't tunnel", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		client.Close()
+		conn.Close()
+		return
+	}
+	go func() {
+		io.Copy(conn, buffered)
+		conn.Close()
+	}()
+	io.Copy(client, conn)
+	client.Close()
+}
+
+// forward sends a plain http request, without following redirects (each one
+// comes back through the proxy)
+func (proxy *EgressProxy) forward(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+		http.Error(w, "only absolute http urls are proxied", http.StatusBadRequest)
+		return
+	}
+	if !proxy.allowed(w, urlHost(r.URL)) {
+		return
+	}
+	req := r.WithContext(r.Context())
+	req.RequestURI = ""
+	req.Header = cloneHeader(r.Header)
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+	res, err := proxy.transport.RoundTrip(req)
+	if err != nil {
+		proxy.dialError(w, r.URL.Host, err)
+		return
+	}
+	defer res.Body.Close()
+	for _, name := range hopHeaders {
+		res.Header.Del(name)
+	}
+	for name, values := range res.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
+
+// authorized checks the basic credentials of the Proxy-Authorization header
+func (proxy *EgressProxy) authorized(r *http.Request) bool {
+	credentials := egressProxyUser + ":" + proxy.password
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Proxy-Authorization")), []byte(expected)) == 1
+}
+
+func (proxy *EgressProxy) allowed(w http.ResponseWriter, host string) bool {
+	if err := proxy.Policy.CheckHost(host); err != nil {
+		log.Warning("egress proxy: %s", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (proxy *EgressProxy) dialError(w http.ResponseWriter, host string, err error) {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		if policyErr, ok := opErr.Err.(*URLPolicyError); ok {
+			log.Warning("egress proxy: %s", policyErr)
+			http.Error(w, policyErr.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	http.Error(w, "can't connect to "+host, http.StatusBadGateway)
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for name, values := range header {
+		clone[name] = append([]string(nil), values...)
+	}
+	return clone
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func proxyClient(t *testing.T, proxy *EgressProxy) *http.Client {
+	proxyURL, err := url.Parse(proxy.URL())
+	require.Nil(t, err)
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func TestEgressProxy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Proxy-Connection"))
+		w.Write([]byte("video"))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	// the test servers are local
+	proxy, err := NewEgressProxy(newTestURLPolicy(&URLPolicyConfig{AllowPrivate: true}), 0, time.Second)
+	require.Nil(t, err)
+	defer proxy.Close()
+	client := proxyClient(t, proxy)
+	for _, server := range []*httptest.Server{plain, secure} {
+		res, err := client.Get(server.URL)
+		require.Nil(t, err)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "video", string(body))
+	}
+
+	// other local users
+	anonymous := &http.Client{Transport: &http.Transport{Proxy: func(*http.Request) (*url.URL, error) {
+		return url.Parse("http://" + proxy.listener.Addr().String())
+	}}}
+	res, err := anonymous.Get(plain.URL)
+	require.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, res.StatusCode)
+	_, err = anonymous.Get(secure.URL)
+	assert.NotNil(t, err)
+}
+
+func TestEgressProxyPrivate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("private address reached through the proxy")
+	}))
+	defer server.Close()
+
+	proxy, err := NewEgressProxy(newTestURLPolicy(&URLPolicyConfig{}), 0, time.Second)
+	require.Nil(t, err)
+	defer proxy.Close()
+	client := proxyClient(t, proxy)
+
+	res, err := client.Get(server.URL)
+	require.Nil(t, err)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Contains(t, string(body), "resolves to a private address")
+
+	// https goes through CONNECT, refused before the tunnel
+	_, err = client.Get("https://intranet.example.com/video.mp4")
+	assert.NotNil(t, err)
+
+	// a public name resolving to a private address when dialed
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+	res, err = client.Get(fmt.Sprintf("http://localhost:%d/video.mp4", port))
+	require.Nil(t, err)
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Contains(t, string(body), "connection to private address")
+}
+
+func TestEgressProxyDenyHosts(t *testing.T) {
+	proxy, err := NewEgressProxy(newTestURLPolicy(&URLPolicyConfig{DenyHosts: []string{"*.example.com"}, AllowPrivate: true}), 0, time.Second)
+	require.Nil(t, err)
+	defer proxy.Close()
+	res, err := proxyClient(t, proxy).Get("http://cdn.example.com/video.mp4")
+	require.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
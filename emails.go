@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// how long the code sent to confirm a new address lasts
+const emailVerificationLifetime = 24 * time.Hour
+
+const (
+	// verifications an user can wait for at the same time
+	maxPendingEmailVerifications = 3
+	// verifications sent in an hour to an user, or to an address
+	maxEmailConfirmations = 5
+)
+
+var (
+	ErrInvalidEmailVerification  = errors.New("invalid or expired verification code")
+	ErrTooManyEmailVerifications = errors.New("too many addresses waiting for verification")
+)
+
+// EmailVerification is an address added by an user, waiting for the code
+// sent to it. Only the hash of the code is stored.
+type EmailVerification struct {
+	Hash     string // sha256 of the code, hex
+	Username string
+	Email    string
+	Expires  time.Time
+}
+
+// EmailConfirmation is the message with the code to verify an address
+type EmailConfirmation struct {
+	Name     string
+	Email    string
+	Language string // of the user
+	Code     string
+	Expires  time.Time
+}
+
+type EmailVerificationRepository interface {
+	// CreateEmailVerification stores verification, replacing the previous
+	// one of the same user and address. ErrTooManyEmailVerifications if the
+	// user has maxPendingEmailVerifications others.
+	CreateEmailVerification(verification *EmailVerification) error
+	// TakeEmailVerification returns and deletes the verification of a code
+	// hash, nil if not found
+	TakeEmailVerification(hash string) (*EmailVerification, error)
+	DeleteUserEmailVerifications(username string) error
+}
+
+// BoltEmailVerificationRepository stores the pending verifications, as json,
+// in a bolt database
+type BoltEmailVerificationRepository struct {
+	DB  *bolt.DB
+	Now func() time.Time
+}
+
+var emailVerificationsBucket = []byte("email_verifications")
+
+func NewBoltEmailVerificationRepository(db *bolt.DB) (*BoltEmailVerificationRepository, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(emailVerificationsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltEmailVerificationRepository{db, time.Now}, nil
+}
+
+// CreateEmailVerification stores verification, dropping the expired ones
+func (repo *BoltEmailVerificationRepository) CreateEmailVerification(verification *EmailVerification) error {
+	now := repo.Now()
+	return repo.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(emailVerificationsBucket)
+		var expired [][]byte
+		pending := 0
+		err := bucket.ForEach(func(k, v []byte) error {
+			old := &EmailVerification{}
+			if err := json.Unmarshal(v, old); err != nil || now.After(old.Expires) {
+				expired = append(expired, k)
+			} else if old.Username == verification.Username && strings.EqualFold(old.Email, verification.Email) {
+				// replaced
+				expired = append(expired, k)
+			} else if old.Username == verification.Username {
+				pending++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if pending >= maxPendingEmailVerifications {
+			return ErrTooManyEmailVerifications
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		v, err := json.Marshal(verification)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(verification.Hash), v)
+	})
+}
+
+func (repo *BoltEmailVerificationRepository) TakeEmailVerification(hash string) (*EmailVerification, error) {
+	var verification *EmailVerification
+	err := repo.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(emailVerificationsBucket)
+		v := bucket.Get([]byte(hash))
+		if v == nil {
+			return nil
+		}
+		verification = &EmailVerification{}
+		if err := json.Unmarshal(v, verification); err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(hash))
+	})
+	return verification, err
+}
+
+func (repo *BoltEmailVerificationRepository) DeleteUserEmailVerifications(username string) error {
+	return deleteUserValues(repo.DB, emailVerificationsBucket, username)
+}
+
+// addresses of an user in the http api
+type EmailsInfo struct {
+	Email   string   `json:"email"`
+	Aliases []string `json:"aliases"`
+}
+
+func NewEmailsInfo(user *ConfigUser) *EmailsInfo {
+	aliases := user.Aliases
+	if aliases == nil {
+		aliases = []string{}
+	}
+	return &EmailsInfo{user.Email, aliases}
+}
+
+// HandleListEmails lists the addresses of the authenticated user
+func (s *HttpServer) HandleListEmails(w http.ResponseWriter, r *http.Request) {
+	account := context.Get(r, "account").(*ConfigUser)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewEmailsInfo(account))
+}
+
+// HandleAddEmail sends a verification code to a new address of the user,
+// which becomes an alias once HandleVerifyEmail gets the code
+func (s *HttpServer) HandleAddEmail(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Email string `json:"email"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid json message.", http.StatusBadRequest)
+		return
+	}
+	address, err := mail.ParseAddress(body.Email)
+	if err != nil {
+		http.Error(w, "invalid email", http.StatusBadRequest)
+		return
+	}
+	account := context.Get(r, "account").(*ConfigUser)
+	owner, err := s.Accounts.GetUserByEmail(address.Address)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if owner != nil {
+		// also for the user's own addresses, there's nothing to verify
+		http.Error(w, ErrEmailTaken.Error(), http.StatusConflict)
+		return
+	}
+	// usernames have no @, they don't share the limits of the addresses
+	if !s.Confirms.Allow(account.Username) || !s.Confirms.Allow(address.Address) {
+		audit.Warning("user %s added too many emails, not verifying %s", account.Username, address.Address)
+		http.Error(w, "too many emails added, retry later", http.StatusTooManyRequests)
+		return
+	}
+	code, err := randomHex(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	verification := &EmailVerification{}
+	verification.Hash = hashSecret(code)
+	verification.Username = account.Username
+	verification.Email = address.Address
+	verification.Expires = time.Now().Add(emailVerificationLifetime)
+	if err := s.Emails.CreateEmailVerification(verification); err == ErrTooManyEmailVerifications {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit.Info("user %s added email %s, waiting for verification", account.Username, address.Address)
+	go s.Mailer.ConfirmEmail(&EmailConfirmation{account.Name, address.Address, account.Language, code, verification.Expires})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// HandleVerifyEmail adds the address of a verification code to the aliases
+// of the user that requested it
+func (s *HttpServer) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Code string `json:"code"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid json message.", http.StatusBadRequest)
+		return
+	}
+	account := context.Get(r, "account").(*ConfigUser)
+	verification, err := s.Emails.TakeEmailVerification(hashSecret(body.Code))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if verification == nil || verification.Username != account.Username || time.Now().After(verification.Expires) {
+		http.Error(w, ErrInvalidEmailVerification.Error(), http.StatusBadRequest)
+		return
+	}
+	account.Aliases = append(account.Aliases, verification.Email)
+	if err := s.Accounts.SaveUser(account); err == ErrEmailTaken {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit.Info("user %s verified email %s", account.Username, verification.Email)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewEmailsInfo(account))
+}
+
+// HandleDeleteEmail removes an alias of the user (the primary address is
+// changed by an admin)
+func (s *HttpServer) HandleDeleteEmail(w http.ResponseWriter, r *http.Request) {
+	account := context.Get(r, "account").(*ConfigUser)
+	email, err := NormalizeEmail(mux.Vars(r)["email"])
+	if err != nil {
+		http.Error(w, "invalid email", http.StatusBadRequest)
+		return
+	}
+	aliases := []string{}
+	for _, alias := range account.Aliases {
+		if normalized, _ := NormalizeEmail(alias); normalized != email {
+			aliases = append(aliases, alias)
+		}
+	}
+	if len(aliases) == len(account.Aliases) {
+		http.Error(w, "alias not found", http.StatusNotFound)
+		return
+	}
+	account.Aliases = aliases
+	account.PruneBounced()
+	if err := s.Accounts.SaveUser(account); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
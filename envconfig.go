@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// prefix of the environment variables overriding the config
+const envPrefix = "YUTUBAAS"
+
+// ApplyConfigEnv overrides the fields of config with environment variables.
+// Each field has a variable named after its yaml path: YUTUBAAS_MAILGUN_KEY
+// is mailgun.key, YUTUBAAS_S3_SECRET_KEY is s3.secretKey and
+// YUTUBAAS_ACCOUNTS_KOKOSCHKA_PASSWORD the password of an account (map and
+// list entries must be in the yaml, keys and indexes are part of the name).
+// Lists of strings are comma separated. A variable with the _FILE suffix
+// names a file with the value instead (a docker or kubernetes secret), and
+// the precedence is: the variable, the file, the yaml.
+func ApplyConfigEnv(config *Config, lookup func(name string) (string, bool)) error {
+	_, err := applyEnv(reflect.ValueOf(config).Elem(), envPrefix, lookup)
+	return err
+}
+
+// applyEnv sets v, and its fields or entries, from the variables starting
+// with name. It returns if any was set.
+func applyEnv(v reflect.Value, name string, lookup func(string) (string, bool)) (bool, error) {
+	set := false
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue // unexported
+			}
+			// the tags are the yaml keys, as yaml.v2 reads them
+			key := strings.Split(string(field.Tag), ",")[0]
+			if key == "-" {
+				continue
+			}
+			if key == "" {
+				key = strings.ToLower(field.Name)
+			}
+			fieldSet, err := applyEnv(v.Field(i), name+"_"+envName(key), lookup)
+			if err != nil {
+				return false, err
+			}
+			set = set || fieldSet
+		}
+		return set, nil
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(k))
+			elemSet, err := applyEnv(elem, name+"_"+envName(fmt.Sprint(k.Interface())), lookup)
+			if err != nil {
+				return false, err
+			}
+			if elemSet {
+				v.SetMapIndex(k, elem)
+				set = true
+			}
+		}
+		return set, nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			break
+		}
+		for i := 0; i < v.Len(); i++ {
+			elemSet, err := applyEnv(v.Index(i), fmt.Sprintf("%s_%d", name, i), lookup)
+			if err != nil {
+				return false, err
+			}
+			set = set || elemSet
+		}
+		return set, nil
+	case reflect.Ptr:
+		// set only if a variable changes it, nil means the default
+		elem := reflect.New(v.Type().Elem())
+		if !v.IsNil() {
+			elem.Elem().Set(v.Elem())
+		}
+		elemSet, err := applyEnv(elem.Elem(), name, lookup)
+		if elemSet {
+			v.Set(elem)
+		}
+		return elemSet, err
+	}
+	value, ok, err := lookupEnv(name, lookup)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, setEnvValue(v, name, value)
+}
+
+// lookupEnv returns the value of the variable name, or the contents of the
+// file in name_FILE
+func lookupEnv(name string, lookup func(string) (string, bool)) (string, bool, error) {
+	if value, ok := lookup(name); ok {
+		return value, true, nil
+	}
+	file, ok := lookup(name + "_FILE")
+	if !ok {
+		return "", false, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %s", name, err)
+	}
+	// editors and `echo` leave a newline at the end
+	return strings.TrimRight(string(b), "\r\n"), true, nil
+}
+
+func setEnvValue(v reflect.Value, name string, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid boolean %q", name, value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%s: invalid integer %q", name, value)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%s: invalid integer %q", name, value)
+		}
+		v.SetUint(n)
+	case reflect.Slice:
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("%s: can't set a %s from the environment", name, v.Type())
+	}
+	return nil
+}
+
+// envName writes a yaml key as a variable name: secretKey is SECRET_KEY,
+// maxIPFailures MAX_IP_FAILURES
+func envName(key string) string {
+	runes := []rune(key)
+	var name []rune
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+				(unicode.IsUpper(prev) && i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				name = append(name, '_')
+			}
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			r = '_'
+		}
+		name = append(name, unicode.ToUpper(r))
+	}
+	return string(name)
+}
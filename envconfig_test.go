@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestApplyConfigEnv(t *testing.T) {
+	secret, err := ioutil.TempFile("", "yutubaas-secret")
+	assert.Nil(t, err)
+	defer os.Remove(secret.Name())
+	secret.WriteString("s3-secret\n")
+	secret.Close()
+
+	config := &Config{}
+	assert.Nil(t, yaml.Unmarshal([]byte(`
+hs256key: in-the-yaml
+accounts:
+  kokoschka:
+    name: Oskar
+    password: plaintext
+mailgun:
+  key: key-yaml
+s3:
+  secretKey: yaml-secret
+signing:
+  keys:
+    - kid: k1
+      privateKey: k1.pem
+`), config))
+	env := map[string]string{
+		"YUTUBAAS_HS256KEY":                               "from-the-env",
+		"YUTUBAAS_MAILGUN_KEY":                            "key-env",
+		"YUTUBAAS_MAILGUN_KEY_FILE":                       "/nonexistent", // the variable wins
+		"YUTUBAAS_S3_SECRET_KEY_FILE":                     secret.Name(),
+		"YUTUBAAS_ACCOUNTS_KOKOSCHKA_PASSWORD":            "$2a$10$hash",
+		"YUTUBAAS_ACCOUNTS_KOKOSCHKA_LIMITS_MAX_DURATION": "600",
+		"YUTUBAAS_LOGIN_MAX_IP_FAILURES":                  "50",
+		"YUTUBAAS_URLS_DENY_HOSTS":                        "example.com, *.example.org",
+		"YUTUBAAS_SIGNING_KEYS_0_PRIVATE_KEY":             "/run/secrets/k1.pem",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	assert.Nil(t, ApplyConfigEnv(config, lookup))
+	assert.Equal(t, "from-the-env", config.HS256key)
+	assert.Equal(t, "key-env", config.MailgunConfig.Key)
+	assert.Equal(t, "s3-secret", config.S3Config.SecretKey)
+	assert.Equal(t, "$2a$10$hash", config.Accounts["kokoschka"].Password)
+	assert.Equal(t, "Oskar", config.Accounts["kokoschka"].Name)
+	assert.Equal(t, int64(600), config.Accounts["kokoschka"].Limits.MaxDuration)
+	assert.Equal(t, 50, config.Login.MaxIPFailures)
+	assert.Equal(t, []string{"example.com", "*.example.org"}, config.URLPolicy.DenyHosts)
+	assert.Equal(t, "/run/secrets/k1.pem", config.Signing.Keys[0].PrivateKey)
+	// untouched pointers stay nil
+	assert.Nil(t, config.Limits.AllowLive)
+
+	env["YUTUBAAS_LOGIN_DELAY"] = "soon"
+	assert.Equal(t, `YUTUBAAS_LOGIN_DELAY: invalid integer "soon"`, ApplyConfigEnv(config, lookup).Error())
+	delete(env, "YUTUBAAS_LOGIN_DELAY")
+	env["YUTUBAAS_OIDC_CLIENT_SECRET_FILE"] = "/nonexistent"
+	assert.NotNil(t, ApplyConfigEnv(config, lookup))
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "HS256KEY", envName("hs256key"))
+	assert.Equal(t, "SECRET_KEY", envName("secretKey"))
+	assert.Equal(t, "MAX_IP_FAILURES", envName("maxIPFailures"))
+	assert.Equal(t, "REQUIRE_DKIM", envName("requireDkim"))
+	assert.Equal(t, "OSKAR_K", envName("oskar.k"))
+}
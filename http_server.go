@@ -1,13 +1,12 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/context"
@@ -18,26 +17,171 @@ import (
 )
 
 type HttpServer struct {
-	HS256key   []byte // to sign JWT tokens
-	Accounts   map[string]ConfigUser
+	Keys       *KeySet // to sign and verify JWT tokens
+	Accounts   UserRepository
+	ApiKeys    ApiKeyRepository
+	Tokens     TokenRepository
+	Emails     EmailVerificationRepository // addresses added by users, waiting for confirmation
 	Downloader Downloader
+	Mailer     Mailer
+	Chat       *ChatNotifier
+	Mailgun    *MailgunVerifier
+	Inbound    InboundConfig
+	Replies    *MailReplyLimiter
+	Confirms   *MailReplyLimiter // verifications sent by /account/emails, by user and by address
+	Jobs       JobRepository
+	Outbox     *Outbox
+	URLPolicy  *URLPolicy
+	LoginGuard *LoginGuard
+	OIDC       *OIDCProvider // nil without OpenID Connect
+	ConfigFile string        // read again by HandleReloadConfig
+
+	// lifetime of the tokens created by /login and /token/refresh
+	AccessLifetime  time.Duration
+	RefreshLifetime time.Duration
+
+	settingsMu sync.RWMutex
+	settings   ServerSettings
+}
+
+// ServerSettings are the parts of the config applied again on reload
+type ServerSettings struct {
+	Limits LimitsConfig
+	Roles  map[string]RoleConfig
+	// how long HandleDownload waits for the metadata to check the limits
+	PreflightTimeout time.Duration
 }
 
 func NewHttpServer(config *Config) (*HttpServer, error) {
 	log.Debug("config: %+v", config)
 	server := &HttpServer{}
-	server.HS256key = []byte(config.HS256key)
-	server.Accounts = config.Accounts
-	repoConfig := &S3VideoRepoConfig{config.S3Config.AccessKey, config.S3Config.SecretKey, config.S3Config.Bucket}
+	keys, err := NewKeySet(&config.Signing, []byte(config.HS256key))
+	if err != nil {
+		return nil, err
+	}
+	server.Keys = keys
+	db, err := OpenDatabase(config.Database.Path)
+	if err != nil {
+		return nil, err
+	}
+	users, err := NewBoltUserRepository(db)
+	if err != nil {
+		return nil, err
+	}
+	if err := users.Seed(config.Accounts); err != nil {
+		return nil, err
+	}
+	server.Accounts = users
+	server.ApiKeys, err = NewBoltApiKeyRepository(db)
+	if err != nil {
+		return nil, err
+	}
+	server.Tokens, err = NewBoltTokenRepository(db)
+	if err != nil {
+		return nil, err
+	}
+	server.Emails, err = NewBoltEmailVerificationRepository(db)
+	if err != nil {
+		return nil, err
+	}
+	if config.OIDC.Issuer != "" {
+		server.OIDC = NewOIDCProvider(&config.OIDC, &http.Client{Timeout: 10 * time.Second})
+	}
+	server.AccessLifetime, server.RefreshLifetime = 15*time.Minute, 30*24*time.Hour
+	if config.Tokens.AccessLifetime != 0 {
+		server.AccessLifetime = time.Duration(config.Tokens.AccessLifetime) * time.Second
+	}
+	if config.Tokens.RefreshLifetime != 0 {
+		server.RefreshLifetime = time.Duration(config.Tokens.RefreshLifetime) * time.Second
+	}
+	accounts, err := users.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range accounts {
+		if !IsPasswordHash(account.Password) {
+			log.Warning("account %s has a plaintext password, replace it with the output of `yutubaas hash-password`", account.Username)
+		}
+	}
+	repoConfig := &S3VideoRepoConfig{config.S3Config.AccessKey, config.S3Config.SecretKey, config.S3Config.Bucket,
+		time.Duration(config.S3Config.LinkLifetime) * time.Second}
 	videoRepo := NewS3VideoRepository(repoConfig)
-	mailer, err := NewMailgunMailer(config.MailgunConfig.From, config.MailgunConfig.Key, config.MailgunConfig.Domain)
+	templates, err := NewMailTemplates(config.MailgunConfig.Templates, config.MailgunConfig.Language)
+	if err != nil {
+		return nil, err
+	}
+	server.Jobs = NewMemoryJobRepository()
+	outboxRepo, err := NewBoltOutboxRepository(db)
+	if err != nil {
+		return nil, err
+	}
+	server.Outbox = NewOutbox(outboxRepo, server.Jobs, &config.Outbox)
+	mailer := NewMailgunMailer(config.MailgunConfig.From, config.MailgunConfig.Key, config.MailgunConfig.Domain, templates, server.Outbox, users)
+	server.URLPolicy = NewURLPolicy(&config.URLPolicy)
+	server.Chat = NewChatNotifier(&config.Chat, templates, users, server.URLPolicy)
+	digests, err := NewBoltDigestRepository(db)
+	if err != nil {
+		return nil, err
+	}
+	digestMailer := NewDigestMailer(MultiMailer{mailer, server.Chat}, users, digests, &config.Notifications)
+	if err := digestMailer.Resume(); err != nil {
+		return nil, err
+	}
+	server.Mailer = digestMailer
+	server.Mailgun = NewMailgunVerifier(&config.MailgunConfig)
+	server.Replies = NewMailReplyLimiter(&config.MailgunConfig)
+	server.Confirms = &MailReplyLimiter{Max: maxEmailConfirmations, Window: time.Hour, Now: time.Now, sent: make(map[string][]time.Time)}
+	server.Inbound = config.Inbound
+	server.LoginGuard = NewLoginGuard(&config.Login)
+	server.ApplyConfig(config)
+	sandbox, err := NewSandbox(&config.Sandbox)
+	if err != nil {
+		return nil, err
+	}
+	logConfig := &JobLogConfig{config.JobsConfig.LogDir, config.JobsConfig.LogMaxSize, config.JobsConfig.LogBackups}
+	youtubeDl := NewDefaultDownloader(videoRepo, server.Mailer, server.Jobs, logConfig, server.URLPolicy, sandbox)
+	timeout, retries := 30*time.Second, 3
+	if config.Direct.Timeout != 0 {
+		timeout = time.Duration(config.Direct.Timeout) * time.Second
+	}
+	egress, err := NewEgressProxy(server.URLPolicy, config.Sandbox.ProxyPort, timeout)
+	if err != nil {
+		return nil, err
+	}
+	youtubeDl.Proxy = egress.URL()
+	if config.Direct.Retries != 0 {
+		retries = config.Direct.Retries
+	}
+	direct := NewHttpDownloader(youtubeDl, server.URLPolicy.HttpClient(timeout), retries)
+	server.Downloader, err = NewDispatchDownloader(youtubeDl, direct, &config.Direct)
 	if err != nil {
 		return nil, err
 	}
-	server.Downloader = NewDefaultDownloader(videoRepo, mailer)
 	return server, nil
 }
 
+// ApplyConfig sets the settings (and url policy and login limits) that can
+// change without a restart
+func (s *HttpServer) ApplyConfig(config *Config) {
+	settings := ServerSettings{Limits: config.Limits, Roles: config.Roles}
+	settings.PreflightTimeout = 5 * time.Second
+	if config.JobsConfig.PreflightTimeout != 0 {
+		settings.PreflightTimeout = time.Duration(config.JobsConfig.PreflightTimeout) * time.Second
+	}
+	s.settingsMu.Lock()
+	s.settings = settings
+	s.settingsMu.Unlock()
+	s.URLPolicy.Update(&config.URLPolicy)
+	s.LoginGuard.Update(&config.Login)
+	s.Chat.Update(&config.Chat)
+}
+
+func (s *HttpServer) Settings() ServerSettings {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	return s.settings
+}
+
 func (s *HttpServer) CreateRouter() *mux.Router {
 	commonHandlers := alice.New(s.LoggingHandler)
 
@@ -46,8 +190,52 @@ func (s *HttpServer) CreateRouter() *mux.Router {
 	// service status
 	router.Handle("/status", commonHandlers.ThenFunc(s.HandleStatus)).Methods("GET")
 	router.Handle("/login", commonHandlers.ThenFunc(s.HandleLogin)).Methods("POST")
+	if s.OIDC != nil {
+		router.Handle("/oidc/login", commonHandlers.ThenFunc(s.HandleOIDCLogin)).Methods("GET")
+		router.Handle("/oidc/callback", commonHandlers.ThenFunc(s.HandleOIDCCallback)).Methods("GET")
+	}
+	router.Handle("/.well-known/jwks.json", commonHandlers.ThenFunc(s.HandleJWKS)).Methods("GET")
+	router.Handle("/token/refresh", commonHandlers.ThenFunc(s.HandleRefreshToken)).Methods("POST")
+	router.Handle("/logout", commonHandlers.Append(s.AuthenticationHandler).ThenFunc(s.HandleLogout)).Methods("POST")
 	router.Handle("/download/mailgun", commonHandlers.ThenFunc(s.HandleDownloadMailgun)).Methods("POST")
-	router.Handle("/download", commonHandlers.Append(s.AuthenticationHandler).ThenFunc(s.HandleDownload)).Methods("POST")
+	router.Handle("/mailgun/events", commonHandlers.ThenFunc(s.HandleMailgunEvent)).Methods("POST")
+	if s.Inbound.Token != "" {
+		router.Handle("/download/email", commonHandlers.ThenFunc(s.HandleDownloadEmail)).Methods("POST")
+	}
+	downloadHandlers := commonHandlers.Append(s.AuthenticationHandler, s.RequireScope(ScopeDownload))
+	readHandlers := commonHandlers.Append(s.AuthenticationHandler, s.RequireScope(ScopeRead))
+	router.Handle("/download", downloadHandlers.ThenFunc(s.HandleDownload)).Methods("POST")
+	router.Handle("/jobs", readHandlers.ThenFunc(s.HandleListJobs)).Methods("GET")
+	router.Handle("/jobs/all", readHandlers.Append(s.RequireRole(RoleAdmin)).ThenFunc(s.HandleListAllJobs)).Methods("GET")
+	router.Handle("/jobs/{id}", readHandlers.ThenFunc(s.HandleJob)).Methods("GET")
+	router.Handle("/jobs/{id}/log", readHandlers.ThenFunc(s.HandleJobLog)).Methods("GET")
+	router.Handle("/jobs/{id}/cancel", downloadHandlers.ThenFunc(s.HandleCancelJob)).Methods("POST")
+
+	// api keys
+	accountHandlers := commonHandlers.Append(s.AuthenticationHandler, s.RequireScope(ScopeAccount))
+	router.Handle("/apikeys", accountHandlers.ThenFunc(s.HandleListApiKeys)).Methods("GET")
+	router.Handle("/apikeys", accountHandlers.ThenFunc(s.HandleCreateApiKey)).Methods("POST")
+	router.Handle("/apikeys/{id}", accountHandlers.ThenFunc(s.HandleDeleteApiKey)).Methods("DELETE")
+	router.Handle("/account/emails", accountHandlers.ThenFunc(s.HandleListEmails)).Methods("GET")
+	router.Handle("/account/emails", accountHandlers.ThenFunc(s.HandleAddEmail)).Methods("POST")
+	router.Handle("/account/emails/verify", accountHandlers.ThenFunc(s.HandleVerifyEmail)).Methods("POST")
+	router.Handle("/account/emails/{email}", accountHandlers.ThenFunc(s.HandleDeleteEmail)).Methods("DELETE")
+	router.Handle("/account/language", accountHandlers.ThenFunc(s.HandleSetLanguage)).Methods("PUT")
+	router.Handle("/account/notify", accountHandlers.ThenFunc(s.HandleSetNotify)).Methods("PUT")
+	router.Handle("/account/chat", accountHandlers.ThenFunc(s.HandleSetChat)).Methods("PUT")
+
+	// administration
+	adminHandlers := accountHandlers.Append(s.RequireRole(RoleAdmin))
+	router.Handle("/config/reload", adminHandlers.ThenFunc(s.HandleReloadConfig)).Methods("POST")
+	router.Handle("/users", adminHandlers.ThenFunc(s.HandleListUsers)).Methods("GET")
+	router.Handle("/users", adminHandlers.ThenFunc(s.HandleCreateUser)).Methods("POST")
+	router.Handle("/users/{username}", adminHandlers.ThenFunc(s.HandleGetUser)).Methods("GET")
+	router.Handle("/users/{username}", adminHandlers.ThenFunc(s.HandleUpdateUser)).Methods("PUT")
+	router.Handle("/users/{username}", adminHandlers.ThenFunc(s.HandleDeleteUser)).Methods("DELETE")
+	router.Handle("/users/{username}/password", adminHandlers.ThenFunc(s.HandleResetPassword)).Methods("PUT")
+	router.Handle("/users/{username}/email", adminHandlers.ThenFunc(s.HandleChangeEmail)).Methods("PUT")
+	router.Handle("/notifications", adminHandlers.ThenFunc(s.HandleListNotifications)).Methods("GET")
+	router.Handle("/notifications/{id}/resend", adminHandlers.ThenFunc(s.HandleResendNotification)).Methods("POST")
 
 	return router
 }
@@ -82,25 +270,79 @@ func (s *HttpServer) HandleStatus(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// AuthenticationHandler accepts a JWT from /login or an api key (with its
+// scopes only)
 func (s *HttpServer) AuthenticationHandler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		f := func(t *jwt.Token) (interface{}, error) { return s.HS256key, nil }
-		token, err := jwt.ParseFromRequest(r, f)
+		var username, role, jti string
+		var exp time.Time
+		scopes := allScopes
+		if value := RequestApiKey(r); value != "" {
+			key, err := s.AuthenticateApiKey(value)
+			if err == ErrInvalidApiKey {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			username, scopes = key.Username, key.Scopes
+		} else {
+			token, err := jwt.ParseFromRequest(r, s.Keys.Keyfunc)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid token: %s", err), http.StatusUnauthorized)
+				return
+			}
+			if token == nil {
+				http.Error(w, "missing Authorization token", http.StatusUnauthorized)
+				return
+			}
+			log.Debug("token claims: %+v", token.Claims)
+			var ok bool
+			username, ok = token.Claims["sub"].(string)
+			if !ok {
+				http.Error(w, "missing sub in token claims", http.StatusUnauthorized)
+				return
+			}
+			// tokens from before roles were added are for users
+			role, _ = token.Claims["role"].(string)
+			if role == "" {
+				role = RoleUser
+			}
+			jti, _ = token.Claims["jti"].(string)
+			if jti != "" {
+				revoked, err := s.Tokens.IsRevoked(jti)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if revoked {
+					http.Error(w, "invalid token: token revoked", http.StatusUnauthorized)
+					return
+				}
+				expClaim, _ := token.Claims["exp"].(float64)
+				exp = time.Unix(int64(expClaim), 0)
+			}
+		}
+		account, err := s.Accounts.GetUser(username)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("invalid token: %s", err), http.StatusUnauthorized)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if token == nil {
-			http.Error(w, "missing Authorization token", http.StatusUnauthorized)
+		if account == nil || account.Disabled {
+			http.Error(w, "unknown or disabled user", http.StatusUnauthorized)
 			return
 		}
-		log.Debug("token claims: %+v", token.Claims)
-		if username, ok := token.Claims["sub"]; !ok {
-			http.Error(w, "missing sub in token claims", http.StatusUnauthorized)
-			return
-		} else {
-			context.Set(r, "sub", username)
+		if role == "" {
+			// api keys act with the current role of the account
+			role = account.GetRole()
 		}
+		context.Set(r, "sub", username)
+		context.Set(r, "role", role)
+		context.Set(r, "scopes", scopes)
+		context.Set(r, "jti", jti)
+		context.Set(r, "exp", exp)
+		context.Set(r, "account", account)
 
 		next.ServeHTTP(w, r)
 	}
@@ -109,7 +351,9 @@ func (s *HttpServer) AuthenticationHandler(next http.Handler) http.Handler {
 }
 
 type Video struct {
-	Url string `json:"url"`
+	Url      string          `json:"url"`
+	Checksum string          `json:"checksum,omitempty"` // algorithm:hex, for direct downloads
+	Options  DownloadOptions `json:"options"`
 }
 
 func (s *HttpServer) HandleDownload(w http.ResponseWriter, r *http.Request) {
@@ -125,28 +369,66 @@ func (s *HttpServer) HandleDownload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
+	if err := s.URLPolicy.CheckURL(videoUrl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := video.Options.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if video.Checksum != "" && !video.Options.IsZero() {
+		http.Error(w, "checksums are only verified in downloads without options", http.StatusBadRequest)
+		return
+	}
+	if video.Checksum != "" {
+		if err := CheckChecksum(video.Checksum); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
 	// download
-	username := context.Get(r, "sub").(string)
-	account, _ := s.Accounts[username]
-	videoDwn := &DownloadVideo{}
-	videoDwn.SrcUrl = videoUrl
-	videoDwn.DstUrl = nil // downloader set this
-	videoDwn.Title = ""   // downloader set this
-	videoDwn.Name = account.Name
-	videoDwn.Username = username
-	videoDwn.Email = account.Email
-	videoDwn.Error = nil
+	account := context.Get(r, "account").(*ConfigUser)
+	videoDwn, err := s.NewJob(account, account.Username, videoUrl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	videoDwn.Checksum = video.Checksum
+	videoDwn.Options = video.Options
+	// the job counts for the quota while in preflight
+	if err := s.AddJob(account, videoDwn); err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err := s.Preflight(videoDwn); err != nil {
+		s.RejectJob(videoDwn, err)
+		status := http.StatusUnprocessableEntity
+		if _, ok := err.(*URLPolicyError); ok {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	s.Jobs.SaveJob(videoDwn)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/jobs/%s", videoDwn.Id))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(NewJobInfo(videoDwn))
 	go s.Downloader.DownloadVideo(videoDwn)
 }
 
 type MailgunMessage struct {
-	Sender       string `schema:"sender"`
-	Timestamp    string `schema:"timestamp"`
-	Token        string `schema:"token"`
-	Signature    string `schema:"signature"`
-	StrippedText string `schema:"stripped-text"`
+	Sender          string `schema:"sender"`
+	Timestamp       string `schema:"timestamp"`
+	Token           string `schema:"token"`
+	Signature       string `schema:"signature"`
+	Subject         string `schema:"subject"`
+	StrippedText    string `schema:"stripped-text"`
+	MessageHeaders  string `schema:"message-headers"` // json list of [name, value]
+	Spf             string `schema:"X-Mailgun-Spf"`
+	DkimCheckResult string `schema:"X-Mailgun-Dkim-Check-Result"`
 }
 
 func (s *HttpServer) HandleDownloadMailgun(w http.ResponseWriter, r *http.Request) {
@@ -170,51 +452,67 @@ func (s *HttpServer) HandleDownloadMailgun(w http.ResponseWriter, r *http.Reques
 	}
 	log.Debug("parameters: %+v", mgmsg)
 
-	// TODO: check signature
-
-	// get account
-	account := s.GetAccountFromEmail(mgmsg.Sender)
-	if account == nil {
-		log.Error("unknown sender from Mailgun: %s", mgmsg.Sender)
-		w.WriteHeader(http.StatusOK) // sending 200 anyway
+	// only trust the sender of messages signed by Mailgun
+	if err := s.Mailgun.Verify(mgmsg); err != nil {
+		audit.Warning("message from Mailgun (sender %s) rejected: %s", mgmsg.Sender, err)
+		// Mailgun doesn't retry a 406
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
 		return
 	}
 
-	// TODO: have to move this to send the error message to the user
-	log.Debug("parsing %s", mgmsg.StrippedText)
-	scanner := bufio.NewScanner(strings.NewReader(mgmsg.StrippedText))
-	if !scanner.Scan() {
-		log.Error("error extracting url from Mailgun message: %s", mgmsg.StrippedText)
-		w.WriteHeader(http.StatusOK) // sending 200 anyway
-		return
-	}
-	videoUrl, err := url.ParseRequestURI(scanner.Text())
+	w.WriteHeader(http.StatusOK) // Mailgun is done, the sender gets the errors
+	s.ProcessMail(mgmsg.InboundMail())
+}
+
+// NewJob creates a queued job to download videoUrl
+func (s *HttpServer) NewJob(account *ConfigUser, username string, videoUrl *url.URL) (*DownloadVideo, error) {
+	id, err := NewJobId()
 	if err != nil {
-		log.Error("wrong url(%s) in Mailgun message: %s", mgmsg.StrippedText, err)
-		w.WriteHeader(http.StatusOK) // sending 200 anyway
-		return
+		return nil, err
 	}
-
-	// everything is ok, download!
-	w.WriteHeader(http.StatusOK)
-
-	// download
 	videoDwn := &DownloadVideo{}
+	videoDwn.Id = id
 	videoDwn.SrcUrl = videoUrl
 	videoDwn.DstUrl = nil // downloader set this
 	videoDwn.Title = ""   // downloader set this
 	videoDwn.Name = account.Name
-	videoDwn.Username = account.Username
+	videoDwn.Username = username
 	videoDwn.Email = account.Email
+	videoDwn.Language = account.Language
 	videoDwn.Error = nil
-	go s.Downloader.DownloadVideo(videoDwn)
+	videoDwn.Status = JobQueued
+	videoDwn.Created = time.Now()
+	settings := s.Settings()
+	videoDwn.Limits = settings.Limits.Merge(account.Limits)
+	videoDwn.Cancelled = make(chan struct{})
+	return videoDwn, nil
+}
+
+// RejectJob marks a job as failed before starting it (the reply to the
+// email tells the user)
+func (s *HttpServer) RejectJob(videoDwn *DownloadVideo, err error) {
+	videoDwn.Error = err
+	videoDwn.Status = JobFailed
+	s.Jobs.SaveJob(videoDwn)
+}
+
+// ReplyToSender answers an email request with the jobs it created or why it
+// was rejected (unless the sender got too many replies already)
+func (s *HttpServer) ReplyToSender(account *ConfigUser, msg *InboundMail, reply *MailReply) {
+	if !s.Replies.Allow(account.Email) {
+		log.Warning("too many replies to %s, not replying to %q", account.Email, msg.Subject)
+		return
+	}
+	reply.Name, reply.Email, reply.Language = account.Name, account.Email, account.Language
+	reply.Subject, reply.MessageId = msg.Subject, msg.MessageId
+	go s.Mailer.Reply(reply)
 }
 
 func (s *HttpServer) GetAccountFromEmail(email string) *ConfigUser {
-	for _, account := range s.Accounts {
-		if account.Email == email {
-			return &account
-		}
+	account, err := s.Accounts.GetUserByEmail(email)
+	if err != nil {
+		log.Error("error looking for account of %s: %s", email, err)
+		return nil
 	}
-	return nil
+	return account
 }
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"gopkg.in/dgrijalva/jwt-go.v2"
 )
@@ -18,10 +22,11 @@ import (
 // Downloader mock
 type MockDownloader struct {
 	mock.Mock
-	T *testing.T
+	T        *testing.T
+	Duration time.Duration // of every video
 }
 
-func NewMockDownloader(t *testing.T) Downloader {
+func NewMockDownloader(t *testing.T) *MockDownloader {
 	m := &MockDownloader{}
 	m.T = t
 	return m
@@ -31,11 +36,22 @@ func (m *MockDownloader) DownloadVideo(video *DownloadVideo) {
 	m.T.Logf("downloading video mock: %+v", video)
 }
 
+func (m *MockDownloader) CompleteMetadata(video *DownloadVideo) error {
+	video.Title = "mock"
+	video.File = "mock.mp4"
+	video.Duration = m.Duration
+	return nil
+}
+
 // API tests
 type ApiRestSuite struct {
 	suite.Suite
-	HS256key []byte
-	server   *httptest.Server
+	HS256key   []byte
+	server     *httptest.Server
+	downloader *MockDownloader
+	mailer     *MockMailer
+	outbox     *Outbox
+	removeDB   func()
 }
 
 func (s *ApiRestSuite) SetupSuite() {
@@ -44,24 +60,51 @@ func (s *ApiRestSuite) SetupSuite() {
 	// config
 	config := &Config{}
 	config.HS256key = "eCTEHBp97YKY4Bf89UKrV4az8FFe34fTYu4eLX8aryj6TUpycRkMJkHYRjbykCh"
-	config.Accounts = map[string]ConfigUser{"jriquelme": ConfigUser{"Jorge", "asdf", "jorge@larix.cl", "jriquelme"}}
+	config.Accounts = map[string]ConfigUser{
+		"jriquelme": ConfigUser{Name: "Jorge", Password: "asdf", Email: "jorge@larix.cl", Role: RoleAdmin},
+		"oskar":     ConfigUser{Name: "Oskar", Password: "qwerty", Email: "oskar@gmail.com"},
+	}
+	config.Database.Path, s.removeDB = newTestDBFile(s.T())
 
+	config.Limits.MaxDuration = 3600
+	config.Roles = map[string]RoleConfig{RoleUser: {MaxConcurrent: 1}}
+	config.Login = LoginConfig{MaxFailures: 3, Delay: 1}
+	config.MailgunConfig.SigningKey = "mailgun-signing-key"
+	config.MailgunConfig.MaxReplies = 5
+	config.Inbound.Token = "inbound-token"
 	s.HS256key = []byte(config.HS256key)
 
 	// setup server
 	httpServer, err := NewHttpServer(config)
-	assert.Nil(s.T(), err)
-	httpServer.Downloader = NewMockDownloader(s.T())
+	require.Nil(s.T(), err)
+	httpServer.URLPolicy.LookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("203.0.113.10")}, nil
+	}
+	s.downloader = NewMockDownloader(s.T())
+	httpServer.Downloader = s.downloader
+	s.mailer = NewMockMailer(s.T()).(*MockMailer)
+	httpServer.Mailer = s.mailer
+	s.outbox = httpServer.Outbox
 	s.server = httptest.NewServer(httpServer.CreateRouter())
 }
 
 func (s *ApiRestSuite) TearDownSuite() {
 	s.server.Close()
+	s.removeDB()
 }
 
 func (s *ApiRestSuite) CreateToken(sub string) string {
+	role := RoleUser
+	if sub == "jriquelme" {
+		role = RoleAdmin
+	}
+	return s.CreateTokenWithRole(sub, role)
+}
+
+func (s *ApiRestSuite) CreateTokenWithRole(sub string, role string) string {
 	token := jwt.New(jwt.SigningMethodHS256)
 	token.Claims["sub"] = sub
+	token.Claims["role"] = role
 	token.Claims["iat"] = time.Now().Unix()
 	token.Claims["exp"] = time.Now().Add(1 * time.Hour).Unix()
 	signedToken, signErr := token.SignedString(s.HS256key)
@@ -151,3 +194,600 @@ func (s *ApiRestSuite) TestDownloadWrongUrl() {
 	assert.Nil(s.T(), err)
 	assert.Equal(s.T(), "parse asdf: invalid URI for request\n", string(body))
 }
+
+func (s *ApiRestSuite) TestDownloadTooLong() {
+	s.downloader.Duration = 2 * time.Hour
+	defer func() { s.downloader.Duration = 0 }()
+
+	// request
+	json := "{\"url\": \"https://www.youtube.com/watch?v=bS5P_LAqiVg\"}"
+	r, err := http.NewRequest("POST", fmt.Sprintf("%s/download", s.server.URL), strings.NewReader(json))
+	token := s.CreateToken("jriquelme")
+	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	assert.Nil(s.T(), err)
+	res, err := http.DefaultClient.Do(r)
+	assert.Nil(s.T(), err)
+
+	// check response
+	assert.Equal(s.T(), http.StatusUnprocessableEntity, res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "video duration 2h0m0s exceeds the limit of 1h0m0s\n", string(body))
+}
+
+func (s *ApiRestSuite) TestDownloadFileUrl() {
+	// request
+	json := "{\"url\": \"file:///etc/passwd\"}"
+	r, err := http.NewRequest("POST", fmt.Sprintf("%s/download", s.server.URL), strings.NewReader(json))
+	token := s.CreateToken("jriquelme")
+	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	assert.Nil(s.T(), err)
+	res, err := http.DefaultClient.Do(r)
+	assert.Nil(s.T(), err)
+
+	// check response
+	assert.Equal(s.T(), http.StatusBadRequest, res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "scheme \"file\" not allowed\n", string(body))
+}
+
+func (s *ApiRestSuite) TestListUsers() {
+	// request
+	r, err := http.NewRequest("GET", fmt.Sprintf("%s/users", s.server.URL), nil)
+	assert.Nil(s.T(), err)
+	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.CreateToken("jriquelme")))
+	res, err := http.DefaultClient.Do(r)
+	assert.Nil(s.T(), err)
+
+	// check response
+	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+	var users []UserInfo
+	assert.Nil(s.T(), json.NewDecoder(res.Body).Decode(&users))
+	assert.Equal(s.T(), []UserInfo{
+		{Username: "jriquelme", Name: "Jorge", Email: "jorge@larix.cl", Notify: NotifyImmediate, Role: RoleAdmin},
+		{Username: "oskar", Name: "Oskar", Email: "oskar@gmail.com", Notify: NotifyImmediate, Role: RoleUser},
+	}, users)
+}
+
+func (s *ApiRestSuite) TestListUsersNotAdmin() {
+	// request
+	r, err := http.NewRequest("GET", fmt.Sprintf("%s/users", s.server.URL), nil)
+	assert.Nil(s.T(), err)
+	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.CreateToken("oskar")))
+	res, err := http.DefaultClient.Do(r)
+	assert.Nil(s.T(), err)
+
+	// check response
+	assert.Equal(s.T(), http.StatusForbidden, res.StatusCode)
+}
+
+func (s *ApiRestSuite) TestListUsersAdminClaim() {
+	// a role claim alone isn't enough
+	r, err := http.NewRequest("GET", fmt.Sprintf("%s/users", s.server.URL), nil)
+	assert.Nil(s.T(), err)
+	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.CreateTokenWithRole("oskar", RoleAdmin)))
+	res, err := http.DefaultClient.Do(r)
+	assert.Nil(s.T(), err)
+
+	// check response
+	assert.Equal(s.T(), http.StatusForbidden, res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "admin role required\n", string(body))
+}
+
+func (s *ApiRestSuite) TestListAllJobsNotAdmin() {
+	// request
+	r, err := http.NewRequest("GET", fmt.Sprintf("%s/jobs/all", s.server.URL), nil)
+	assert.Nil(s.T(), err)
+	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.CreateToken("oskar")))
+	res, err := http.DefaultClient.Do(r)
+	assert.Nil(s.T(), err)
+
+	// check response
+	assert.Equal(s.T(), http.StatusForbidden, res.StatusCode)
+}
+
+func (s *ApiRestSuite) Download(sub string) *http.Response {
+	json := "{\"url\": \"https://www.youtube.com/watch?v=bS5P_LAqiVg\"}"
+	r, err := http.NewRequest("POST", fmt.Sprintf("%s/download", s.server.URL), strings.NewReader(json))
+	assert.Nil(s.T(), err)
+	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.CreateToken(sub)))
+	res, err := http.DefaultClient.Do(r)
+	assert.Nil(s.T(), err)
+	return res
+}
+
+func (s *ApiRestSuite) CancelJob(sub string, id string) *http.Response {
+	r, err := http.NewRequest("POST", fmt.Sprintf("%s/jobs/%s/cancel", s.server.URL, id), nil)
+	assert.Nil(s.T(), err)
+	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.CreateToken(sub)))
+	res, err := http.DefaultClient.Do(r)
+	assert.Nil(s.T(), err)
+	return res
+}
+
+func (s *ApiRestSuite) TestRoleQuota() {
+	// the mock downloader never finishes a job, users can only run one
+	res := s.Download("oskar")
+	assert.Equal(s.T(), http.StatusCreated, res.StatusCode)
+	job := &JobInfo{}
+	assert.Nil(s.T(), json.NewDecoder(res.Body).Decode(job))
+
+	res = s.Download("oskar")
+	assert.Equal(s.T(), http.StatusTooManyRequests, res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "1 jobs running, the limit for role user is 1\n", string(body))
+
+	// admins can cancel it, and then oskar can download again
+	res = s.CancelJob("jriquelme", job.Id)
+	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+	assert.Nil(s.T(), json.NewDecoder(res.Body).Decode(job))
+	assert.Equal(s.T(), JobCancelled, job.Status)
+
+	res = s.CancelJob("oskar", job.Id)
+	assert.Equal(s.T(), http.StatusConflict, res.StatusCode)
+
+	res = s.Download("oskar")
+	assert.Equal(s.T(), http.StatusCreated, res.StatusCode)
+	assert.Nil(s.T(), json.NewDecoder(res.Body).Decode(job))
+	res = s.CancelJob("oskar", job.Id)
+	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+}
+
+func (s *ApiRestSuite) TestCancelJobNotOwner() {
+	res := s.Download("jriquelme")
+	assert.Equal(s.T(), http.StatusCreated, res.StatusCode)
+	job := &JobInfo{}
+	assert.Nil(s.T(), json.NewDecoder(res.Body).Decode(job))
+
+	res = s.CancelJob("oskar", job.Id)
+	assert.Equal(s.T(), http.StatusNotFound, res.StatusCode)
+	res = s.CancelJob("jriquelme", job.Id)
+	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+}
+
+func (s *ApiRestSuite) TestApiKey() {
+	// create a read-only key
+	body := "{\"name\": \"cron\", \"scopes\": [\"read\"]}"
+	r, err := http.NewRequest("POST", fmt.Sprintf("%s/apikeys", s.server.URL), strings.NewReader(body))
+	assert.Nil(s.T(), err)
+	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.CreateToken("oskar")))
+	res, err := http.DefaultClient.Do(r)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), http.StatusCreated, res.StatusCode)
+	key := &ApiKeyInfo{}
+	assert.Nil(s.T(), json.NewDecoder(res.Body).Decode(key))
+	assert.NotEmpty(s.T(), key.Key)
+
+	request := func(method string, path string, header string, value string) *http.Response {
+		r, err := http.NewRequest(method, s.server.URL+path, strings.NewReader("{}"))
+		assert.Nil(s.T(), err)
+		r.Header.Add(header, value)
+		res, err := http.DefaultClient.Do(r)
+		assert.Nil(s.T(), err)
+		return res
+	}
+	assert.Equal(s.T(), http.StatusOK, request("GET", "/jobs", "X-API-Key", key.Key).StatusCode)
+	assert.Equal(s.T(), http.StatusOK, request("GET", "/jobs", "Authorization", "ApiKey "+key.Key).StatusCode)
+	assert.Equal(s.T(), http.StatusForbidden, request("POST", "/download", "X-API-Key", key.Key).StatusCode)
+	assert.Equal(s.T(), http.StatusForbidden, request("GET", "/apikeys", "X-API-Key", key.Key).StatusCode)
+	assert.Equal(s.T(), http.StatusUnauthorized, request("GET", "/jobs", "X-API-Key", key.Key+"x").StatusCode)
+
+	// revoke it
+	res = request("DELETE", "/apikeys/"+key.Id, "Authorization", "Bearer "+s.CreateToken("oskar"))
+	assert.Equal(s.T(), http.StatusNoContent, res.StatusCode)
+	assert.Equal(s.T(), http.StatusUnauthorized, request("GET", "/jobs", "X-API-Key", key.Key).StatusCode)
+}
+
+func (s *ApiRestSuite) PostJSON(path string, body string, token string) *http.Response {
+	r, err := http.NewRequest("POST", s.server.URL+path, strings.NewReader(body))
+	assert.Nil(s.T(), err)
+	if token != "" {
+		r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	res, err := http.DefaultClient.Do(r)
+	assert.Nil(s.T(), err)
+	return res
+}
+
+func (s *ApiRestSuite) TestRefreshToken() {
+	res := s.PostJSON("/login", "{\"username\": \"oskar\", \"password\": \"qwerty\"}", "")
+	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+	login := &TokenResponse{}
+	assert.Nil(s.T(), json.NewDecoder(res.Body).Decode(login))
+	assert.Equal(s.T(), int64(900), login.ExpiresIn)
+
+	// rotate
+	res = s.PostJSON("/token/refresh", fmt.Sprintf("{\"refreshToken\": %q}", login.RefreshToken), "")
+	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+	refreshed := &TokenResponse{}
+	assert.Nil(s.T(), json.NewDecoder(res.Body).Decode(refreshed))
+	assert.NotEqual(s.T(), login.RefreshToken, refreshed.RefreshToken)
+
+	// reusing the old one revokes the new one too
+	res = s.PostJSON("/token/refresh", fmt.Sprintf("{\"refreshToken\": %q}", login.RefreshToken), "")
+	assert.Equal(s.T(), http.StatusUnauthorized, res.StatusCode)
+	res = s.PostJSON("/token/refresh", fmt.Sprintf("{\"refreshToken\": %q}", refreshed.RefreshToken), "")
+	assert.Equal(s.T(), http.StatusUnauthorized, res.StatusCode)
+}
+
+func (s *ApiRestSuite) TestLogout() {
+	res := s.PostJSON("/login", "{\"username\": \"oskar\", \"password\": \"qwerty\"}", "")
+	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+	login := &TokenResponse{}
+	assert.Nil(s.T(), json.NewDecoder(res.Body).Decode(login))
+
+	res = s.PostJSON("/logout", fmt.Sprintf("{\"refreshToken\": %q}", login.RefreshToken), login.Token)
+	assert.Equal(s.T(), http.StatusNoContent, res.StatusCode)
+
+	res = s.PostJSON("/logout", "", login.Token)
+	assert.Equal(s.T(), http.StatusUnauthorized, res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "invalid token: token revoked\n", string(body))
+	res = s.PostJSON("/token/refresh", fmt.Sprintf("{\"refreshToken\": %q}", login.RefreshToken), "")
+	assert.Equal(s.T(), http.StatusUnauthorized, res.StatusCode)
+}
+
+func (s *ApiRestSuite) TestLoginLockout() {
+	for i := 0; i < 3; i++ {
+		res := s.PostJSON("/login", "{\"username\": \"mallory\", \"password\": \"guess\"}", "")
+		assert.Equal(s.T(), http.StatusUnauthorized, res.StatusCode)
+		time.Sleep(10 * time.Millisecond) // the delay after a failure
+	}
+	res := s.PostJSON("/login", "{\"username\": \"mallory\", \"password\": \"guess\"}", "")
+	assert.Equal(s.T(), http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(s.T(), "900", res.Header.Get("Retry-After"))
+
+	// other users can still log in from the same ip
+	res = s.PostJSON("/login", "{\"username\": \"oskar\", \"password\": \"qwerty\"}", "")
+	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+}
+
+func (s *ApiRestSuite) PostMailgun(msg *MailgunMessage) *http.Response {
+	form := url.Values{}
+	form.Set("sender", msg.Sender)
+	form.Set("timestamp", msg.Timestamp)
+	form.Set("token", msg.Token)
+	form.Set("signature", msg.Signature)
+	form.Set("subject", msg.Subject)
+	form.Set("stripped-text", msg.StrippedText)
+	form.Set("message-headers", msg.MessageHeaders)
+	res, err := http.PostForm(s.server.URL+"/download/mailgun", form)
+	assert.Nil(s.T(), err)
+	return res
+}
+
+func (s *ApiRestSuite) TestDownloadMailgunSignature() {
+	msg := &MailgunMessage{Sender: "jorge@larix.cl", StrippedText: "https://www.youtube.com/watch?v=bS5P_LAqiVg"}
+	msg.Timestamp = fmt.Sprint(time.Now().Unix())
+	msg.Token = "8f1fbc0ab3d5e0b5"
+	SignMailgunMessage("mailgun-signing-key", msg)
+	res := s.PostMailgun(msg)
+	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+	s.NextReply()
+
+	// replayed
+	res = s.PostMailgun(msg)
+	assert.Equal(s.T(), http.StatusNotAcceptable, res.StatusCode)
+
+	// forged sender
+	msg.Token = "e3c1a1b9a2bdd4d0"
+	msg.Signature = "00"
+	res = s.PostMailgun(msg)
+	assert.Equal(s.T(), http.StatusNotAcceptable, res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "invalid Mailgun signature\n", string(body))
+}
+
+// NextReply waits for a reply sent by the mailer
+func (s *ApiRestSuite) NextReply() *MailReply {
+	select {
+	case reply := <-s.mailer.Replies:
+		return reply
+	case <-time.After(time.Second):
+		s.T().Fatal("missing reply")
+		return nil
+	}
+}
+
+// PostMailgunText posts a signed email request
+func (s *ApiRestSuite) PostMailgunText(sender string, subject string, text string, headers string) {
+	msg := &MailgunMessage{Sender: sender, Subject: subject, StrippedText: text, MessageHeaders: headers}
+	msg.Timestamp = fmt.Sprint(time.Now().Unix())
+	msg.Token, _ = randomHex(8)
+	SignMailgunMessage("mailgun-signing-key", msg)
+	res := s.PostMailgun(msg)
+	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+}
+
+func (s *ApiRestSuite) TestDownloadMailgunReply() {
+	s.PostMailgunText("oskar@gmail.com", "video", "asdf", `[["Message-Id", "<1234@gmail.com>"]]`)
+	reply := s.NextReply()
+	assert.Equal(s.T(), &MailReply{Name: "Oskar", Email: "oskar@gmail.com", Subject: "video", MessageId: "<1234@gmail.com>",
+		Error: &RequestError{Code: ErrCodeNoUrls}}, reply)
+	s.PostMailgunText("oskar@gmail.com", "video", "https://www.youtube.com/watch?v=bS5P_LAqiVg\nfrom 4:00 to 1:30", "")
+	reply = s.NextReply()
+	assert.Equal(s.T(), &RequestError{Code: ErrCodeEndBeforeStart}, reply.Error)
+
+	// no replies to unknown senders or auto responders, and at most 5 per hour
+	s.PostMailgunText("mallory@gmail.com", "video", "asdf", "")
+	s.PostMailgunText("oskar@gmail.com", "video", "asdf", `[["Auto-Submitted", "auto-replied"]]`)
+	for i := 0; i < 3; i++ {
+		s.PostMailgunText("oskar@gmail.com", "video", "asdf", "")
+		s.NextReply()
+	}
+	s.PostMailgunText("oskar@gmail.com", "video", "asdf", "")
+	select {
+	case reply := <-s.mailer.Replies:
+		s.T().Errorf("unexpected reply %+v", reply)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func (s *ApiRestSuite) TestDownloadMailgunMultiple() {
+	text := "look at these:\nhttps://vimeo.com/123456, and http://127.0.0.1/video.mp4\n\naudio\nfrom 1:30 to 4:00\n"
+	s.PostMailgunText("jorge@larix.cl", "https://www.youtube.com/watch?v=bS5P_LAqiVg", text, "")
+	reply := s.NextReply()
+	assert.Nil(s.T(), reply.Error)
+	assert.Equal(s.T(), DownloadOptions{Audio: true, Start: 90, End: 240}, reply.Options)
+	assert.Equal(s.T(), 3, len(reply.Jobs))
+	urls := []string{"https://www.youtube.com/watch?v=bS5P_LAqiVg", "https://vimeo.com/123456", "http://127.0.0.1/video.mp4"}
+	for i, job := range reply.Jobs {
+		assert.Equal(s.T(), urls[i], job.SrcUrl.String())
+		assert.Equal(s.T(), DownloadOptions{Audio: true, Start: 90, End: 240}, job.Options)
+	}
+	assert.Nil(s.T(), reply.Jobs[0].Error)
+	assert.Nil(s.T(), reply.Jobs[1].Error)
+	assert.Equal(s.T(), "host 127.0.0.1 resolves to a private address", reply.Jobs[2].Error.Error())
+}
+
+func (s *ApiRestSuite) TestDownloadEmail() {
+	raw := "From: Jorge <jorge@larix.cl>\r\nSubject: video\r\nMessage-Id: <42@larix.cl>\r\n\r\nhttps://vimeo.com/654321\r\n"
+	res, err := http.Post(s.server.URL+"/download/email?token=wrong", "message/rfc822", strings.NewReader(raw))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), http.StatusUnauthorized, res.StatusCode)
+
+	res, err = http.Post(s.server.URL+"/download/email?token=inbound-token", "message/rfc822", strings.NewReader(raw))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+	reply := s.NextReply()
+	assert.Equal(s.T(), "<42@larix.cl>", reply.MessageId)
+	assert.Equal(s.T(), 1, len(reply.Jobs))
+	assert.Equal(s.T(), "https://vimeo.com/654321", reply.Jobs[0].SrcUrl.String())
+
+	// postmark
+	body, _ := json.Marshal(map[string]string{"RawEmail": raw})
+	r, err := http.NewRequest("POST", s.server.URL+"/download/email", strings.NewReader(string(body)))
+	assert.Nil(s.T(), err)
+	r.Header.Set("Content-Type", "application/json")
+	r.SetBasicAuth("postmark", "inbound-token")
+	res, err = http.DefaultClient.Do(r)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+	s.NextReply()
+}
+
+func (s *ApiRestSuite) TestDownloadOptions() {
+	body := "{\"url\": \"https://www.youtube.com/watch?v=bS5P_LAqiVg\", \"options\": {\"maxHeight\": 720, \"subtitles\": [\"es\"]}}"
+	res := s.PostJSON("/download", body, s.CreateToken("jriquelme"))
+	assert.Equal(s.T(), http.StatusCreated, res.StatusCode)
+	info := &JobInfo{}
+	assert.Nil(s.T(), json.NewDecoder(res.Body).Decode(info))
+	assert.Equal(s.T(), &DownloadOptions{MaxHeight: 720, Subtitles: []string{"es"}}, info.Options)
+
+	body = "{\"url\": \"https://www.youtube.com/watch?v=bS5P_LAqiVg\", \"options\": {\"subtitles\": [\"--exec\"]}}"
+	res = s.PostJSON("/download", body, s.CreateToken("jriquelme"))
+	assert.Equal(s.T(), http.StatusBadRequest, res.StatusCode)
+
+	// checked before queueing the job
+	body = "{\"url\": \"https://cdn.example.com/video.mp4\", \"checksum\": \"sha256:abc\"}"
+	res = s.PostJSON("/download", body, s.CreateToken("jriquelme"))
+	assert.Equal(s.T(), http.StatusBadRequest, res.StatusCode)
+	message, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(s.T(), "invalid sha256 checksum \"abc\"\n", string(message))
+}
+
+func (s *ApiRestSuite) TestCreateUser() {
+	// request
+	body := "{\"username\": \"charles\", \"name\": \"Charles\", \"email\": \"charles@gmail.com\", \"password\": \"spleen\"}"
+	r, err := http.NewRequest("POST", fmt.Sprintf("%s/users", s.server.URL), strings.NewReader(body))
+	assert.Nil(s.T(), err)
+	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.CreateToken("jriquelme")))
+	res, err := http.DefaultClient.Do(r)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), http.StatusCreated, res.StatusCode)
+
+	// again
+	r, err = http.NewRequest("POST", fmt.Sprintf("%s/users", s.server.URL), strings.NewReader(body))
+	assert.Nil(s.T(), err)
+	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.CreateToken("jriquelme")))
+	res, err = http.DefaultClient.Do(r)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), http.StatusConflict, res.StatusCode)
+
+	// delete it
+	r, err = http.NewRequest("DELETE", fmt.Sprintf("%s/users/charles", s.server.URL), nil)
+	assert.Nil(s.T(), err)
+	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.CreateToken("jriquelme")))
+	res, err = http.DefaultClient.Do(r)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), http.StatusNoContent, res.StatusCode)
+}
+
+func (s *ApiRestSuite) TestDeleteUserCredentials() {
+	admin := s.CreateToken("jriquelme")
+	request := func(method string, path string, body string, header string, value string) int {
+		r, err := http.NewRequest(method, s.server.URL+path, strings.NewReader(body))
+		assert.Nil(s.T(), err)
+		r.Header.Add(header, value)
+		res, err := http.DefaultClient.Do(r)
+		assert.Nil(s.T(), err)
+		return res.StatusCode
+	}
+	create := `{"username": "dora", "name": "Dora", "email": "dora@gmail.com", "password": "maar"}`
+	login := func() *TokenResponse {
+		res := s.PostJSON("/login", `{"username": "dora", "password": "maar"}`, "")
+		assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+		login := &TokenResponse{}
+		assert.Nil(s.T(), json.NewDecoder(res.Body).Decode(login))
+		return login
+	}
+	refresh := func(login *TokenResponse) int {
+		return s.PostJSON("/token/refresh", fmt.Sprintf(`{"refreshToken": %q}`, login.RefreshToken), "").StatusCode
+	}
+	assert.Equal(s.T(), http.StatusCreated, s.PostJSON("/users", create, admin).StatusCode)
+
+	// a new password ends the logins
+	first := login()
+	assert.Equal(s.T(), http.StatusOK, request("PUT", "/users/dora/password", `{"password": "maar"}`, "Authorization", "Bearer "+admin))
+	assert.Equal(s.T(), http.StatusUnauthorized, refresh(first))
+
+	// everything of dora, deleted with her
+	second := login()
+	res := s.PostJSON("/apikeys", `{"name": "cron", "scopes": ["read"]}`, second.Token)
+	assert.Equal(s.T(), http.StatusCreated, res.StatusCode)
+	key := &ApiKeyInfo{}
+	assert.Nil(s.T(), json.NewDecoder(res.Body).Decode(key))
+	assert.Equal(s.T(), http.StatusAccepted, s.PostJSON("/account/emails", `{"email": "dora@larix.cl"}`, second.Token).StatusCode)
+	var confirmation *EmailConfirmation
+	select {
+	case confirmation = <-s.mailer.Confirmations:
+	case <-time.After(time.Second):
+		s.T().Fatal("missing confirmation")
+	}
+	assert.Equal(s.T(), http.StatusNoContent, request("DELETE", "/users/dora", "", "Authorization", "Bearer "+admin))
+	assert.Equal(s.T(), http.StatusNotFound, request("DELETE", "/users/dora", "", "Authorization", "Bearer "+admin))
+
+	// a new dora doesn't inherit them
+	assert.Equal(s.T(), http.StatusCreated, s.PostJSON("/users", create, admin).StatusCode)
+	assert.Equal(s.T(), http.StatusUnauthorized, request("GET", "/jobs", "", "X-API-Key", key.Key))
+	assert.Equal(s.T(), http.StatusUnauthorized, refresh(second))
+	verify := fmt.Sprintf(`{"code": %q}`, confirmation.Code)
+	assert.Equal(s.T(), http.StatusBadRequest, s.PostJSON("/account/emails/verify", verify, s.CreateToken("dora")).StatusCode)
+	assert.Equal(s.T(), http.StatusNoContent, request("DELETE", "/users/dora", "", "Authorization", "Bearer "+admin))
+}
+
+func (s *ApiRestSuite) TestAccountEmails() {
+	token := s.CreateToken("jriquelme")
+	res := s.PostJSON("/account/emails", `{"email": "Jorge <Jorge@Gmail.com>"}`, token)
+	assert.Equal(s.T(), http.StatusAccepted, res.StatusCode)
+	var confirmation *EmailConfirmation
+	select {
+	case confirmation = <-s.mailer.Confirmations:
+	case <-time.After(time.Second):
+		s.T().Fatal("missing confirmation")
+	}
+	assert.Equal(s.T(), "Jorge@Gmail.com", confirmation.Email)
+
+	// taken by another user
+	res = s.PostJSON("/account/emails", `{"email": "OSKAR@gmail.com"}`, token)
+	assert.Equal(s.T(), http.StatusConflict, res.StatusCode)
+
+	res = s.PostJSON("/account/emails/verify", `{"code": "asdf"}`, token)
+	assert.Equal(s.T(), http.StatusBadRequest, res.StatusCode)
+	res = s.PostJSON("/account/emails/verify", fmt.Sprintf(`{"code": "%s"}`, confirmation.Code), token)
+	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+	emails := &EmailsInfo{}
+	assert.Nil(s.T(), json.NewDecoder(res.Body).Decode(emails))
+	assert.Equal(s.T(), &EmailsInfo{"jorge@larix.cl", []string{"Jorge@Gmail.com"}}, emails)
+	// codes are used once
+	res = s.PostJSON("/account/emails/verify", fmt.Sprintf(`{"code": "%s"}`, confirmation.Code), token)
+	assert.Equal(s.T(), http.StatusBadRequest, res.StatusCode)
+
+	deleteEmail := func(email string) int {
+		r, err := http.NewRequest("DELETE", s.server.URL+"/account/emails/"+email, nil)
+		assert.Nil(s.T(), err)
+		r.Header.Add("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(r)
+		assert.Nil(s.T(), err)
+		return res.StatusCode
+	}
+	assert.Equal(s.T(), http.StatusNoContent, deleteEmail("jorge+videos@gmail.com"))
+	assert.Equal(s.T(), http.StatusNotFound, deleteEmail("jorge@gmail.com"))
+}
+
+func (s *ApiRestSuite) TestSetChat() {
+	put := func(body string) int {
+		r, err := http.NewRequest("PUT", s.server.URL+"/account/chat", strings.NewReader(body))
+		assert.Nil(s.T(), err)
+		r.Header.Add("Authorization", "Bearer "+s.CreateToken("oskar"))
+		res, err := http.DefaultClient.Do(r)
+		assert.Nil(s.T(), err)
+		return res.StatusCode
+	}
+	assert.Equal(s.T(), http.StatusBadRequest, put(`{"chat": ["https://10.0.0.1/hooks/x"]}`))
+	assert.Equal(s.T(), http.StatusBadRequest, put(`{"chat": ["http://hooks.example.com/x"]}`))
+	assert.Equal(s.T(), http.StatusOK, put(`{"chat": ["https://hooks.example.com/x"]}`))
+	assert.Equal(s.T(), http.StatusOK, put(`{"chat": []}`))
+}
+
+func (s *ApiRestSuite) TestAccountEmailsLimits() {
+	add := func(sub string, email string) int {
+		res := s.PostJSON("/account/emails", fmt.Sprintf(`{"email": %q}`, email), s.CreateToken(sub))
+		if res.StatusCode == http.StatusAccepted {
+			select {
+			case <-s.mailer.Confirmations:
+			case <-time.After(time.Second):
+				s.T().Fatal("missing confirmation")
+			}
+		}
+		return res.StatusCode
+	}
+	// pending verifications of an user
+	for _, email := range []string{"oskar1@example.org", "oskar2@example.org", "oskar3@example.org"} {
+		assert.Equal(s.T(), http.StatusAccepted, add("oskar", email))
+	}
+	assert.Equal(s.T(), http.StatusTooManyRequests, add("oskar", "oskar4@example.org"))
+	// sending the code again replaces it
+	assert.Equal(s.T(), http.StatusAccepted, add("oskar", "oskar1@example.org"))
+	// verifications sent to an user in an hour
+	assert.Equal(s.T(), http.StatusTooManyRequests, add("oskar", "oskar1@example.org"))
+
+	// and to an address, by any user
+	for i := 0; i < 3; i++ {
+		assert.Equal(s.T(), http.StatusAccepted, add("jriquelme", "oskar1@example.org"))
+	}
+	assert.Equal(s.T(), http.StatusTooManyRequests, add("jriquelme", "oskar1@example.org"))
+}
+
+func (s *ApiRestSuite) TestResendNotification() {
+	sent := make(chan *Notification, 1)
+	s.outbox.Sender = func(n *Notification) (string, error) {
+		sent <- n
+		return "<1@mg.example.com>", nil
+	}
+	n := &Notification{Id: "n1", To: "oskar@gmail.com", Subject: "listo", Status: NotificationFailed, Attempts: 8,
+		LastError: "mailgun is down", Created: time.Now()}
+	assert.Nil(s.T(), s.outbox.Repo.SaveNotification(n))
+
+	get := func(path string, sub string) *http.Response {
+		r, err := http.NewRequest("GET", s.server.URL+path, nil)
+		assert.Nil(s.T(), err)
+		r.Header.Add("Authorization", "Bearer "+s.CreateToken(sub))
+		res, err := http.DefaultClient.Do(r)
+		assert.Nil(s.T(), err)
+		return res
+	}
+	assert.Equal(s.T(), http.StatusForbidden, get("/notifications", "oskar").StatusCode)
+	res := get("/notifications", "jriquelme")
+	assert.Equal(s.T(), http.StatusOK, res.StatusCode)
+	var failed []NotificationInfo
+	assert.Nil(s.T(), json.NewDecoder(res.Body).Decode(&failed))
+	assert.Len(s.T(), failed, 1)
+	assert.Equal(s.T(), "mailgun is down", failed[0].LastError)
+
+	res = s.PostJSON("/notifications/n1/resend", "", s.CreateToken("jriquelme"))
+	assert.Equal(s.T(), http.StatusAccepted, res.StatusCode)
+	assert.Equal(s.T(), http.StatusConflict, s.PostJSON("/notifications/n1/resend", "", s.CreateToken("jriquelme")).StatusCode)
+	assert.Equal(s.T(), http.StatusNotFound, s.PostJSON("/notifications/n2/resend", "", s.CreateToken("jriquelme")).StatusCode)
+	s.outbox.DeliverDue()
+	assert.Equal(s.T(), "oskar@gmail.com", (<-sent).To)
+	n, err := s.outbox.Repo.GetNotification("n1")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), NotificationSent, n.Status)
+}
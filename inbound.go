@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+type InboundConfig struct {
+	Token       string "token"       // secret of /download/email, disabled if empty
+	MaxSize     int64  "maxSize"     // bytes of a message, 10MB by default
+	RequireSPF  bool   "requireSpf"  // reject messages unless Authentication-Results has spf=pass
+	RequireDKIM bool   "requireDkim" // same for dkim=pass
+	AuthservID  string "authservId"  // of the Authentication-Results added by our MTA, its hostname usually
+}
+
+// InboundMail is an email request, from any provider
+type InboundMail struct {
+	Sender        string
+	Subject       string
+	Text          string // without quoted replies
+	MessageId     string
+	AutoGenerated bool // by an auto responder or mailing list
+}
+
+// HandleDownloadEmail receives raw RFC 5322 messages: as the request body
+// (from a local MTA), in the email field of a form (SendGrid) or the
+// RawEmail of a json message (Postmark). The token of the config comes in
+// the token parameter or as the basic auth password.
+func (s *HttpServer) HandleDownloadEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.Inbound.Token)) != 1 {
+		audit.Warning("inbound email with a wrong token from %s", r.RemoteAddr)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	maxSize := s.Inbound.MaxSize
+	if maxSize == 0 {
+		maxSize = 10 << 20
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	raw, err := ReadRawMail(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg, err := ParseRawMail(raw)
+	if err != nil {
+		log.Error("error parsing inbound email: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.CheckMailAuthentication(msg); err != nil {
+		audit.Warning("inbound email from %s rejected: %s", msg.Sender, err)
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	s.ProcessMail(msg.InboundMail)
+}
+
+// ReadRawMail returns the raw message of a request to /download/email
+func ReadRawMail(r *http.Request) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data", "application/x-www-form-urlencoded":
+		if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+			return nil, err
+		}
+		if email := r.FormValue("email"); email != "" {
+			return []byte(email), nil
+		}
+		return nil, errors.New("missing email field")
+	case "application/json":
+		message := struct {
+			RawEmail string
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			return nil, errors.New("invalid json message.")
+		}
+		if message.RawEmail == "" {
+			return nil, errors.New("missing RawEmail")
+		}
+		return []byte(message.RawEmail), nil
+	}
+	return ioutil.ReadAll(r.Body)
+}
+
+// RawMail is a parsed RFC 5322 message
+type RawMail struct {
+	InboundMail
+	Header mail.Header
+}
+
+// ParseRawMail gets the sender, subject and text of a message. HTML bodies
+// are converted to text (with the urls of their links), and forwarded
+// messages attached as message/rfc822 are included.
+func ParseRawMail(raw []byte) (*RawMail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid From: %s", err)
+	}
+	parsed := &RawMail{Header: msg.Header}
+	parsed.Sender = from.Address
+	decoder := &mime.WordDecoder{CharsetReader: charsetReader}
+	if parsed.Subject, err = decoder.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		parsed.Subject = msg.Header.Get("Subject")
+	}
+	parsed.MessageId = msg.Header.Get("Message-Id")
+	parsed.AutoGenerated = isAutoGenerated(msg.Header.Get("Auto-Submitted"), msg.Header.Get("Precedence"))
+	text, err := partText(msg.Header, msg.Body, 0)
+	if err != nil {
+		return nil, err
+	}
+	parsed.Text = stripQuotes(text)
+	return parsed, nil
+}
+
+// isAutoGenerated tells, from its headers, if a message was sent by an auto
+// responder or a mailing list, which never get replies (avoiding mail loops)
+func isAutoGenerated(autoSubmitted string, precedence string) bool {
+	if autoSubmitted != "" && !strings.EqualFold(autoSubmitted, "no") {
+		return true
+	}
+	switch strings.ToLower(precedence) {
+	case "bulk", "list", "junk", "auto_reply":
+		return true
+	}
+	return false
+}
+
+// AuthResult is the result of a method in an Authentication-Results header,
+// with its properties (smtp.mailfrom, header.d, ...)
+type AuthResult struct {
+	Result     string
+	Properties map[string]string
+}
+
+// CheckMailAuthentication checks the SPF and DKIM results added by our MTA,
+// if the config requires them. Only the top-most Authentication-Results of
+// the authserv-id of the config counts, the sender can add others. SPF checks
+// the envelope sender and DKIM any domain, so the domain of a passing result
+// must be the one of the From address (or a subdomain of it), else anyone
+// could send as our users from their own domains.
+func (s *HttpServer) CheckMailAuthentication(msg *RawMail) error {
+	if !s.Inbound.RequireSPF && !s.Inbound.RequireDKIM {
+		return nil
+	}
+	var results map[string][]AuthResult
+	for _, header := range msg.Header["Authentication-Results"] {
+		authservID, methods := ParseAuthenticationResults(header)
+		if s.Inbound.AuthservID != "" && strings.EqualFold(authservID, s.Inbound.AuthservID) {
+			results = methods
+			break
+		}
+	}
+	if results == nil {
+		return fmt.Errorf("message of %s without Authentication-Results of %s", msg.Sender, s.Inbound.AuthservID)
+	}
+	domain := addressDomain(msg.Sender)
+	if s.Inbound.RequireSPF && !hasAlignedPass(results["spf"], domain, "smtp.mailfrom") {
+		return fmt.Errorf("SPF check of %s didn't pass", msg.Sender)
+	}
+	// one for each signature, any valid one will do
+	if s.Inbound.RequireDKIM && !hasAlignedPass(results["dkim"], domain, "header.d") {
+		return fmt.Errorf("DKIM check of %s didn't pass", msg.Sender)
+	}
+	return nil
+}
+
+// ParseAuthenticationResults returns the authserv-id of an
+// Authentication-Results header (RFC 8601) and the results of each method,
+// lowercase. Comments are ignored.
+func ParseAuthenticationResults(header string) (string, map[string][]AuthResult) {
+	parts := splitUnquoted(stripComments(header), ';')
+	// the authserv-id, maybe followed by a version
+	fields := strings.Fields(parts[0])
+	if len(fields) == 0 {
+		return "", nil
+	}
+	results := make(map[string][]AuthResult)
+	for _, resinfo := range parts[1:] {
+		fields := strings.Fields(resinfo)
+		if len(fields) == 0 {
+			continue
+		}
+		pair := strings.SplitN(fields[0], "=", 2)
+		if len(pair) != 2 {
+			continue // none, or malformed
+		}
+		method := strings.ToLower(strings.TrimSpace(strings.SplitN(pair[0], "/", 2)[0]))
+		result := AuthResult{Result: strings.ToLower(pair[1]), Properties: make(map[string]string)}
+		for _, field := range fields[1:] {
+			property := strings.SplitN(field, "=", 2)
+			// ptype.property, not reason=
+			if len(property) == 2 && strings.Contains(property[0], ".") {
+				result.Properties[strings.ToLower(property[0])] = strings.Trim(property[1], `"`)
+			}
+		}
+		results[method] = append(results[method], result)
+	}
+	return fields[0], results
+}
+
+// hasAlignedPass tells if a result passed for domain, or a subdomain of it,
+// in the property
+func hasAlignedPass(results []AuthResult, domain string, property string) bool {
+	for _, result := range results {
+		if result.Result != "pass" || domain == "" {
+			continue
+		}
+		passed := addressDomain(result.Properties[property])
+		if passed == domain || strings.HasSuffix(passed, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressDomain returns the lowercase domain of an address, or the value
+// itself if it's a domain already
+func addressDomain(address string) string {
+	return strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+}
+
+// stripComments removes the (comments) of a header, nested or with escapes,
+// keeping the quoted strings
+func stripComments(header string) string {
+	var b bytes.Buffer
+	depth := 0
+	quoted := false
+	for i := 0; i < len(header); i++ {
+		c := header[i]
+		switch {
+		case c == '\\' && (quoted || depth > 0):
+			if depth == 0 {
+				b.WriteByte(c)
+				if i+1 < len(header) {
+					b.WriteByte(header[i+1])
+				}
+			}
+			i++
+		case c == '"' && depth == 0:
+			quoted = !quoted
+			b.WriteByte(c)
+		case c == '(' && !quoted:
+			depth++
+		case c == ')' && !quoted && depth > 0:
+			depth--
+			// a comment separates tokens
+			if depth == 0 {
+				b.WriteByte(' ')
+			}
+		case depth == 0:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// splitUnquoted splits s around sep, except in quoted strings
+func splitUnquoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// the headers of a message or part (mail.Header or textproto.MIMEHeader)
+type partHeader interface {
+	Get(key string) string
+}
+
+// nested multiparts and forwarded messages deeper than this are ignored
+const maxMimeDepth = 8
+
+// partText returns the text of a MIME part: the plain text alternative if
+// there's one, or the html one converted to text
+func partText(header partHeader, body io.Reader, depth int) (string, error) {
+	if depth > maxMimeDepth {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	body = transferDecoder(header.Get("Content-Transfer-Encoding"), body)
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		reader := multipart.NewReader(body, params["boundary"])
+		var texts []string
+		var plain, htmlText string
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return "", err
+			}
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if strings.HasPrefix(part.Header.Get("Content-Disposition"), "attachment") && partType != "message/rfc822" {
+				continue
+			}
+			text, err := partText(part.Header, part, depth+1)
+			if err != nil {
+				return "", err
+			}
+			switch {
+			case mediaType != "multipart/alternative":
+				texts = append(texts, text)
+			case partType == "text/html":
+				htmlText = text
+			case plain == "":
+				plain = text
+			}
+		}
+		if mediaType == "multipart/alternative" {
+			if plain != "" {
+				return plain, nil
+			}
+			return htmlText, nil
+		}
+		return strings.Join(texts, "\n"), nil
+	case mediaType == "message/rfc822":
+		// a forwarded message
+		forwarded, err := mail.ReadMessage(body)
+		if err != nil {
+			return "", err
+		}
+		text, err := partText(forwarded.Header, forwarded.Body, depth+1)
+		return forwarded.Header.Get("Subject") + "\n" + text, err
+	case mediaType == "text/plain" || mediaType == "text/html":
+		content, err := ioutil.ReadAll(body)
+		if err != nil {
+			return "", err
+		}
+		text := decodeCharset(params["charset"], content)
+		if mediaType == "text/html" {
+			text = HtmlToText(text)
+		}
+		return text, nil
+	}
+	return "", nil
+}
+
+func transferDecoder(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+// decodeCharset converts latin1 text to utf-8 (other charsets are left as
+// they are, hopefully utf-8 or ascii)
+func decodeCharset(charset string, content []byte) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252":
+		runes := make([]rune, len(content))
+		for i, b := range content {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	return string(content)
+}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	content, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(decodeCharset(charset, content)), nil
+}
+
+var (
+	htmlIgnored = regexp.MustCompile(`(?is)<(script|style|head)[^>]*>.*?</(script|style|head)>`)
+	htmlBreak   = regexp.MustCompile(`(?i)<(br|/p|/div|/li|/tr|/h\d)[^>]*>`)
+	htmlHref    = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*["']([^"']+)["'][^>]*>`)
+	htmlTag     = regexp.MustCompile(`<[^>]*>`)
+)
+
+// HtmlToText converts an html body to text with a line per paragraph. The
+// urls of links go in their own line, after the text of the link.
+func HtmlToText(body string) string {
+	body = htmlIgnored.ReplaceAllString(body, "")
+	body = htmlBreak.ReplaceAllString(body, "\n")
+	var hrefs []string
+	for _, match := range htmlHref.FindAllStringSubmatch(body, -1) {
+		hrefs = append(hrefs, html.UnescapeString(match[1]))
+	}
+	body = html.UnescapeString(htmlTag.ReplaceAllString(body, ""))
+	var lines []string
+	for _, line := range strings.Split(body, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(append(lines, hrefs...), "\n")
+}
+
+// stripQuotes drops the quoted lines of replies, so the urls of our own
+// messages aren't downloaded again
+func stripQuotes(text string) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), ">") {
+			lines = append(lines, strings.TrimRight(line, "\r"))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ProcessMail creates the jobs of an email request from a registered sender,
+// replying with them (or the reason they weren't created)
+func (s *HttpServer) ProcessMail(msg InboundMail) {
+	if msg.AutoGenerated {
+		log.Info("ignoring auto generated message from %s", msg.Sender)
+		return
+	}
+
+	// get account
+	account := s.GetAccountFromEmail(msg.Sender)
+	if account == nil || account.Disabled {
+		// no replies to unknown senders, they're usually forged
+		log.Error("unknown sender of email request: %s", msg.Sender)
+		return
+	}
+
+	log.Debug("parsing %s", msg.Text)
+	request, err := ParseMailRequest(msg.Subject, msg.Text)
+	if err != nil {
+		log.Error("wrong email request from %s: %s", msg.Sender, err)
+		s.ReplyToSender(account, &msg, &MailReply{Error: err})
+		return
+	}
+
+	reply := &MailReply{Options: request.Options}
+	for _, videoUrl := range request.Urls {
+		videoDwn, err := s.NewJob(account, account.Username, videoUrl)
+		if err != nil {
+			log.Error("error creating job for %s: %s", videoUrl, err)
+			return
+		}
+		videoDwn.Options = request.Options
+		if err := s.URLPolicy.CheckURL(videoUrl); err != nil {
+			log.Error("url %s from email rejected: %s", videoUrl, err)
+			s.RejectJob(videoDwn, err)
+		} else if err := s.AddJob(account, videoDwn); err != nil {
+			log.Error("url %s from email rejected: %s", videoUrl, err)
+			s.RejectJob(videoDwn, err)
+		} else {
+			// everything is ok, download!
+			go s.Downloader.DownloadVideo(videoDwn)
+		}
+		reply.Jobs = append(reply.Jobs, videoDwn)
+	}
+	s.ReplyToSender(account, &msg, reply)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRawMail(t *testing.T) {
+	raw := strings.Replace(`From: Jorge <jorge@larix.cl>
+To: yutubaas@mg.mydomain.com
+Subject: =?ISO-8859-1?Q?canci=F3n?=
+Message-Id: <1234@larix.cl>
+Content-Type: text/plain; charset=utf-8
+
+https://www.youtube.com/watch?v=bS5P_LAqiVg
+audio
+
+> https://vimeo.com/123456 (quoted, ignored)
+`, "\n", "\r\n", -1)
+	msg, err := ParseRawMail([]byte(raw))
+	assert.Nil(t, err)
+	assert.Equal(t, "jorge@larix.cl", msg.Sender)
+	assert.Equal(t, "canción", msg.Subject)
+	assert.Equal(t, "<1234@larix.cl>", msg.MessageId)
+	assert.False(t, msg.AutoGenerated)
+	assert.Equal(t, "https://www.youtube.com/watch?v=bS5P_LAqiVg\naudio\n\n", msg.Text)
+}
+
+func TestParseRawMailHtml(t *testing.T) {
+	// html only, base64
+	raw := `From: jorge@larix.cl
+Subject: video
+Auto-Submitted: auto-replied
+Content-Type: text/html; charset=utf-8
+Content-Transfer-Encoding: base64
+
+PGh0bWw+PGhlYWQ+PHN0eWxlPnAge308L3N0eWxlPjwvaGVhZD48Ym9keT48cD5NaXJhIDxhIGhy
+ZWY9Imh0dHBzOi8vd3d3LnlvdXR1YmUuY29tL3dhdGNoP3Y9YlM1UF9MQXFpVmcmYW1wO3Q9MTAi
+PmVzdGU8L2E+PC9wPjxwPjcyMHA8L3A+PC9ib2R5PjwvaHRtbD4=
+`
+	msg, err := ParseRawMail([]byte(raw))
+	assert.Nil(t, err)
+	assert.True(t, msg.AutoGenerated)
+	assert.Equal(t, "Mira este\n720p\nhttps://www.youtube.com/watch?v=bS5P_LAqiVg&t=10", msg.Text)
+}
+
+func TestParseRawMailMultipart(t *testing.T) {
+	raw := `From: jorge@larix.cl
+Subject: Fwd: video
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+m=C3=ADralo
+--inner
+Content-Type: text/html; charset=utf-8
+
+<p>m&iacute;ralo</p>
+--inner--
+--outer
+Content-Type: image/png
+Content-Disposition: attachment; filename="https.png"
+
+https://example.com/not-an-url-but-an-image
+--outer
+Content-Type: message/rfc822
+Content-Disposition: attachment
+
+From: Oskar <oskar@gmail.com>
+Subject: https://vimeo.com/123456
+
+check this
+--outer--
+`
+	msg, err := ParseRawMail([]byte(raw))
+	assert.Nil(t, err)
+	assert.Equal(t, "míralo\nhttps://vimeo.com/123456\ncheck this", msg.Text)
+	request, err := ParseMailRequest(msg.Subject, msg.Text)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://vimeo.com/123456", request.Urls[0].String())
+}
+
+func TestParseAuthenticationResults(t *testing.T) {
+	id, results := ParseAuthenticationResults(`mx.larix.cl 1; spf=pass (sender (SPF) "ok") smtp.mailfrom=jorge@larix.cl;
+	 dkim=fail header.d=larix.cl; DKIM/1=Pass header.d=gmail.com; dmarc=none reason="a; spf=fail"`)
+	assert.Equal(t, "mx.larix.cl", id)
+	assert.Equal(t, map[string][]AuthResult{
+		"spf":   {{"pass", map[string]string{"smtp.mailfrom": "jorge@larix.cl"}}},
+		"dkim":  {{"fail", map[string]string{"header.d": "larix.cl"}}, {"pass", map[string]string{"header.d": "gmail.com"}}},
+		"dmarc": {{"none", map[string]string{}}},
+	}, results)
+
+	id, results = ParseAuthenticationResults("mx.larix.cl; none")
+	assert.Equal(t, "mx.larix.cl", id)
+	assert.Empty(t, results)
+}
+
+func TestCheckMailAuthentication(t *testing.T) {
+	server := &HttpServer{Inbound: InboundConfig{RequireSPF: true, RequireDKIM: true, AuthservID: "mx.larix.cl"}}
+	check := func(headers ...string) error {
+		raw := ""
+		for _, header := range headers {
+			raw += "Authentication-Results: " + header + "\r\n"
+		}
+		msg, err := ParseRawMail([]byte(raw + "From: jorge@larix.cl\r\nSubject: video\r\n\r\nhttps://vimeo.com/123456\r\n"))
+		assert.Nil(t, err)
+		return server.CheckMailAuthentication(msg)
+	}
+	assert.Nil(t, check("mx.larix.cl; spf=pass smtp.mailfrom=larix.cl; dkim=pass header.d=larix.cl"))
+	assert.NotNil(t, check("mx.larix.cl; spf=pass smtp.mailfrom=larix.cl; dkim=fail header.d=larix.cl"))
+	assert.Nil(t, check("mx.larix.cl; spf=pass smtp.mailfrom=bounces@mail.larix.cl; dkim=pass header.d=LARIX.cl"))
+
+	// passing for the domain of the attacker, not the one in From
+	assert.NotNil(t, check("mx.larix.cl; spf=pass smtp.mailfrom=evil@evil.example.com; dkim=pass header.d=larix.cl"))
+	assert.NotNil(t, check("mx.larix.cl; spf=pass smtp.mailfrom=larix.cl; dkim=pass header.d=evil.example.com"))
+	assert.NotNil(t, check("mx.larix.cl; spf=pass smtp.mailfrom=evil-larix.cl; dkim=pass header.d=evillarix.cl"))
+	assert.NotNil(t, check("mx.larix.cl; spf=pass; dkim=pass"))
+
+	// forged by the sender: of other servers, below ours, in comments or
+	// in the values
+	assert.NotNil(t, check("evil.example.com; spf=pass; dkim=pass"))
+	assert.NotNil(t, check("mx.larix.cl; spf=fail; dkim=fail", "mx.larix.cl; spf=pass; dkim=pass"))
+	assert.NotNil(t, check("mx.larix.cl; spf=fail (spf=pass; dkim=pass) smtp.mailfrom=larix.cl; dkim=none"))
+	assert.NotNil(t, check(`mx.larix.cl; spf=pass smtp.mailfrom="x;dkim=pass"; dkim=none`))
+	assert.NotNil(t, check("mx.larix.cl.evil.example.com; spf=pass; dkim=pass"))
+	assert.NotNil(t, check())
+
+	// without an authserv-id nothing is trusted
+	server.Inbound.AuthservID = ""
+	assert.NotNil(t, check("mx.larix.cl; spf=pass; dkim=pass"))
+}
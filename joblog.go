@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how many error lines are kept to report in the job record and notification
+const jobLogErrorLines = 5
+
+// JobLog is the log file of a single job. Every line written by youtube-dl
+// (stdout and stderr) ends up here. The file is capped to MaxSize bytes,
+// rotating old content to <path>.1 ... <path>.<MaxBackups>.
+type JobLog struct {
+	Id         string
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	streams []*lineWriter
+	errors  []string // lines with an ERROR: mark
+	tail    []string // last stderr lines, used when there are no errors
+}
+
+func OpenJobLog(id string, path string, maxSize int64, maxBackups int) (*JobLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &JobLog{Id: id, Path: path, MaxSize: maxSize, MaxBackups: maxBackups, file: file}, nil
+}
+
+// Stream returns a writer that splits its input in lines and writes each of
+// them to the log, tagged with name.
+func (l *JobLog) Stream(name string) io.Writer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w := &lineWriter{fn: func(line string) { l.WriteLine(name, line) }}
+	l.streams = append(l.streams, w)
+	return w
+}
+
+func (l *JobLog) WriteLine(stream string, line string) {
+	log.Debug("[%s] %s: %s", l.Id, stream, line)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if stream == "stderr" && strings.TrimSpace(line) != "" {
+		if strings.Contains(line, "ERROR:") {
+			l.errors = appendCapped(l.errors, line, jobLogErrorLines)
+		}
+		l.tail = appendCapped(l.tail, line, jobLogErrorLines)
+	}
+	entry := fmt.Sprintf("%s %s: %s\n", time.Now().Format("15:04:05.000"), stream, line)
+	if err := l.write([]byte(entry)); err != nil {
+		log.Error("error writing log of job %s: %s", l.Id, err)
+	}
+}
+
+// ErrorLines returns the last lines reported as errors by youtube-dl, or the
+// last lines of stderr if there was no explicit error.
+func (l *JobLog) ErrorLines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lines := l.errors
+	if len(lines) == 0 {
+		lines = l.tail
+	}
+	return append([]string(nil), lines...)
+}
+
+func (l *JobLog) Close() error {
+	for _, stream := range l.streams {
+		stream.Flush()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// must be called with the lock held
+func (l *JobLog) write(b []byte) error {
+	if l.MaxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+func (l *JobLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if l.MaxBackups > 0 {
+		for i := l.MaxBackups - 1; i > 0; i-- {
+			older := fmt.Sprintf("%s.%d", l.Path, i)
+			if _, err := os.Stat(older); err == nil {
+				if err := os.Rename(older, fmt.Sprintf("%s.%d", l.Path, i+1)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := os.Rename(l.Path, l.Path+".1"); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(l.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.size = 0
+	return nil
+}
+
+// ReadJobLog copies the log at path to w, including the rotated files (oldest
+// first).
+func ReadJobLog(path string, w io.Writer) error {
+	var backups []string
+	for i := 1; ; i++ {
+		backup := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(backup); err != nil {
+			break
+		}
+		backups = append([]string{backup}, backups...)
+	}
+	for _, file := range append(backups, path) {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendCapped(lines []string, line string, max int) []string {
+	lines = append(lines, line)
+	if len(lines) > max {
+		lines = lines[len(lines)-max:]
+	}
+	return lines
+}
+
+// lineWriter calls fn for every complete line written to it
+type lineWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	fn  func(line string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.buf.Next(i + 1))
+		w.fn(strings.TrimRight(line, "\r\n"))
+	}
+	return len(p), nil
+}
+
+// Flush sends any pending incomplete line
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() > 0 {
+		w.fn(strings.TrimRight(w.buf.String(), "\r\n"))
+		w.buf.Reset()
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobLogErrorLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yutubaas")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	jobLog, err := OpenJobLog("job", filepath.Join(dir, "job.log"), 0, 0)
+	assert.Nil(t, err)
+	stderr := jobLog.Stream("stderr")
+	fmt.Fprint(stderr, "WARNING: something\nERROR: first\n")
+	fmt.Fprint(jobLog.Stream("stdout"), "[download] 10%\n")
+	fmt.Fprint(stderr, "ERROR: unfinished")
+	assert.Nil(t, jobLog.Close())
+	assert.Equal(t, []string{"ERROR: first", "ERROR: unfinished"}, jobLog.ErrorLines())
+}
+
+func TestJobLogTailWithoutErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yutubaas")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	jobLog, err := OpenJobLog("job", filepath.Join(dir, "job.log"), 0, 0)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		jobLog.WriteLine("stderr", fmt.Sprintf("line %d", i))
+	}
+	assert.Nil(t, jobLog.Close())
+	assert.Equal(t, []string{"line 5", "line 6", "line 7", "line 8", "line 9"}, jobLog.ErrorLines())
+}
+
+func TestJobLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yutubaas")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "job.log")
+	jobLog, err := OpenJobLog("job", path, 100, 2)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		jobLog.WriteLine("stdout", fmt.Sprintf("line %02d", i))
+	}
+	assert.Nil(t, jobLog.Close())
+
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+	for _, file := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(file)
+		assert.Nil(t, err)
+		assert.True(t, info.Size() <= 100)
+	}
+
+	// the newest lines are kept, in order
+	out := &bytes.Buffer{}
+	assert.Nil(t, ReadJobLog(path, out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.True(t, strings.HasSuffix(lines[len(lines)-1], "stdout: line 19"))
+	assert.True(t, strings.HasSuffix(lines[0], fmt.Sprintf("stdout: line %02d", 20-len(lines))))
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+type JobStatus string
+
+const (
+	JobQueued      JobStatus = "queued"
+	JobDownloading JobStatus = "downloading"
+	JobUploading   JobStatus = "uploading"
+	JobDone        JobStatus = "done"
+	JobFailed      JobStatus = "failed"
+	JobCancelled   JobStatus = "cancelled"
+)
+
+var ErrJobCancelled = errors.New("job cancelled")
+
+type JobRepository interface {
+	SaveJob(video *DownloadVideo)
+	// AddJob saves a new job if check, given the jobs of its user, returns
+	// nil; no other job is added in between
+	AddJob(video *DownloadVideo, check func(jobs []*DownloadVideo) error) error
+	GetJob(id string) *DownloadVideo
+	ListJobs(username string) []*DownloadVideo // all the jobs if username is empty, oldest first
+	CancelJob(id string) bool                  // false if the job doesn't exist or is finished
+	AddMessageId(id string, messageId string)  // of a notification about the job
+}
+
+// Finished tells if the job is done, failed or cancelled
+func (video *DownloadVideo) Finished() bool {
+	return video.Status == JobDone || video.Status == JobFailed || video.Status == JobCancelled
+}
+
+// IsCancelled tells if the job was cancelled while running
+func (video *DownloadVideo) IsCancelled() bool {
+	select {
+	case <-video.Cancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// MemoryJobRepository keeps the jobs in memory. The downloader keeps working
+// on its own DownloadVideo, so the repository stores and returns copies.
+type MemoryJobRepository struct {
+	mu   sync.RWMutex
+	jobs map[string]DownloadVideo
+}
+
+func NewMemoryJobRepository() *MemoryJobRepository {
+	return &MemoryJobRepository{jobs: make(map[string]DownloadVideo)}
+}
+
+func (repo *MemoryJobRepository) SaveJob(video *DownloadVideo) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.save(video)
+}
+
+func (repo *MemoryJobRepository) AddJob(video *DownloadVideo, check func(jobs []*DownloadVideo) error) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if err := check(repo.list(video.Username)); err != nil {
+		return err
+	}
+	repo.save(video)
+	return nil
+}
+
+func (repo *MemoryJobRepository) save(video *DownloadVideo) {
+	job := *video
+	job.ErrorLines = append([]string(nil), video.ErrorLines...)
+	job.MessageIds = nil
+	if old, ok := repo.jobs[video.Id]; ok {
+		// the downloader may not have noticed the cancellation yet
+		if old.Status == JobCancelled {
+			job.Status = JobCancelled
+		}
+		// only recorded by the outbox
+		job.MessageIds = old.MessageIds
+	}
+	repo.jobs[video.Id] = job
+}
+
+func (repo *MemoryJobRepository) GetJob(id string) *DownloadVideo {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	job, ok := repo.jobs[id]
+	if !ok {
+		return nil
+	}
+	job.ErrorLines = append([]string(nil), job.ErrorLines...)
+	job.MessageIds = append([]string(nil), job.MessageIds...)
+	return &job
+}
+
+func (repo *MemoryJobRepository) ListJobs(username string) []*DownloadVideo {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	return repo.list(username)
+}
+
+func (repo *MemoryJobRepository) list(username string) []*DownloadVideo {
+	jobs := []*DownloadVideo{}
+	for _, job := range repo.jobs {
+		job := job // a copy per job, we return its address
+		if username != "" && job.Username != username {
+			continue
+		}
+		job.ErrorLines = append([]string(nil), job.ErrorLines...)
+		job.MessageIds = append([]string(nil), job.MessageIds...)
+		jobs = append(jobs, &job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+	return jobs
+}
+
+// CancelJob marks the job as cancelled and closes its Cancelled channel, to
+// stop the downloader
+func (repo *MemoryJobRepository) CancelJob(id string) bool {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	job, ok := repo.jobs[id]
+	if !ok || job.Finished() {
+		return false
+	}
+	job.Status = JobCancelled
+	job.Error = ErrJobCancelled
+	if job.Cancelled != nil {
+		close(job.Cancelled)
+	}
+	repo.jobs[id] = job
+	return true
+}
+
+func (repo *MemoryJobRepository) AddMessageId(id string, messageId string) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	job, ok := repo.jobs[id]
+	if !ok {
+		return
+	}
+	job.MessageIds = append(append([]string(nil), job.MessageIds...), messageId)
+	repo.jobs[id] = job
+}
+
+func NewJobId() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// job representation in the http api
+type JobInfo struct {
+	Id          string           `json:"id"`
+	Status      JobStatus        `json:"status"`
+	Url         string           `json:"url"`
+	Title       string           `json:"title,omitempty"`
+	Options     *DownloadOptions `json:"options,omitempty"`
+	DownloadUrl string           `json:"downloadUrl,omitempty"`
+	Error       string           `json:"error,omitempty"`
+	ErrorLines  []string         `json:"errorLines,omitempty"`
+	MessageIds  []string         `json:"messageIds,omitempty"` // of the emails about the job
+	Created     time.Time        `json:"created"`
+}
+
+func NewJobInfo(video *DownloadVideo) *JobInfo {
+	info := &JobInfo{}
+	info.Id = video.Id
+	info.Status = video.Status
+	info.Url = video.SrcUrl.String()
+	info.Title = video.Title
+	if !video.Options.IsZero() {
+		options := video.Options
+		info.Options = &options
+	}
+	if video.DstUrl != nil {
+		info.DownloadUrl = video.DstUrl.String()
+	}
+	if video.Error != nil {
+		info.Error = video.Error.Error()
+	}
+	info.ErrorLines = video.ErrorLines
+	info.MessageIds = video.MessageIds
+	info.Created = video.Created
+	return info
+}
+
+func (s *HttpServer) HandleJob(w http.ResponseWriter, r *http.Request) {
+	job := s.GetRequestJob(r)
+	if job == nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewJobInfo(job))
+}
+
+// HandleListJobs lists the jobs of the authenticated user
+func (s *HttpServer) HandleListJobs(w http.ResponseWriter, r *http.Request) {
+	account := context.Get(r, "account").(*ConfigUser)
+	writeJobs(w, s.Jobs.ListJobs(account.Username))
+}
+
+// HandleListAllJobs lists the jobs of every user (admins only)
+func (s *HttpServer) HandleListAllJobs(w http.ResponseWriter, r *http.Request) {
+	writeJobs(w, s.Jobs.ListJobs(""))
+}
+
+func writeJobs(w http.ResponseWriter, jobs []*DownloadVideo) {
+	response := make([]*JobInfo, len(jobs))
+	for i, job := range jobs {
+		response[i] = NewJobInfo(job)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleCancelJob stops a queued or running job, of the user or (for admins)
+// of anyone
+func (s *HttpServer) HandleCancelJob(w http.ResponseWriter, r *http.Request) {
+	job := s.GetRequestJob(r)
+	if job == nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	if !s.Jobs.CancelJob(job.Id) {
+		http.Error(w, fmt.Sprintf("job already %s", job.Status), http.StatusConflict)
+		return
+	}
+	log.Info("job %s cancelled by %s", job.Id, context.Get(r, "sub"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewJobInfo(s.Jobs.GetJob(job.Id)))
+}
+
+func (s *HttpServer) HandleJobLog(w http.ResponseWriter, r *http.Request) {
+	job := s.GetRequestJob(r)
+	if job == nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	if job.LogFile == "" {
+		http.Error(w, "job has no log yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := ReadJobLog(job.LogFile, w); err != nil {
+		log.Error("error reading log of job %s: %s", job.Id, err)
+	}
+}
+
+// GetRequestJob returns the job of the {id} in the url, if the authenticated
+// user is its owner or an admin.
+func (s *HttpServer) GetRequestJob(r *http.Request) *DownloadVideo {
+	job := s.Jobs.GetJob(mux.Vars(r)["id"])
+	if job == nil {
+		return nil
+	}
+	account := context.Get(r, "account").(*ConfigUser)
+	if job.Username != account.Username && !HasRole(r, RoleAdmin) {
+		return nil
+	}
+	return job
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryJobRepositoryListJobs(t *testing.T) {
+	jobs := NewMemoryJobRepository()
+	now := time.Now()
+	jobs.SaveJob(&DownloadVideo{Id: "job1", Username: "oskar", Status: JobDone, Created: now.Add(-time.Minute)})
+	jobs.SaveJob(&DownloadVideo{Id: "job2", Username: "oskar", Status: JobDownloading, Created: now})
+	jobs.SaveJob(&DownloadVideo{Id: "job3", Username: "jriquelme", Status: JobFailed, Created: now})
+
+	list := jobs.ListJobs("oskar")
+	assert.Len(t, list, 2)
+	assert.Equal(t, "job1", list[0].Id)
+	assert.Equal(t, JobDone, list[0].Status)
+	assert.Equal(t, "job2", list[1].Id)
+	assert.Equal(t, JobDownloading, list[1].Status)
+	assert.Len(t, jobs.ListJobs(""), 3)
+}
+
+func TestMemoryJobRepositoryAddJob(t *testing.T) {
+	jobs := NewMemoryJobRepository()
+	limits := RoleConfig{MaxConcurrent: 2}
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			video := &DownloadVideo{Id: fmt.Sprintf("job%d", i), Username: "oskar", Status: JobQueued, Created: time.Now()}
+			errs <- jobs.AddJob(video, func(jobs []*DownloadVideo) error {
+				return checkQuota(jobs, RoleUser, limits)
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	added := 0
+	for err := range errs {
+		if err == nil {
+			added++
+		} else {
+			assert.Equal(t, "2 jobs running, the limit for role user is 2", err.Error())
+		}
+	}
+	assert.Equal(t, 2, added)
+	assert.Len(t, jobs.ListJobs("oskar"), 2)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limits in the config, global or per account. Zero means no limit (or, in
+// an account, use the global one).
+type LimitsConfig struct {
+	MaxDuration int64 "maxDuration" // seconds
+	MaxFileSize int64 "maxFileSize" // bytes
+	AllowLive   *bool "allowLive"   // live and upcoming streams, denied by default
+}
+
+// limits applied to a job
+type Limits struct {
+	MaxDuration time.Duration
+	MaxFileSize int64
+	AllowLive   bool
+}
+
+// LimitError is returned when a video is rejected because of the limits
+type LimitError struct {
+	Reason string
+}
+
+func (e *LimitError) Error() string {
+	return e.Reason
+}
+
+// Merge returns the limits of an account, using the global ones (config)
+// for everything the account doesn't set.
+func (config *LimitsConfig) Merge(account *LimitsConfig) Limits {
+	limits := Limits{}
+	limits.MaxDuration = time.Duration(config.MaxDuration) * time.Second
+	limits.MaxFileSize = config.MaxFileSize
+	if config.AllowLive != nil {
+		limits.AllowLive = *config.AllowLive
+	}
+	if account == nil {
+		return limits
+	}
+	if account.MaxDuration != 0 {
+		limits.MaxDuration = time.Duration(account.MaxDuration) * time.Second
+	}
+	if account.MaxFileSize != 0 {
+		limits.MaxFileSize = account.MaxFileSize
+	}
+	if account.AllowLive != nil {
+		limits.AllowLive = *account.AllowLive
+	}
+	return limits
+}
+
+// Check validates the video metadata against the limits
+func (limits *Limits) Check(video *DownloadVideo) error {
+	if video.IsLive && !limits.AllowLive {
+		return &LimitError{"live and upcoming streams are not allowed"}
+	}
+	if limits.MaxDuration > 0 && video.Duration > limits.MaxDuration {
+		return &LimitError{fmt.Sprintf("video duration %s exceeds the limit of %s", video.Duration, limits.MaxDuration)}
+	}
+	if limits.MaxFileSize > 0 && video.FileSize > limits.MaxFileSize {
+		return &LimitError{fmt.Sprintf("estimated file size of %d bytes exceeds the limit of %d bytes", video.FileSize, limits.MaxFileSize)}
+	}
+	return nil
+}
+
+// Preflight gets the metadata of the video and checks the limits of the job
+// and the extractor allowed by the url policy.
+// If getting the metadata fails or takes longer than PreflightTimeout, the
+// video is accepted and the downloader checks it later.
+func (s *HttpServer) Preflight(video *DownloadVideo) error {
+	timeout := s.Settings().PreflightTimeout
+	// with the options of the job, which choose the format and the file
+	metadata := &DownloadVideo{SrcUrl: video.SrcUrl, Checksum: video.Checksum, Options: video.Options,
+		Cancelled: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Downloader.CompleteMetadata(metadata)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Debug("error getting metadata of %s in preflight: %s", video.SrcUrl, err)
+			return nil
+		}
+	case <-time.After(timeout):
+		// don't leave youtube-dl running
+		close(metadata.Cancelled)
+		log.Debug("metadata of %s not ready after %s, skipping preflight", video.SrcUrl, timeout)
+		return nil
+	}
+	video.Title = metadata.Title
+	video.Thumbnail = metadata.Thumbnail
+	video.File = metadata.File
+	video.Duration = metadata.Duration
+	video.FileSize = metadata.FileSize
+	video.IsLive = metadata.IsLive
+	video.Extractor = metadata.Extractor
+	video.Downloader = metadata.Downloader
+	video.Checksum = metadata.Checksum
+	if err := s.URLPolicy.CheckExtractor(video.SrcUrl, video.Extractor); err != nil {
+		return err
+	}
+	return video.Limits.Check(video)
+}
+
+// SizeWatcher kills a download when the files it writes grow beyond a limit
+type SizeWatcher struct {
+	Dir      string // directory of the download
+	Prefix   string // name of the files, without extension
+	MaxSize  int64
+	Interval time.Duration
+
+	mu       sync.Mutex
+	exceeded int64
+	stop     chan struct{}
+}
+
+func NewSizeWatcher(file string, maxSize int64) *SizeWatcher {
+	watcher := &SizeWatcher{}
+	watcher.Dir = filepath.Dir(file)
+	watcher.Prefix = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	watcher.MaxSize = maxSize
+	watcher.Interval = time.Second
+	watcher.stop = make(chan struct{})
+	return watcher
+}
+
+// Watch checks the size of the download until Stop is called, killing the
+// process of cmd when it exceeds the limit.
+func (watcher *SizeWatcher) Watch(cmd *exec.Cmd) {
+	ticker := time.NewTicker(watcher.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-watcher.stop:
+			return
+		case <-ticker.C:
+			size := watcher.Size()
+			if size > watcher.MaxSize {
+				watcher.mu.Lock()
+				watcher.exceeded = size
+				watcher.mu.Unlock()
+				killProcessGroup(cmd)
+				return
+			}
+		}
+	}
+}
+
+func (watcher *SizeWatcher) Stop() {
+	close(watcher.stop)
+}
+
+// Size returns the bytes written so far (partial files and separate
+// audio/video formats included)
+func (watcher *SizeWatcher) Size() int64 {
+	files, err := ioutil.ReadDir(watcher.Dir)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, file := range files {
+		if file.Mode().IsRegular() && strings.HasPrefix(file.Name(), watcher.Prefix) {
+			size += file.Size()
+		}
+	}
+	return size
+}
+
+// Err returns a LimitError if the download was killed for being too big
+func (watcher *SizeWatcher) Err() error {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	if watcher.exceeded == 0 {
+		return nil
+	}
+	return &LimitError{fmt.Sprintf("download aborted after %d bytes, exceeding the limit of %d bytes", watcher.exceeded, watcher.MaxSize)}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitsMerge(t *testing.T) {
+	allow := true
+	global := &LimitsConfig{MaxDuration: 3600, MaxFileSize: 1000}
+	limits := global.Merge(nil)
+	assert.Equal(t, Limits{time.Hour, 1000, false}, limits)
+
+	limits = global.Merge(&LimitsConfig{MaxDuration: 7200, AllowLive: &allow})
+	assert.Equal(t, Limits{2 * time.Hour, 1000, true}, limits)
+}
+
+func TestLimitsCheck(t *testing.T) {
+	limits := &Limits{time.Hour, 1000, false}
+	assert.Nil(t, limits.Check(&DownloadVideo{Duration: time.Minute, FileSize: 500}))
+
+	err := limits.Check(&DownloadVideo{Duration: 10 * time.Hour})
+	assert.Equal(t, "video duration 10h0m0s exceeds the limit of 1h0m0s", err.Error())
+
+	err = limits.Check(&DownloadVideo{FileSize: 2000})
+	assert.Equal(t, "estimated file size of 2000 bytes exceeds the limit of 1000 bytes", err.Error())
+
+	err = limits.Check(&DownloadVideo{IsLive: true})
+	assert.IsType(t, &LimitError{}, err)
+}
+
+// audioYoutubeDl reports a webm video, only with the format of audio jobs,
+// and converts it to mp3
+const audioYoutubeDl = `#!/bin/sh
+case " $* " in
+*" -j "*)
+	case " $* " in
+	*" bestaudio/best "*) ;;
+	*) echo "not the audio format" >&2; exit 1 ;;
+	esac
+	echo '{"title": "Schnee", "_filename": "Schnee-bS5P_LAqiVg.webm", "extractor_key": "Youtube", "duration": 90, "filesize": 1000}'
+	;;
+*" --audio-format mp3 "*)
+	echo mp3 > Schnee-bS5P_LAqiVg.mp3
+	;;
+*)
+	echo webm > Schnee-bS5P_LAqiVg.webm
+	;;
+esac
+`
+
+// fakeYoutubeDl puts a youtube-dl running script in the PATH
+func fakeYoutubeDl(t *testing.T, script string) func() {
+	bin, err := ioutil.TempDir("", "yutubaas-bin")
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(bin, "youtube-dl"), []byte(script), 0755))
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	return func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(bin)
+	}
+}
+
+// uploadedFiles records the files uploaded, failing if they don't exist
+type uploadedFiles []string
+
+func (files *uploadedFiles) SaveVideo(video *DownloadVideo) error {
+	if _, err := os.Stat(filepath.Join(video.Dir, video.File)); err != nil {
+		return err
+	}
+	*files = append(*files, video.File)
+	return nil
+}
+
+func TestPreflightAudioJob(t *testing.T) {
+	defer fakeYoutubeDl(t, audioYoutubeDl)()
+	sandbox, err := NewSandbox(&SandboxConfig{})
+	assert.Nil(t, err)
+	files := &uploadedFiles{}
+	jobs := NewMemoryJobRepository()
+	policy := NewURLPolicy(&URLPolicyConfig{})
+	downloader := NewDefaultDownloader(files, &RecordingMailer{}, jobs, &JobLogConfig{}, policy, sandbox)
+	server := &HttpServer{Downloader: downloader, Jobs: jobs, URLPolicy: policy}
+	server.settings.PreflightTimeout = 5 * time.Second
+
+	video := &DownloadVideo{Id: "audio1", Username: "alma", Status: JobQueued, Cancelled: make(chan struct{})}
+	video.SrcUrl, _ = url.Parse("https://www.youtube.com/watch?v=bS5P_LAqiVg")
+	video.Options.Audio = true
+	video.Limits = Limits{MaxDuration: time.Hour, MaxFileSize: 2000}
+	assert.Nil(t, server.Preflight(video))
+	assert.Equal(t, "Schnee", video.Title)
+	assert.Equal(t, "Schnee-bS5P_LAqiVg.mp3", video.File)
+	assert.Equal(t, 90*time.Second, video.Duration)
+
+	downloader.DownloadVideo(video)
+	assert.Nil(t, video.Error)
+	assert.Equal(t, JobDone, video.Status)
+	assert.Equal(t, uploadedFiles{"Schnee-bS5P_LAqiVg.mp3"}, *files)
+}
+
+func TestPreflightTimeout(t *testing.T) {
+	pidFile, err := ioutil.TempFile("", "yutubaas-pid")
+	assert.Nil(t, err)
+	pidFile.Close()
+	defer os.Remove(pidFile.Name())
+	defer fakeYoutubeDl(t, "#!/bin/sh\necho $$ > "+pidFile.Name()+"\nexec sleep 30\n")()
+	sandbox, err := NewSandbox(&SandboxConfig{})
+	assert.Nil(t, err)
+	policy := NewURLPolicy(&URLPolicyConfig{})
+	downloader := NewDefaultDownloader(&uploadedFiles{}, &RecordingMailer{}, NewMemoryJobRepository(), &JobLogConfig{}, policy, sandbox)
+	server := &HttpServer{Downloader: downloader, URLPolicy: policy}
+	server.settings.PreflightTimeout = 500 * time.Millisecond
+
+	video := &DownloadVideo{Id: "slow1", Username: "alma"}
+	video.SrcUrl, _ = url.Parse("https://www.youtube.com/watch?v=bS5P_LAqiVg")
+	assert.Nil(t, server.Preflight(video))
+	assert.Empty(t, video.File)
+
+	// youtube-dl is killed, not left running
+	b, err := ioutil.ReadFile(pidFile.Name())
+	assert.Nil(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	assert.Nil(t, err)
+	for i := 0; i < 50 && syscall.Kill(pid, 0) == nil; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.NotNil(t, syscall.Kill(pid, 0), "youtube-dl still running")
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limits of failed logins, zero means the default
+type LoginConfig struct {
+	MaxFailures   int  "maxFailures"   // failed logins of an user before locking it, 5 by default
+	LockoutTime   int  "lockoutTime"   // seconds an user or ip stays locked, 15 minutes by default
+	MaxIPFailures int  "maxIPFailures" // failed logins from an ip (any user) before blocking it, 20 by default
+	FailureWindow int  "failureWindow" // seconds a failure counts, 15 minutes by default
+	Delay         int  "delay"         // milliseconds to wait after the first failure of an user, doubled with every failure
+	TrustProxy    bool "trustProxy"    // take the client ip from X-Forwarded-For
+}
+
+// the longest progressive delay between two logins of an user
+const maxLoginDelay = 30 * time.Second
+
+// LoginGuard counts the failed logins by username and by ip. After a failure
+// the next login of the user has to wait a delay (doubled with every
+// failure), and too many failures lock the user or ip for a while.
+// Check reserves the attempt until Fail, Success or Release, so concurrent
+// logins can't get past the limits: an user has one login at a time, and
+// the logins in progress from an ip count as failures.
+type LoginGuard struct {
+	Now        func() time.Time
+	MaxEntries int // usernames (and ips) tracked, the oldest are dropped past it
+
+	mu        sync.Mutex
+	config    LoginConfig
+	users     map[string]*loginFailures
+	ips       map[string]*loginFailures
+	lastPrune time.Time
+}
+
+type loginFailures struct {
+	Count   int
+	Last    time.Time
+	Locked  time.Time // locked until
+	Pending int       // logins checked and not finished
+}
+
+func NewLoginGuard(config *LoginConfig) *LoginGuard {
+	guard := &LoginGuard{Now: time.Now, MaxEntries: 10000}
+	guard.users = make(map[string]*loginFailures)
+	guard.ips = make(map[string]*loginFailures)
+	guard.Update(config)
+	return guard
+}
+
+// Update applies config (on reload), keeping the failures counted so far
+func (guard *LoginGuard) Update(config *LoginConfig) {
+	c := *config
+	if c.MaxFailures == 0 {
+		c.MaxFailures = 5
+	}
+	if c.LockoutTime == 0 {
+		c.LockoutTime = 15 * 60
+	}
+	if c.MaxIPFailures == 0 {
+		c.MaxIPFailures = 20
+	}
+	if c.FailureWindow == 0 {
+		c.FailureWindow = 15 * 60
+	}
+	if c.Delay == 0 {
+		c.Delay = 250
+	}
+	guard.mu.Lock()
+	guard.config = c
+	guard.mu.Unlock()
+}
+
+// Check returns how long a login of username from ip has to wait, zero if
+// it can go on. Then the login is reserved, and must end with Fail, Success
+// or Release.
+func (guard *LoginGuard) Check(username string, ip string) time.Duration {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	now := guard.Now()
+	var wait time.Duration
+	if failures := guard.current(guard.ips, ip, now); failures != nil {
+		if now.Before(failures.Locked) {
+			wait = failures.Locked.Sub(now)
+		} else if failures.Count+failures.Pending >= guard.config.MaxIPFailures {
+			// until the logins in progress finish
+			wait = guard.delay(1)
+		}
+	}
+	if failures := guard.current(guard.users, username, now); failures != nil {
+		until := failures.Last.Add(guard.delay(failures.Count))
+		if failures.Locked.After(until) {
+			until = failures.Locked
+		}
+		if failures.Pending > 0 && until.Before(now.Add(guard.delay(failures.Count+1))) {
+			// another login of the user in progress
+			until = now.Add(guard.delay(failures.Count + 1))
+		}
+		if until.Sub(now) > wait {
+			wait = until.Sub(now)
+		}
+	}
+	if wait == 0 {
+		guard.reserve(guard.users, username, now).Pending++
+		guard.reserve(guard.ips, ip, now).Pending++
+	}
+	return wait
+}
+
+// Fail records a failed login, locking the user or ip when they reach the
+// limit
+func (guard *LoginGuard) Fail(username string, ip string) {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	guard.release(username, ip)
+	now := guard.Now()
+	guard.prune(now)
+	lockout := time.Duration(guard.config.LockoutTime) * time.Second
+	failures := guard.add(guard.users, username, now)
+	if failures.Count >= guard.config.MaxFailures {
+		failures.Locked = now.Add(lockout)
+		audit.Warning("user %s locked until %s after %d failed logins (last from %s)",
+			username, failures.Locked.Format(time.RFC3339), failures.Count, ip)
+	}
+	failures = guard.add(guard.ips, ip, now)
+	if failures.Count >= guard.config.MaxIPFailures {
+		failures.Locked = now.Add(lockout)
+		audit.Warning("ip %s blocked until %s after %d failed logins (last for %s)",
+			ip, failures.Locked.Format(time.RFC3339), failures.Count, username)
+	}
+}
+
+// Success forgets the failures of username (not of the ip, so an attacker
+// can't reset them with its own account)
+func (guard *LoginGuard) Success(username string, ip string) {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	guard.release(username, ip)
+	delete(guard.users, username)
+}
+
+// Release ends a login that neither failed nor succeeded (an error checking
+// it)
+func (guard *LoginGuard) Release(username string, ip string) {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	guard.release(username, ip)
+}
+
+func (guard *LoginGuard) release(username string, ip string) {
+	if f, ok := guard.users[username]; ok && f.Pending > 0 {
+		f.Pending--
+	}
+	if f, ok := guard.ips[ip]; ok && f.Pending > 0 {
+		f.Pending--
+	}
+}
+
+// current returns the failures of key, nil if they expired
+func (guard *LoginGuard) current(failures map[string]*loginFailures, key string, now time.Time) *loginFailures {
+	f, ok := failures[key]
+	if !ok || guard.expired(f, now) {
+		return nil
+	}
+	return f
+}
+
+// reserve returns the failures of key, new ones if they expired
+func (guard *LoginGuard) reserve(failures map[string]*loginFailures, key string, now time.Time) *loginFailures {
+	f := guard.current(failures, key, now)
+	if f == nil {
+		if _, ok := failures[key]; !ok && len(failures) >= guard.MaxEntries {
+			guard.evict(failures, now)
+		}
+		f = &loginFailures{}
+		failures[key] = f
+	}
+	return f
+}
+
+func (guard *LoginGuard) add(failures map[string]*loginFailures, key string, now time.Time) *loginFailures {
+	f := guard.reserve(failures, key, now)
+	f.Count++
+	f.Last = now
+	return f
+}
+
+func (guard *LoginGuard) expired(f *loginFailures, now time.Time) bool {
+	window := time.Duration(guard.config.FailureWindow) * time.Second
+	return now.Sub(f.Last) > window && now.After(f.Locked) && f.Pending == 0
+}
+
+// evict makes room in failures, full of usernames sprayed from many ips: it
+// forgets the expired ones or, if there aren't, the oldest failure not in
+// progress, keeping the locked ones while there are others
+func (guard *LoginGuard) evict(failures map[string]*loginFailures, now time.Time) {
+	var oldest *loginFailures
+	var oldestKey string
+	pruned := false
+	for key, f := range failures {
+		if guard.expired(f, now) {
+			delete(failures, key)
+			pruned = true
+		} else if f.Pending == 0 && (oldest == nil || guard.evictBefore(f, oldest, now)) {
+			oldest, oldestKey = f, key
+		}
+	}
+	if !pruned && oldest != nil {
+		delete(failures, oldestKey)
+	}
+}
+
+func (guard *LoginGuard) evictBefore(f *loginFailures, other *loginFailures, now time.Time) bool {
+	locked, otherLocked := now.Before(f.Locked), now.Before(other.Locked)
+	if locked != otherLocked {
+		return otherLocked
+	}
+	return f.Last.Before(other.Last)
+}
+
+// prune forgets the expired failures, at most once per window
+func (guard *LoginGuard) prune(now time.Time) {
+	if now.Sub(guard.lastPrune) < time.Duration(guard.config.FailureWindow)*time.Second {
+		return
+	}
+	guard.lastPrune = now
+	for _, failures := range []map[string]*loginFailures{guard.users, guard.ips} {
+		for key, f := range failures {
+			if guard.expired(f, now) {
+				delete(failures, key)
+			}
+		}
+	}
+}
+
+func (guard *LoginGuard) delay(count int) time.Duration {
+	if count == 0 {
+		return 0
+	}
+	delay := time.Duration(guard.config.Delay) * time.Millisecond
+	for i := 1; i < count && delay < maxLoginDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxLoginDelay {
+		delay = maxLoginDelay
+	}
+	return delay
+}
+
+// ClientIP returns the ip of the client of r, from X-Forwarded-For (the
+// address added by our proxy) if the proxy is trusted
+func (guard *LoginGuard) ClientIP(r *http.Request) string {
+	guard.mu.Lock()
+	trustProxy := guard.config.TrustProxy
+	guard.mu.Unlock()
+	if forwarded := r.Header.Get("X-Forwarded-For"); trustProxy && forwarded != "" {
+		addrs := strings.Split(forwarded, ",")
+		return strings.TrimSpace(addrs[len(addrs)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginGuard(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	guard := NewLoginGuard(&LoginConfig{MaxFailures: 3, LockoutTime: 600, MaxIPFailures: 5, FailureWindow: 300, Delay: 1000})
+	guard.Now = func() time.Time { return now }
+
+	assert.Equal(t, time.Duration(0), guard.Check("oskar", "192.0.2.1"))
+	// progressive delays
+	guard.Fail("oskar", "192.0.2.1")
+	assert.Equal(t, time.Second, guard.Check("oskar", "192.0.2.1"))
+	now = now.Add(time.Second)
+	assert.Equal(t, time.Duration(0), guard.Check("oskar", "192.0.2.1"))
+	guard.Fail("oskar", "192.0.2.1")
+	assert.Equal(t, 2*time.Second, guard.Check("oskar", "192.0.2.1"))
+	assert.Equal(t, 2*time.Second, guard.Check("oskar", "198.51.100.1"))
+	assert.Equal(t, time.Duration(0), guard.Check("jriquelme", "192.0.2.1"))
+	guard.Release("jriquelme", "192.0.2.1")
+
+	// lockout
+	now = now.Add(2 * time.Second)
+	guard.Fail("oskar", "192.0.2.1")
+	assert.Equal(t, 10*time.Minute, guard.Check("oskar", "192.0.2.1"))
+	now = now.Add(10 * time.Minute)
+	assert.Equal(t, time.Duration(0), guard.Check("oskar", "192.0.2.1"))
+
+	// the failures expire, and a login resets them
+	now = now.Add(5*time.Minute + time.Second)
+	guard.Fail("oskar", "192.0.2.1")
+	assert.Equal(t, time.Second, guard.Check("oskar", "192.0.2.1"))
+	guard.Success("oskar", "192.0.2.1")
+	assert.Equal(t, time.Duration(0), guard.Check("oskar", "192.0.2.1"))
+	guard.Release("oskar", "192.0.2.1")
+
+	// ip blocked after failures of several users
+	for _, username := range []string{"a", "b", "c", "d", "e"} {
+		guard.Fail(username, "203.0.113.1")
+	}
+	assert.Equal(t, 10*time.Minute, guard.Check("jriquelme", "203.0.113.1"))
+	assert.Equal(t, time.Duration(0), guard.Check("jriquelme", "192.0.2.1"))
+}
+
+func TestLoginGuardMaxEntries(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	guard := NewLoginGuard(&LoginConfig{MaxFailures: 2, LockoutTime: 600, MaxIPFailures: 100, FailureWindow: 300})
+	guard.Now = func() time.Time { return now }
+	guard.MaxEntries = 3
+	guard.Fail("oskar", "192.0.2.1")
+	guard.Fail("oskar", "192.0.2.1")
+
+	// a spray of usernames from many ips
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		ip := fmt.Sprintf("198.51.100.%d", i)
+		if guard.Check(fmt.Sprintf("user%d", i), ip) == 0 {
+			guard.Fail(fmt.Sprintf("user%d", i), ip)
+		}
+		assert.True(t, len(guard.users) <= 3)
+		assert.True(t, len(guard.ips) <= 3)
+	}
+	assert.Contains(t, guard.users, "user9")
+	// the locked users stay
+	assert.Equal(t, 10*time.Minute-10*time.Second, guard.Check("oskar", "192.0.2.1"))
+	// the expired ones go first
+	now = now.Add(11 * time.Minute)
+	guard.Fail("alma", "192.0.2.1")
+	assert.Len(t, guard.users, 1)
+}
+
+func TestLoginGuardConcurrent(t *testing.T) {
+	guard := NewLoginGuard(&LoginConfig{MaxFailures: 3, MaxIPFailures: 5})
+	// logins checked at the same time, failing after all the checks
+	check := func(username func(i int) string, ip string) int {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var passed []string
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(username string) {
+				defer wg.Done()
+				if guard.Check(username, ip) == 0 {
+					mu.Lock()
+					passed = append(passed, username)
+					mu.Unlock()
+				}
+			}(username(i))
+		}
+		wg.Wait()
+		for _, username := range passed {
+			guard.Fail(username, ip)
+		}
+		return len(passed)
+	}
+
+	// one login of an user at a time
+	assert.Equal(t, 1, check(func(int) string { return "oskar" }, "192.0.2.1"))
+	guard.Success("oskar", "192.0.2.1")
+	// and the ip blocked after as many logins as failures allowed
+	assert.Equal(t, 4, check(func(i int) string { return fmt.Sprint("user", i) }, "192.0.2.1"))
+	assert.True(t, guard.Check("jriquelme", "192.0.2.1") > 5*time.Minute)
+
+	// released logins don't count
+	assert.Equal(t, time.Duration(0), guard.Check("oskar", "198.51.100.1"))
+	guard.Release("oskar", "198.51.100.1")
+	assert.Equal(t, time.Duration(0), guard.Check("oskar", "198.51.100.1"))
+}
+
+func TestLoginGuardClientIP(t *testing.T) {
+	r, _ := http.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "192.0.2.1:5000"
+	r.Header.Set("X-Forwarded-For", "10.0.0.1, 198.51.100.7")
+	assert.Equal(t, "192.0.2.1", NewLoginGuard(&LoginConfig{}).ClientIP(r))
+	assert.Equal(t, "198.51.100.7", NewLoginGuard(&LoginConfig{TrustProxy: true}).ClientIP(r))
+}
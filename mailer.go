@@ -1,67 +1,137 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
-	"html/template"
+	"strings"
 
 	"github.com/mailgun/mailgun-go"
 )
 
 type Mailer interface {
 	Notify(video *DownloadVideo)
+	Reply(reply *MailReply)
+	ConfirmEmail(confirmation *EmailConfirmation)
+	Digest(digest *NotificationDigest) // several finished jobs of an user in one email
 }
 
+// MailReply answers an email request, with the jobs it created or the
+// reason it couldn't be processed
+type MailReply struct {
+	Name      string
+	Email     string
+	Subject   string // of the request
+	MessageId string // of the request, empty if unknown
+	Error     *RequestError
+	Jobs      []*DownloadVideo // queued or rejected
+	Options   DownloadOptions  // of the jobs
+	Language  string           // of the user
+}
+
+// ReplySubject is the subject of the reply, Re: the request
+func (reply *MailReply) ReplySubject() string {
+	if strings.HasPrefix(strings.ToLower(reply.Subject), "re:") {
+		return reply.Subject
+	}
+	return "Re: " + reply.Subject
+}
+
+// MailgunMailer renders the emails and puts them in the outbox, which sends
+// them with Send
 type MailgunMailer struct {
-	Mailgun         mailgun.Mailgun
-	From            string
-	SuccessTemplate *template.Template
-	ErrorTemplate   *template.Template
+	Mailgun   mailgun.Mailgun
+	From      string
+	Templates *MailTemplates
+	Outbox    *Outbox
+	Accounts  UserRepository // to skip the addresses that bounced
 }
 
-func NewMailgunMailer(from string, key string, domain string) (*MailgunMailer, error) {
+func NewMailgunMailer(from string, key string, domain string, templates *MailTemplates, outbox *Outbox, accounts UserRepository) *MailgunMailer {
 	mg := &MailgunMailer{}
 	mg.From = from
 	mg.Mailgun = mailgun.NewMailgun(domain, key, "")
-	var err error
-	mg.SuccessTemplate, err = template.New("success").Parse(`
-Hola {{.Name}}:
-
-Tu video "{{.Title}}"" está listo, puedes descargarlo desde {{.DstUrl}}.
+	mg.Templates = templates
+	mg.Outbox = outbox
+	mg.Accounts = accounts
+	outbox.Sender = mg.Send
+	return mg
+}
 
-saludos`)
+// enqueue renders the template name into a notification to an user
+func (mailer *MailgunMailer) enqueue(name string, language string, data interface{}, n *Notification) {
+	if mailer.bounced(n.To) {
+		log.Warning("not sending %s email to %s, it bounced", name, n.To)
+		return
+	}
+	content, err := mailer.Templates.Render(name, language, data)
 	if err != nil {
-		return nil, err
+		log.Error("error rendering %s email to %s: %s", name, n.To, err)
+		return
+	}
+	n.Template = name
+	n.Subject, n.Text, n.Html = content.Subject, content.Text, content.Html
+	if err := mailer.Outbox.Enqueue(n); err != nil {
+		log.Error("error queueing %s email to %s: %s", name, n.To, err)
 	}
-	mg.ErrorTemplate, err = template.New("error").Parse(`
-Hola {{.Name}}:
+}
 
-Hubo un error al descargar el video "{{.SrcUrl}}": {{.Error}}
+// Send delivers a notification, returning its Mailgun id. Notifications to
+// addresses that bounced after being queued fail with ErrBounced.
+func (mailer *MailgunMailer) Send(n *Notification) (string, error) {
+	if mailer.bounced(n.To) {
+		return "", ErrBounced
+	}
+	msg := mailer.Mailgun.NewMessage(mailer.From, n.Subject, n.Text, n.To)
+	if n.Html != "" {
+		msg.SetHtml(n.Html)
+	}
+	for name, value := range n.Headers {
+		msg.AddHeader(name, value)
+	}
+	mes, id, err := mailer.Mailgun.Send(msg)
+	if err != nil {
+		return "", err
+	}
+	log.Debug("message sent to mailgun: id=%s status=%s", id, mes)
+	return id, nil
+}
 
-saludos`)
+// bounced tells if email is an account address that bounced or complained
+func (mailer *MailgunMailer) bounced(email string) bool {
+	account, err := mailer.Accounts.GetUserByEmail(email)
 	if err != nil {
-		return nil, err
+		log.Error("error looking for account of %s: %s", email, err)
+		return false
 	}
-	return mg, nil
+	return account != nil && account.IsBounced(email)
 }
 
 func (mailer *MailgunMailer) Notify(video *DownloadVideo) {
-	var subject string
-	txt := bytes.NewBufferString("")
-
-	if video.Error != nil {
-		subject = fmt.Sprintf("%s, hubo un error en la descarga de %s :(", video.SrcUrl, video.Title)
-		mailer.ErrorTemplate.Execute(txt, video)
-	} else {
-		subject = fmt.Sprintf("%s, tu video %s está listo", video.Name, video.Title)
-		mailer.SuccessTemplate.Execute(txt, video)
+	name := TemplateSuccess
+	if video.Status == JobCancelled {
+		name = TemplateCancelled
+	} else if video.Error != nil {
+		name = TemplateError
 	}
+	mailer.enqueue(name, video.Language, video, &Notification{JobIds: []string{video.Id}, To: video.Email})
+}
 
-	msg := mailer.Mailgun.NewMessage(mailer.From, subject, txt.String(), video.Email)
+func (mailer *MailgunMailer) Digest(digest *NotificationDigest) {
+	ids := make([]string, len(digest.Jobs))
+	for i, job := range digest.Jobs {
+		ids[i] = job.Id
+	}
+	mailer.enqueue(TemplateDigest, digest.Language, digest, &Notification{JobIds: ids, To: digest.Email})
+}
 
-	if mes, id, err := mailer.Mailgun.Send(msg); err != nil {
-		log.Error("error sending email to mailgun: %s", err)
-	} else {
-		log.Debug("message sent to mailgun: id=%s status=%s", id, mes)
+func (mailer *MailgunMailer) Reply(reply *MailReply) {
+	// so auto responders don't answer back (RFC 3834)
+	headers := map[string]string{"Auto-Submitted": "auto-replied"}
+	if reply.MessageId != "" {
+		headers["In-Reply-To"] = reply.MessageId
+		headers["References"] = reply.MessageId
 	}
+	mailer.enqueue(TemplateSummary, reply.Language, reply, &Notification{To: reply.Email, Headers: headers})
+}
+
+func (mailer *MailgunMailer) ConfirmEmail(confirmation *EmailConfirmation) {
+	mailer.enqueue(TemplateConfirm, confirmation.Language, confirmation, &Notification{To: confirmation.Email})
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMailgunSignature = errors.New("invalid Mailgun signature")
+	ErrMailgunReplay    = errors.New("Mailgun token already used")
+)
+
+// MailgunVerifier checks that the messages posted to /download/mailgun (and
+// the events to /mailgun/events) come from Mailgun: signed with our signing
+// key, recent and not seen before
+type MailgunVerifier struct {
+	SigningKey  []byte
+	MaxAge      time.Duration // of the timestamp, and how long tokens are remembered
+	RequireSPF  bool
+	RequireDKIM bool
+	Now         func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]time.Time // tokens, until they expire
+}
+
+func NewMailgunVerifier(config *MailgunConfig) *MailgunVerifier {
+	verifier := &MailgunVerifier{Now: time.Now, seen: make(map[string]time.Time)}
+	verifier.SigningKey = []byte(config.SigningKey)
+	if config.SigningKey == "" {
+		verifier.SigningKey = []byte(config.Key)
+	}
+	verifier.MaxAge = 5 * time.Minute
+	if config.MaxAge != 0 {
+		verifier.MaxAge = time.Duration(config.MaxAge) * time.Second
+	}
+	verifier.RequireSPF = config.RequireSPF
+	verifier.RequireDKIM = config.RequireDKIM
+	return verifier
+}
+
+// Verify checks the signature of msg and its age, then the SPF and DKIM
+// results if required. The results are only taken from the fields posted by
+// Mailgun (missing ones fail), the headers of the message come from the
+// sender.
+func (verifier *MailgunVerifier) Verify(msg *MailgunMessage) error {
+	if err := verifier.VerifySignature(msg.Timestamp, msg.Token, msg.Signature); err != nil {
+		return err
+	}
+	if verifier.RequireSPF && !strings.EqualFold(msg.Spf, "Pass") {
+		return fmt.Errorf("SPF check of %s didn't pass", msg.Sender)
+	}
+	if verifier.RequireDKIM && !strings.EqualFold(msg.DkimCheckResult, "Pass") {
+		return fmt.Errorf("DKIM check of %s didn't pass", msg.Sender)
+	}
+	return nil
+}
+
+// VerifySignature checks the signature of a request from Mailgun (the
+// HMAC-SHA256 of timestamp and token), its age and that its token is new
+func (verifier *MailgunVerifier) VerifySignature(timestamp string, token string, signature string) error {
+	if len(verifier.SigningKey) == 0 {
+		return errors.New("no Mailgun signing key")
+	}
+	mac := hmac.New(sha256.New, verifier.SigningKey)
+	mac.Write([]byte(timestamp + token))
+	decoded, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(decoded, mac.Sum(nil)) {
+		return ErrMailgunSignature
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrMailgunSignature
+	}
+	now := verifier.Now()
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > verifier.MaxAge || age < -verifier.MaxAge {
+		return fmt.Errorf("stale Mailgun timestamp (%s old)", age)
+	}
+	return verifier.remember(token, now)
+}
+
+// remember records token, failing if it was seen before. Tokens are kept
+// until a message with them would be stale anyway.
+func (verifier *MailgunVerifier) remember(token string, now time.Time) error {
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+	for t, expires := range verifier.seen {
+		if now.After(expires) {
+			delete(verifier.seen, t)
+		}
+	}
+	if _, ok := verifier.seen[token]; ok {
+		return ErrMailgunReplay
+	}
+	verifier.seen[token] = now.Add(2 * verifier.MaxAge)
+	return nil
+}
+
+// Header returns a header of the original message, from the message-headers
+// list
+func (msg *MailgunMessage) Header(name string) string {
+	var headers [][]string
+	if err := json.Unmarshal([]byte(msg.MessageHeaders), &headers); err != nil {
+		return ""
+	}
+	for _, header := range headers {
+		if len(header) == 2 && strings.EqualFold(header[0], name) {
+			return header[1]
+		}
+	}
+	return ""
+}
+
+func (msg *MailgunMessage) InboundMail() InboundMail {
+	return InboundMail{msg.Sender, msg.Subject, msg.StrippedText, msg.Header("Message-Id"), msg.IsAutoGenerated()}
+}
+
+func (msg *MailgunMessage) IsAutoGenerated() bool {
+	return isAutoGenerated(msg.Header("Auto-Submitted"), msg.Header("Precedence"))
+}
+
+// MailReplyLimiter limits the replies sent to each address, so a
+// misbehaving sender can't make us send mail in a loop
+type MailReplyLimiter struct {
+	Max    int
+	Window time.Duration
+	Now    func() time.Time
+
+	mu   sync.Mutex
+	sent map[string][]time.Time // by address, in the window
+}
+
+func NewMailReplyLimiter(config *MailgunConfig) *MailReplyLimiter {
+	limiter := &MailReplyLimiter{Max: 10, Window: time.Hour, Now: time.Now, sent: make(map[string][]time.Time)}
+	if config.MaxReplies != 0 {
+		limiter.Max = config.MaxReplies
+	}
+	return limiter
+}
+
+// Allow records a reply to email, if it's below the limit
+func (limiter *MailReplyLimiter) Allow(email string) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	now := limiter.Now()
+	for address, sent := range limiter.sent {
+		for len(sent) > 0 && now.Sub(sent[0]) > limiter.Window {
+			sent = sent[1:]
+		}
+		if len(sent) == 0 {
+			delete(limiter.sent, address)
+		} else {
+			limiter.sent[address] = sent
+		}
+	}
+	email = strings.ToLower(email)
+	if len(limiter.sent[email]) >= limiter.Max {
+		return false
+	}
+	limiter.sent[email] = append(limiter.sent[email], now)
+	return true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func SignMailgunMessage(key string, msg *MailgunMessage) {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(msg.Timestamp + msg.Token))
+	msg.Signature = hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestMailgunVerifier(t *testing.T) {
+	now := time.Unix(1450000000, 0)
+	verifier := NewMailgunVerifier(&MailgunConfig{Key: "key-api", SigningKey: "signing-key", MaxAge: 60})
+	verifier.Now = func() time.Time { return now }
+	message := func(timestamp time.Time, token string) *MailgunMessage {
+		msg := &MailgunMessage{Sender: "jorge@larix.cl", Timestamp: fmt.Sprint(timestamp.Unix()), Token: token}
+		SignMailgunMessage("signing-key", msg)
+		return msg
+	}
+
+	assert.Nil(t, verifier.Verify(message(now, "token1")))
+	// replay
+	assert.Equal(t, ErrMailgunReplay, verifier.Verify(message(now, "token1")))
+	// stale
+	assert.Equal(t, "stale Mailgun timestamp (2m0s old)", verifier.Verify(message(now.Add(-2*time.Minute), "token2")).Error())
+	// forged
+	msg := message(now, "token3")
+	msg.Token = "token4"
+	assert.Equal(t, ErrMailgunSignature, verifier.Verify(msg))
+	msg = &MailgunMessage{Timestamp: fmt.Sprint(now.Unix()), Token: "token5"}
+	SignMailgunMessage("key-api", msg)
+	assert.Equal(t, ErrMailgunSignature, verifier.Verify(msg))
+	// tokens are forgotten when they expire
+	now = now.Add(3 * time.Minute)
+	assert.Nil(t, verifier.Verify(message(now, "token1")))
+}
+
+func TestMailgunVerifierSPF(t *testing.T) {
+	verifier := NewMailgunVerifier(&MailgunConfig{Key: "key-api", RequireSPF: true, RequireDKIM: true})
+	msg := &MailgunMessage{Sender: "jorge@larix.cl", Timestamp: fmt.Sprint(time.Now().Unix()), Token: "token1"}
+	// the headers of the message don't count, the sender wrote them
+	msg.MessageHeaders = `[["X-Mailgun-Spf", "Pass"], ["X-Mailgun-Dkim-Check-Result", "Pass"]]`
+	SignMailgunMessage("key-api", msg)
+	assert.Equal(t, "SPF check of jorge@larix.cl didn't pass", verifier.Verify(msg).Error())
+
+	msg.Token = "token2"
+	msg.Spf = "Pass"
+	msg.DkimCheckResult = "Fail"
+	SignMailgunMessage("key-api", msg)
+	assert.Equal(t, "DKIM check of jorge@larix.cl didn't pass", verifier.Verify(msg).Error())
+
+	msg.Token = "token3"
+	msg.DkimCheckResult = "Pass"
+	SignMailgunMessage("key-api", msg)
+	assert.Nil(t, verifier.Verify(msg))
+}
@@ -1,22 +1,32 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/op/go-logging"
-	"gopkg.in/alecthomas/kingpin.v1"
+	"golang.org/x/crypto/ssh/terminal"
+	"gopkg.in/alecthomas/kingpin.v2"
 	"gopkg.in/yaml.v2"
 )
 
 // comand line flags
 var (
 	log        = logging.MustGetLogger("yutubaas")
+	audit      = logging.MustGetLogger("audit") // security events
 	verbose    = kingpin.Flag("verbose", "verbose output").Default("false").Bool()
-	configfile = kingpin.Flag("config", "config file").Required().String()
+	configfile = kingpin.Flag("config", "config file").String()
 	httpPort   = kingpin.Flag("port", "http port").Default("8080").Int()
+
+	serveCmd         = kingpin.Command("serve", "start the http server (default)").Default()
+	hashPasswordCmd  = kingpin.Command("hash-password", "hash a password for the accounts in the config file")
+	hashAlgorithm    = hashPasswordCmd.Flag("algorithm", "bcrypt or argon2id").Default("bcrypt").Enum("bcrypt", "argon2id")
+	hashPasswordText = hashPasswordCmd.Arg("password", "password to hash (read from stdin if missing)").String()
+	checkConfigCmd   = kingpin.Command("check-config", "check the config file (with the environment overrides) and list its problems")
 )
 
 const (
@@ -33,19 +43,37 @@ func init() {
 
 func main() {
 	kingpin.Version(version)
-	kingpin.Parse()
+	switch kingpin.Parse() {
+	case hashPasswordCmd.FullCommand():
+		hashPassword()
+	case checkConfigCmd.FullCommand():
+		checkConfig()
+	case serveCmd.FullCommand():
+		serve()
+	}
+}
+
+func serve() {
+	if *configfile == "" {
+		kingpin.Fatalf("required flag --config not provided")
+	}
 
 	// load config
 	config, cfgErr := LoadConfig(*configfile)
 	if cfgErr != nil {
 		log.Fatalf("error loading config from %s: %s", *configfile, cfgErr)
 	}
+	if err := config.Validate(); err != nil {
+		log.Fatalf("invalid config %s, %s", *configfile, err)
+	}
 
 	// bring up http server
 	server, err := NewHttpServer(config)
 	if err != nil {
 		log.Fatalf("Error creating http server: %s", err)
 	}
+	server.ConfigFile = *configfile
+	go server.Outbox.Run(nil)
 	addr := fmt.Sprintf(":%d", *httpPort)
 	log.Debug("http server listening to %s", addr)
 	http.Handle("/", server.CreateRouter())
@@ -56,29 +84,118 @@ func main() {
 
 // configuration
 type Config struct {
-	HS256key      string                "hs256key"
+	HS256key      string                "hs256key" // optional with signing keys
 	Accounts      map[string]ConfigUser "accounts"
 	MailgunConfig MailgunConfig         "mailgun"
 	S3Config      S3Config              "s3"
+	JobsConfig    JobsConfig            "jobs"
+	Limits        LimitsConfig          "limits"
+	URLPolicy     URLPolicyConfig       "urls"
+	Sandbox       SandboxConfig         "sandbox"
+	Direct        DirectConfig          "direct"
+	Database      DatabaseConfig        "database"
+	Roles         map[string]RoleConfig "roles"
+	Tokens        TokensConfig          "tokens"
+	Signing       SigningConfig         "signing"
+	OIDC          OIDCConfig            "oidc"
+	Login         LoginConfig           "login"
+	Inbound       InboundConfig         "inbound"
+	Outbox        OutboxConfig          "outbox"
+	Notifications NotificationsConfig   "notifications"
+	Chat          ChatConfig            "chat"
 }
 
 type ConfigUser struct {
-	Name     string "name"
-	Password string "password"
-	Email    string "email"
-	Username string "username,omitempty" // always empty in config (field to store the username, key of the map entry)
+	Name     string        "name"
+	Password string        "password"
+	Email    string        "email"
+	Aliases  []string      "aliases,omitempty"  // other verified addresses
+	Language string        "language,omitempty" // of the emails, the default of the config if empty
+	Notify   string        "notify,omitempty"   // about finished jobs: immediate (default), digest or none
+	Chat     []string      "chat,omitempty"     // webhook urls or team channels also notified
+	Bounced  []string      "bounced,omitempty"  // addresses that bounced or complained, not mailed anymore
+	Username string        "username,omitempty" // always empty in config (field to store the username, key of the map entry)
+	Role     string        "role,omitempty"     // user (default) or admin
+	Limits   *LimitsConfig "limits,omitempty"
+	Disabled bool          "disabled,omitempty"
+	OIDC     string        "oidc,omitempty" // issuer and subject of the linked OpenID Connect identity
 }
 
 type MailgunConfig struct {
-	From   string "from"
-	Key    string "key"
-	Domain string "domain"
+	From        string "from"
+	Key         string "key"
+	Domain      string "domain"
+	SigningKey  string "signingKey"  // webhook signing key, the api key by default
+	MaxAge      int    "maxAge"      // seconds, messages with older timestamps are rejected, 5 minutes by default
+	RequireSPF  bool   "requireSpf"  // reject messages unless Mailgun's SPF check passed
+	RequireDKIM bool   "requireDkim" // same for DKIM
+	MaxReplies  int    "maxReplies"  // replies to email requests per sender and hour, 10 by default
+	Templates   string "templates"   // directory of the email templates, by language
+	Language    string "language"    // of the emails to users without one, es by default
 }
 
 type S3Config struct {
 	AccessKey string "accessKey"
 	SecretKey string "secretKey"
 	Bucket    string "bucket"
+	// seconds the download links last, they don't expire (and the videos are public) if zero
+	LinkLifetime int "linkLifetime"
+}
+
+type JobsConfig struct {
+	LogDir           string "logDir"           // defaults to a directory in $TMPDIR
+	LogMaxSize       int64  "logMaxSize"       // bytes, 1MB by default
+	LogBackups       int    "logBackups"       // rotated files to keep
+	PreflightTimeout int    "preflightTimeout" // seconds to wait for the metadata to check limits, 5 by default
+}
+
+// hash-password command
+func hashPassword() {
+	password := *hashPasswordText
+	if password == "" {
+		var err error
+		password, err = readPassword()
+		kingpin.FatalIfError(err, "error reading password")
+	}
+	hash, err := HashPassword(password, *hashAlgorithm)
+	kingpin.FatalIfError(err, "error hashing password")
+	fmt.Println(hash)
+}
+
+// readPassword reads a line from stdin, without echo if it's a terminal
+func readPassword() (string, error) {
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// checkConfig prints the problems of the config, exiting with an error if
+// there are any
+func checkConfig() {
+	if *configfile == "" {
+		kingpin.Fatalf("required flag --config not provided")
+	}
+	config, err := LoadConfig(*configfile)
+	kingpin.FatalIfError(err, "error loading config from %s", *configfile)
+	if err := config.Validate(); err != nil {
+		for _, problem := range err.(ConfigErrors) {
+			fmt.Println(problem)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("%s is ok\n", *configfile)
+}
+
+type DatabaseConfig struct {
+	Path string "path" // bolt database, yutubaas.db by default
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -87,13 +204,16 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 	config := &Config{}
-	yamlErr := yaml.Unmarshal(b, config)
-	if yamlErr != nil {
+	if err := yaml.Unmarshal(b, config); err != nil {
+		return nil, err
+	}
+	if err := ApplyConfigEnv(config, os.LookupEnv); err != nil {
 		return nil, err
 	}
 	// fill usernames
 	for username, account := range config.Accounts {
 		account.Username = username
+		config.Accounts[username] = account
 	}
 	return config, nil
 }
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/dgrijalva/jwt-go.v2"
+)
+
+type OIDCConfig struct {
+	Issuer         string   "issuer" // OpenID Connect disabled if empty
+	ClientId       string   "clientId"
+	ClientSecret   string   "clientSecret"
+	RedirectURL    string   "redirectUrl" // our /oidc/callback, as registered in the provider
+	Scopes         []string "scopes"      // openid, email and profile by default
+	AutoProvision  bool     "autoProvision"
+	AllowedDomains []string "allowedDomains" // email domains of the auto provisioned accounts, any by default
+}
+
+// how long a login can wait in the provider
+const oidcStateLifetime = 10 * time.Minute
+
+// cookie with the state of the login, so only the browser that started it
+// completes it (no login CSRF)
+const oidcStateCookie = "yutubaas_oidc_state"
+
+// OIDCProvider logs users in with the authorization code flow (with PKCE)
+// of an OpenID Connect provider
+type OIDCProvider struct {
+	OIDCConfig
+	Client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]interface{} // public keys of the provider, by kid
+	states    map[string]*oidcState
+}
+
+// the parts of /.well-known/openid-configuration we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// a login waiting for the provider
+type oidcState struct {
+	Verifier string // PKCE code verifier
+	Nonce    string
+	Expires  time.Time
+}
+
+// OIDCError is returned when the provider or its ID token can't be trusted
+type OIDCError struct {
+	Reason string
+}
+
+func (e *OIDCError) Error() string {
+	return e.Reason
+}
+
+func NewOIDCProvider(config *OIDCConfig, client *http.Client) *OIDCProvider {
+	provider := &OIDCProvider{OIDCConfig: *config, Client: client, states: make(map[string]*oidcState)}
+	if len(provider.Scopes) == 0 {
+		provider.Scopes = []string{"openid", "email", "profile"}
+	}
+	return provider
+}
+
+// Discover gets (once) the endpoints of the provider
+func (provider *OIDCProvider) Discover() (*oidcDiscovery, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	if provider.discovery != nil {
+		return provider.discovery, nil
+	}
+	discovery := &oidcDiscovery{}
+	if err := provider.getJSON(strings.TrimSuffix(provider.Issuer, "/")+"/.well-known/openid-configuration", discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != provider.Issuer {
+		return nil, &OIDCError{fmt.Sprintf("provider issuer %q doesn't match %q", discovery.Issuer, provider.Issuer)}
+	}
+	provider.discovery = discovery
+	return discovery, nil
+}
+
+func (provider *OIDCProvider) getJSON(u string, v interface{}) error {
+	res, err := provider.Client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response %s from %s", res.Status, u)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// AuthURL starts a login, returning the url of the provider to send the
+// user to and the state of the login
+func (provider *OIDCProvider) AuthURL() (string, string, error) {
+	discovery, err := provider.Discover()
+	if err != nil {
+		return "", "", err
+	}
+	state, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+	provider.mu.Lock()
+	now := time.Now()
+	for id, s := range provider.states {
+		if now.After(s.Expires) {
+			delete(provider.states, id)
+		}
+	}
+	provider.states[state] = &oidcState{verifier, nonce, now.Add(oidcStateLifetime)}
+	provider.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", provider.ClientId)
+	params.Set("redirect_uri", provider.RedirectURL)
+	params.Set("scope", strings.Join(provider.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return discovery.AuthorizationEndpoint + sep + params.Encode(), state, nil
+}
+
+// stateCookie returns the cookie with the state of a login, for our
+// callback only. An empty state deletes it.
+func (provider *OIDCProvider) stateCookie(state string) *http.Cookie {
+	cookie := &http.Cookie{Name: oidcStateCookie, Value: state, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode}
+	if u, err := url.Parse(provider.RedirectURL); err == nil {
+		cookie.Path = u.Path
+		cookie.Secure = u.Scheme == "https"
+	}
+	cookie.MaxAge = int(oidcStateLifetime / time.Second)
+	if state == "" {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+// Exchange completes the login of state with the code from the provider,
+// returning the claims of the validated ID token
+func (provider *OIDCProvider) Exchange(state string, code string) (map[string]interface{}, error) {
+	provider.mu.Lock()
+	login, ok := provider.states[state]
+	delete(provider.states, state)
+	provider.mu.Unlock()
+	if !ok || time.Now().After(login.Expires) {
+		return nil, &OIDCError{"unknown or expired login state"}
+	}
+	discovery, err := provider.Discover()
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Set("grant_type", "authorization_code")
+	params.Set("code", code)
+	params.Set("redirect_uri", provider.RedirectURL)
+	params.Set("client_id", provider.ClientId)
+	params.Set("code_verifier", login.Verifier)
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if provider.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(provider.ClientId), url.QueryEscape(provider.ClientSecret))
+	}
+	res, err := provider.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, &OIDCError{fmt.Sprintf("unexpected response %s exchanging the code", res.Status)}
+	}
+	tokens := struct {
+		IdToken string `json:"id_token"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	if tokens.IdToken == "" {
+		return nil, &OIDCError{"missing id_token in the provider response"}
+	}
+	return provider.VerifyIdToken(tokens.IdToken, login.Nonce)
+}
+
+// VerifyIdToken checks the signature, issuer, audience, expiration and nonce
+// of an ID token
+func (provider *OIDCProvider) VerifyIdToken(idToken string, nonce string) (map[string]interface{}, error) {
+	token, err := jwt.Parse(idToken, provider.keyfunc)
+	if err != nil {
+		return nil, &OIDCError{fmt.Sprintf("invalid id token: %s", err)}
+	}
+	claims := token.Claims
+	if iss, _ := claims["iss"].(string); iss != provider.Issuer {
+		return nil, &OIDCError{fmt.Sprintf("unexpected id token issuer %q", iss)}
+	}
+	if !audienceContains(claims["aud"], provider.ClientId) {
+		return nil, &OIDCError{"id token not issued for this client"}
+	}
+	if _, ok := claims["exp"].(float64); !ok {
+		return nil, &OIDCError{"missing exp in id token"}
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, &OIDCError{"id token nonce mismatch"}
+	}
+	return claims, nil
+}
+
+func audienceContains(aud interface{}, clientId string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientId
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keyfunc finds the provider key of token, fetching the JWKS again for
+// unknown kids (the provider rotated its keys). Only RS256 and ES256.
+func (provider *OIDCProvider) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, err := provider.key(kid, false)
+	if err == nil && key == nil {
+		key, err = provider.key(kid, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if token.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+	case *ecdsa.PublicKey:
+		if token.Method != jwt.SigningMethodES256 {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+	}
+	return key, nil
+}
+
+func (provider *OIDCProvider) key(kid string, refresh bool) (interface{}, error) {
+	discovery, err := provider.Discover()
+	if err != nil {
+		return nil, err
+	}
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	if provider.keys == nil || refresh {
+		jwks := struct {
+			Keys []JWK `json:"keys"`
+		}{}
+		if err := provider.getJSON(discovery.JwksURI, &jwks); err != nil {
+			return nil, err
+		}
+		provider.keys = make(map[string]interface{})
+		for _, jwk := range jwks.Keys {
+			if key, err := jwk.PublicKey(); err == nil {
+				provider.keys[jwk.Kid] = key
+			} else {
+				log.Debug("ignoring key %s of the OIDC provider: %s", jwk.Kid, err)
+			}
+		}
+	}
+	return provider.keys[kid], nil
+}
+
+// PublicKey returns the RSA or P-256 key of the JWK
+func (jwk *JWK) PublicKey() (interface{}, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b), err
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+var invalidUsernameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// OIDCAccount returns the account linked to the identity (issuer and subject)
+// of the claims. The first time, it links the account with the verified email
+// of the claims (exactly, ignoring case), or creates one if AutoProvision is
+// set.
+func (s *HttpServer) OIDCAccount(claims map[string]interface{}) (*ConfigUser, error) {
+	issuer, _ := claims["iss"].(string)
+	subject, _ := claims["sub"].(string)
+	if issuer == "" || subject == "" {
+		return nil, &OIDCError{"the provider didn't send the subject"}
+	}
+	email, _ := claims["email"].(string)
+	if verified, _ := claims["email_verified"].(bool); email == "" || !verified {
+		return nil, &OIDCError{"the provider didn't send a verified email"}
+	}
+	if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+		return nil, &OIDCError{fmt.Sprintf("invalid email %q", email)}
+	}
+	identity := issuer + " " + subject
+	account, err := s.Accounts.GetUserByOIDC(identity)
+	if err != nil || account != nil {
+		return account, err
+	}
+
+	// first login, not the +tag or case insensitive lookup of email requests
+	account, err = s.Accounts.GetUserByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if account != nil {
+		if account.OIDC != "" || !containsFold(account.Emails(), email) {
+			return nil, &OIDCError{fmt.Sprintf("no account for %s", email)}
+		}
+		account.OIDC = identity
+		if err := s.Accounts.SaveUser(account); err != nil {
+			return nil, err
+		}
+		audit.Info("account %s linked to OIDC identity %s", account.Username, identity)
+		return account, nil
+	}
+	at := strings.LastIndex(email, "@")
+	if !s.OIDC.AutoProvision || (len(s.OIDC.AllowedDomains) > 0 && !containsFold(s.OIDC.AllowedDomains, email[at+1:])) {
+		return nil, &OIDCError{fmt.Sprintf("no account for %s", email)}
+	}
+
+	// new account, without password (only OIDC logins)
+	name, _ := claims["name"].(string)
+	base := invalidUsernameChars.ReplaceAllString(email[:at], "")
+	if base == "" {
+		base = "user"
+	}
+	account = &ConfigUser{Name: name, Email: email, Username: base, OIDC: identity}
+	for i := 2; ; i++ {
+		err := s.Accounts.CreateUser(account)
+		if err != ErrUserExists {
+			if err == nil {
+				log.Info("account %s created for %s from OIDC", account.Username, email)
+			}
+			return account, err
+		}
+		account.Username = fmt.Sprintf("%s%d", base, i)
+	}
+}
+
+// HandleOIDCLogin sends the user to the provider
+func (s *HttpServer) HandleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	authURL, state, err := s.OIDC.AuthURL()
+	if err != nil {
+		log.Error("error starting OIDC login: %s", err)
+		http.Error(w, "identity provider not available", http.StatusBadGateway)
+		return
+	}
+	http.SetCookie(w, s.OIDC.stateCookie(state))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// HandleOIDCCallback completes the login, responding with our own tokens
+func (s *HttpServer) HandleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		http.Error(w, fmt.Sprintf("login failed: %s %s", e, query.Get("error_description")), http.StatusUnauthorized)
+		return
+	}
+	// the login must have started in this browser
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		audit.Warning("OIDC callback from %s with a state not started by its browser", r.RemoteAddr)
+		http.Error(w, "login not started in this browser", http.StatusUnauthorized)
+		return
+	}
+	http.SetCookie(w, s.OIDC.stateCookie(""))
+	claims, err := s.OIDC.Exchange(query.Get("state"), query.Get("code"))
+	var account *ConfigUser
+	if err == nil {
+		account, err = s.OIDCAccount(claims)
+	}
+	if _, ok := err.(*OIDCError); ok {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Error("error completing OIDC login: %s", err)
+		http.Error(w, "identity provider not available", http.StatusBadGateway)
+		return
+	}
+	if account.Disabled {
+		http.Error(w, "unknown or disabled user", http.StatusUnauthorized)
+		return
+	}
+	response, err := s.IssueTokens(account, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
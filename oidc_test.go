@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dgrijalva/jwt-go.v2"
+)
+
+// FakeIdentityProvider is a minimal OpenID Connect provider. Authorize
+// plays the part of the user logging in.
+type FakeIdentityProvider struct {
+	*httptest.Server
+	Key      *rsa.PrivateKey
+	ClientId string
+
+	mu    sync.Mutex
+	codes map[string]fakeAuthorization
+}
+
+type fakeAuthorization struct {
+	Challenge string
+	Claims    map[string]interface{}
+}
+
+func NewFakeIdentityProvider(t *testing.T, clientId string) *FakeIdentityProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	idp := &FakeIdentityProvider{Key: key, ClientId: clientId, codes: make(map[string]fakeAuthorization)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk := &JWK{Kty: "RSA", Kid: "idp", Use: "sig", Alg: "RS256"}
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+		json.NewEncoder(w).Encode(map[string][]*JWK{"keys": {jwk}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		auth, ok := idp.codes[r.FormValue("code")]
+		delete(idp.codes, r.FormValue("code"))
+		idp.mu.Unlock()
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || auth.Challenge != base64.RawURLEncoding.EncodeToString(verifier[:]) {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		token := jwt.New(jwt.SigningMethodRS256)
+		token.Header["kid"] = "idp"
+		token.Claims = auth.Claims
+		idToken, err := token.SignedString(key)
+		assert.Nil(t, err)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "x", "id_token": idToken})
+	})
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+// Authorize logs in the user with the claims at the authorization url,
+// returning the code for the callback
+func (idp *FakeIdentityProvider) Authorize(authURL string, claims map[string]interface{}) (string, string) {
+	u, _ := url.Parse(authURL)
+	query := u.Query()
+	claims["iss"] = idp.URL
+	claims["aud"] = query.Get("client_id")
+	claims["nonce"] = query.Get("nonce")
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	claims["iat"] = time.Now().Unix()
+	code, _ := randomHex(8)
+	idp.mu.Lock()
+	idp.codes[code] = fakeAuthorization{query.Get("code_challenge"), claims}
+	idp.mu.Unlock()
+	return code, query.Get("state")
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := NewFakeIdentityProvider(t, "yutubaas")
+	defer idp.Close()
+
+	config := &Config{}
+	config.HS256key = "secret"
+	config.Accounts = map[string]ConfigUser{
+		"oskar": ConfigUser{Name: "Oskar", Password: "qwerty", Email: "oskar@gmail.com"},
+	}
+	dbPath, cleanup := newTestDBFile(t)
+	defer cleanup()
+	config.Database.Path = dbPath
+	config.OIDC = OIDCConfig{Issuer: idp.URL, ClientId: "yutubaas", RedirectURL: "http://localhost/oidc/callback",
+		AutoProvision: true, AllowedDomains: []string{"larix.cl"}}
+	server, err := NewHttpServer(config)
+	require.Nil(t, err)
+	api := httptest.NewServer(server.CreateRouter())
+	defer api.Close()
+	newClient := func() *http.Client {
+		jar, err := cookiejar.New(nil)
+		assert.Nil(t, err)
+		return &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	}
+	client := newClient()
+
+	login := func(claims map[string]interface{}) *http.Response {
+		res, err := client.Get(api.URL + "/oidc/login")
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusFound, res.StatusCode)
+		code, state := idp.Authorize(res.Header.Get("Location"), claims)
+		res, err = client.Get(api.URL + "/oidc/callback?" + url.Values{"code": {code}, "state": {state}}.Encode())
+		assert.Nil(t, err)
+		return res
+	}
+
+	// existing account
+	res := login(map[string]interface{}{"sub": "1", "email": "oskar@gmail.com", "email_verified": true})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	tokens := &TokenResponse{}
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(tokens))
+	parsed, err := jwt.Parse(tokens.Token, server.Keys.Keyfunc)
+	assert.Nil(t, err)
+	assert.Equal(t, "oskar", parsed.Claims["sub"])
+
+	// unverified email
+	res = login(map[string]interface{}{"sub": "1", "email": "oskar@gmail.com", "email_verified": false})
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	// auto provisioned, only in the allowed domains
+	res = login(map[string]interface{}{"sub": "2", "email": "jorge@larix.cl", "email_verified": true, "name": "Jorge"})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	account, err := server.Accounts.GetUserByEmail("jorge@larix.cl")
+	assert.Nil(t, err)
+	assert.Equal(t, "jorge", account.Username)
+	assert.Equal(t, "Jorge", account.Name)
+	assert.Equal(t, "", account.Password)
+	res = login(map[string]interface{}{"sub": "3", "email": "charles@gmail.com", "email_verified": true})
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	// linked by the identity after the first login, whatever the email
+	res = login(map[string]interface{}{"sub": "1", "email": "kokoschka@wien.at", "email_verified": true})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	account, err = server.Accounts.GetUser("oskar")
+	assert.Nil(t, err)
+	assert.Equal(t, idp.URL+" 1", account.OIDC)
+	// other identities with the email, or a +tag of it, aren't linked
+	res = login(map[string]interface{}{"sub": "4", "email": "oskar@gmail.com", "email_verified": true})
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	require.Nil(t, server.Accounts.CreateUser(&ConfigUser{Username: "alma", Email: "alma@larix.cl", Password: "x"}))
+	res = login(map[string]interface{}{"sub": "5", "email": "alma+x@larix.cl", "email_verified": true})
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	account, err = server.Accounts.GetUser("alma")
+	assert.Nil(t, err)
+	assert.Equal(t, "", account.OIDC)
+	for _, claims := range []map[string]interface{}{
+		{"email": "charles@larix.cl", "email_verified": true},
+		{"sub": "6", "email": "charles", "email_verified": true},
+		{"sub": "6", "email": "Charles <charles@larix.cl>", "email_verified": true},
+	} {
+		res = login(claims)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode, claims["email"])
+	}
+
+	// states can't be reused
+	res, err = client.Get(api.URL + "/oidc/login")
+	assert.Nil(t, err)
+	code, state := idp.Authorize(res.Header.Get("Location"), map[string]interface{}{"sub": "1", "email": "oskar@gmail.com", "email_verified": true})
+	res, err = client.Get(api.URL + "/oidc/callback?" + url.Values{"code": {code}, "state": {state}}.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res, err = client.Get(api.URL + "/oidc/callback?" + url.Values{"code": {code}, "state": {state}}.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	// login CSRF: the callback of a login started by an attacker, in the
+	// browser of a victim, is rejected
+	res, err = client.Get(api.URL + "/oidc/login")
+	assert.Nil(t, err)
+	cookie := res.Cookies()[0]
+	assert.Equal(t, oidcStateCookie, cookie.Name)
+	assert.True(t, cookie.HttpOnly)
+	assert.Equal(t, "/oidc/callback", cookie.Path)
+	code, state = idp.Authorize(res.Header.Get("Location"), map[string]interface{}{"sub": "1", "email": "oskar@gmail.com", "email_verified": true})
+	victim := newClient()
+	res, err = victim.Get(api.URL + "/oidc/login")
+	assert.Nil(t, err)
+	res, err = victim.Get(api.URL + "/oidc/callback?" + url.Values{"code": {code}, "state": {state}}.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	res, err = newClient().Get(api.URL + "/oidc/callback?" + url.Values{"code": {code}, "state": {state}}.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	// still valid for the attacker's own browser
+	res, err = client.Get(api.URL + "/oidc/callback?" + url.Values{"code": {code}, "state": {state}}.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestOIDCVerifyIdToken(t *testing.T) {
+	idp := NewFakeIdentityProvider(t, "yutubaas")
+	defer idp.Close()
+	provider := NewOIDCProvider(&OIDCConfig{Issuer: idp.URL, ClientId: "yutubaas"}, http.DefaultClient)
+
+	sign := func(method jwt.SigningMethod, key interface{}, claims map[string]interface{}) string {
+		token := jwt.New(method)
+		token.Header["kid"] = "idp"
+		token.Claims = claims
+		signed, err := token.SignedString(key)
+		assert.Nil(t, err)
+		return signed
+	}
+	claims := func() map[string]interface{} {
+		return map[string]interface{}{"iss": idp.URL, "aud": "yutubaas", "nonce": "n", "exp": time.Now().Add(time.Minute).Unix()}
+	}
+
+	_, err := provider.VerifyIdToken(sign(jwt.SigningMethodRS256, idp.Key, claims()), "n")
+	assert.Nil(t, err)
+	_, err = provider.VerifyIdToken(sign(jwt.SigningMethodRS256, idp.Key, claims()), "other")
+	assert.Equal(t, "id token nonce mismatch", err.Error())
+	other := claims()
+	other["aud"] = []interface{}{"someone", "else"}
+	_, err = provider.VerifyIdToken(sign(jwt.SigningMethodRS256, idp.Key, other), "n")
+	assert.Equal(t, "id token not issued for this client", err.Error())
+	other = claims()
+	other["iss"] = "https://evil.example.com"
+	_, err = provider.VerifyIdToken(sign(jwt.SigningMethodRS256, idp.Key, other), "n")
+	assert.Equal(t, "unexpected id token issuer \"https://evil.example.com\"", err.Error())
+	other = claims()
+	other["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err = provider.VerifyIdToken(sign(jwt.SigningMethodRS256, idp.Key, other), "n")
+	assert.NotNil(t, err)
+	// HS256 with the public key of the provider
+	_, err = provider.VerifyIdToken(sign(jwt.SigningMethodHS256, idp.Key.N.Bytes(), claims()), "n")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// codes of the RequestErrors, the replies to emails explain them in the
+// language of the user
+const (
+	ErrCodeNoUrls         = "no-urls"
+	ErrCodeInvalidUrl     = "invalid-url"  // Value is the url
+	ErrCodeInvalidTime    = "invalid-time" // Value is the time
+	ErrCodeUnexpected     = "unexpected"   // Value is the word, Line the option
+	ErrCodeNegative       = "negative-option"
+	ErrCodeEndBeforeStart = "end-before-start"
+	ErrCodeAudioFormat    = "audio-format" // audio with a resolution or subtitles
+	ErrCodeSubtitles      = "subtitles"    // Value is the invalid language
+)
+
+// RequestError is why a download request (its options or email) is invalid
+type RequestError struct {
+	Code  string
+	Value string
+	Line  string
+}
+
+func (e *RequestError) Error() string {
+	switch e.Code {
+	case ErrCodeNoUrls:
+		return "the message has no urls"
+	case ErrCodeInvalidUrl:
+		return fmt.Sprintf("%q isn't a valid url", e.Value)
+	case ErrCodeInvalidTime:
+		return fmt.Sprintf("invalid time %q", e.Value)
+	case ErrCodeUnexpected:
+		return fmt.Sprintf("unexpected %q in %q", e.Value, e.Line)
+	case ErrCodeNegative:
+		return "negative option"
+	case ErrCodeEndBeforeStart:
+		return "the end of the video must be after its start"
+	case ErrCodeAudioFormat:
+		return "audio downloads don't have a resolution or subtitles"
+	case ErrCodeSubtitles:
+		return fmt.Sprintf("invalid subtitle language %q", e.Value)
+	}
+	return e.Code
+}
+
+// DownloadOptions are the choices of the user for a job, from the json api
+// or the lines of an email
+type DownloadOptions struct {
+	Audio     bool     `json:"audio,omitempty"`     // only the audio, as mp3
+	MaxHeight int      `json:"maxHeight,omitempty"` // best video up to this height (720 for 720p)
+	Start     int64    `json:"start,omitempty"`     // seconds, cut the video from here
+	End       int64    `json:"end,omitempty"`       // seconds, and up to here
+	Subtitles []string `json:"subtitles,omitempty"` // languages of the embedded subtitles
+}
+
+// languages of subtitles and emails
+var languageTag = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})?$`)
+
+func (opts *DownloadOptions) IsZero() bool {
+	return !opts.Audio && opts.MaxHeight == 0 && opts.Start == 0 && opts.End == 0 && len(opts.Subtitles) == 0
+}
+
+// Validate checks the options, nil if they're valid
+func (opts *DownloadOptions) Validate() *RequestError {
+	if opts.MaxHeight < 0 || opts.Start < 0 || opts.End < 0 {
+		return &RequestError{Code: ErrCodeNegative}
+	}
+	if opts.End != 0 && opts.End <= opts.Start {
+		return &RequestError{Code: ErrCodeEndBeforeStart}
+	}
+	if opts.Audio && (opts.MaxHeight != 0 || len(opts.Subtitles) > 0) {
+		return &RequestError{Code: ErrCodeAudioFormat}
+	}
+	for _, lang := range opts.Subtitles {
+		if !languageTag.MatchString(lang) {
+			return &RequestError{Code: ErrCodeSubtitles, Value: lang}
+		}
+	}
+	return nil
+}
+
+// FormatArgs are the youtube-dl arguments choosing the format, for the
+// metadata and the download
+func (opts *DownloadOptions) FormatArgs() []string {
+	if opts.Audio {
+		return []string{"-f", "bestaudio/best"}
+	}
+	if opts.MaxHeight > 0 {
+		return []string{"-f", fmt.Sprintf("bestvideo[height<=%d]+bestaudio/best[height<=%d]", opts.MaxHeight, opts.MaxHeight)}
+	}
+	return nil
+}
+
+// DownloadArgs are the youtube-dl arguments of the download
+func (opts *DownloadOptions) DownloadArgs() []string {
+	args := opts.FormatArgs()
+	if opts.Audio {
+		args = append(args, "--extract-audio", "--audio-format", "mp3")
+	}
+	if len(opts.Subtitles) > 0 {
+		args = append(args, "--write-sub", "--embed-subs", "--sub-lang", strings.Join(opts.Subtitles, ","))
+	}
+	if opts.Start > 0 || opts.End > 0 {
+		cut := fmt.Sprintf("-ss %d", opts.Start)
+		if opts.End > 0 {
+			cut += fmt.Sprintf(" -to %d", opts.End)
+		}
+		args = append(args, "--external-downloader", "ffmpeg", "--external-downloader-args", cut)
+	}
+	return args
+}
+
+// File returns the name of the downloaded file, given the one reported by
+// youtube-dl -j (audio is converted after the download)
+func (opts *DownloadOptions) File(file string) string {
+	if opts.Audio && file != "" {
+		return strings.TrimSuffix(file, filepath.Ext(file)) + ".mp3"
+	}
+	return file
+}
+
+// ParseTimestamp parses a position in a video: seconds, m:ss or h:mm:ss
+func ParseTimestamp(s string) (int64, error) {
+	var seconds int64
+	for _, part := range strings.Split(s, ":") {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		seconds = seconds*60 + int64(n)
+	}
+	return seconds, nil
+}
+
+func FormatTimestamp(seconds int64) string {
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+var (
+	resolutionPattern = regexp.MustCompile(`^(\d{3,4})p$`)
+	timestampPattern  = regexp.MustCompile(`^\d+(:\d\d){0,2}$`)
+)
+
+// MailRequest is a download request by email: every url in the subject and
+// body, with the options of the body lines
+type MailRequest struct {
+	Urls    []*url.URL
+	Options DownloadOptions
+}
+
+// ParseMailRequest extracts the urls and options of an email. Option lines
+// are:
+//
+//	audio
+//	720p
+//	from 1:30 to 4:00
+//	subs es,en
+//
+// Other words are ignored, so the urls can come with some text.
+func ParseMailRequest(subject string, text string) (*MailRequest, *RequestError) {
+	request := &MailRequest{}
+	seen := make(map[string]bool)
+	for _, line := range append([]string{subject}, strings.Split(text, "\n")...) {
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+		if err := request.parseOption(words); err != nil {
+			return nil, err
+		}
+		for _, word := range words {
+			// the punctuation around an url in a sentence
+			word = strings.TrimRight(strings.TrimLeft(word, "<("), ">).,;")
+			if !strings.HasPrefix(word, "http://") && !strings.HasPrefix(word, "https://") {
+				continue
+			}
+			videoUrl, err := url.ParseRequestURI(word)
+			if err != nil {
+				return nil, &RequestError{Code: ErrCodeInvalidUrl, Value: word}
+			}
+			if !seen[videoUrl.String()] {
+				seen[videoUrl.String()] = true
+				request.Urls = append(request.Urls, videoUrl)
+			}
+		}
+	}
+	if len(request.Urls) == 0 {
+		return nil, &RequestError{Code: ErrCodeNoUrls}
+	}
+	if err := request.Options.Validate(); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// parseOption sets the option of a line, if it's one
+func (request *MailRequest) parseOption(words []string) *RequestError {
+	opts := &request.Options
+	keyword := strings.ToLower(words[0])
+	switch {
+	case keyword == "audio" && len(words) == 1:
+		opts.Audio = true
+	case resolutionPattern.MatchString(keyword) && len(words) == 1:
+		opts.MaxHeight, _ = strconv.Atoi(resolutionPattern.FindStringSubmatch(keyword)[1])
+	case keyword == "subs" && len(words) == 2:
+		opts.Subtitles = strings.Split(words[1], ",")
+	case (keyword == "from" || keyword == "to") && (len(words) == 2 || len(words) == 4) && timestampPattern.MatchString(words[1]):
+		// a sentence starting with from or to isn't an option
+		for i := 0; i < len(words); i += 2 {
+			t, err := ParseTimestamp(words[i+1])
+			if err != nil {
+				return &RequestError{Code: ErrCodeInvalidTime, Value: words[i+1]}
+			}
+			switch strings.ToLower(words[i]) {
+			case "from":
+				opts.Start = t
+			case "to":
+				opts.End = t
+			default:
+				return &RequestError{Code: ErrCodeUnexpected, Value: words[i], Line: strings.Join(words, " ")}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMailRequest(t *testing.T) {
+	request, err := ParseMailRequest("Re: videos", "hola!\nhttps://www.youtube.com/watch?v=bS5P_LAqiVg\n<https://vimeo.com/123456>.\n720p\nsubs es,en\nfrom 1:02:03\nto you, thanks\nhttps://www.youtube.com/watch?v=bS5P_LAqiVg")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(request.Urls))
+	assert.Equal(t, "https://www.youtube.com/watch?v=bS5P_LAqiVg", request.Urls[0].String())
+	assert.Equal(t, "https://vimeo.com/123456", request.Urls[1].String())
+	assert.Equal(t, DownloadOptions{MaxHeight: 720, Start: 3723, Subtitles: []string{"es", "en"}}, request.Options)
+
+	_, err = ParseMailRequest("", "nothing here")
+	assert.Equal(t, &RequestError{Code: ErrCodeNoUrls}, err)
+	assert.Equal(t, "the message has no urls", err.Error())
+	_, err = ParseMailRequest("", "https://vimeo.com/123456\naudio\n720p")
+	assert.Equal(t, "audio downloads don't have a resolution or subtitles", err.Error())
+	_, err = ParseMailRequest("", "https://vimeo.com/123456\nfrom 1:00 until 2:00")
+	assert.Equal(t, &RequestError{Code: ErrCodeUnexpected, Value: "until", Line: "from 1:00 until 2:00"}, err)
+	assert.Equal(t, "unexpected \"until\" in \"from 1:00 until 2:00\"", err.Error())
+}
+
+func TestDownloadOptionsArgs(t *testing.T) {
+	opts := &DownloadOptions{Audio: true, Start: 90, End: 240}
+	assert.Equal(t, []string{"-f", "bestaudio/best"}, opts.FormatArgs())
+	assert.Equal(t, []string{"-f", "bestaudio/best", "--extract-audio", "--audio-format", "mp3",
+		"--external-downloader", "ffmpeg", "--external-downloader-args", "-ss 90 -to 240"}, opts.DownloadArgs())
+	assert.Equal(t, "video-id.mp3", opts.File("video-id.webm"))
+
+	opts = &DownloadOptions{MaxHeight: 480, Subtitles: []string{"es"}}
+	assert.Equal(t, []string{"-f", "bestvideo[height<=480]+bestaudio/best[height<=480]", "--write-sub", "--embed-subs",
+		"--sub-lang", "es"}, opts.DownloadArgs())
+	assert.Equal(t, "video-id.webm", opts.File("video-id.webm"))
+	assert.Nil(t, (&DownloadOptions{}).DownloadArgs())
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+type NotificationStatus string
+
+const (
+	NotificationPending NotificationStatus = "pending"
+	NotificationSent    NotificationStatus = "sent"
+	NotificationFailed  NotificationStatus = "failed" // gave up, until an admin resends it
+)
+
+var ErrNotificationNotFound = errors.New("notification not found")
+
+// ErrNotificationNotFailed is returned resending a notification pending or
+// already sent
+var ErrNotificationNotFailed = errors.New("notification didn't fail")
+
+// delivery of the notifications, zero means the default
+type OutboxConfig struct {
+	MaxAttempts int "maxAttempts" // before giving up on a notification, 8 by default
+	Backoff     int "backoff"     // seconds before the first retry, doubled with every attempt, 30 by default
+	MaxBackoff  int "maxBackoff"  // longest wait between attempts, 1 hour by default
+	Retention   int "retention"   // seconds the sent and failed notifications are kept, 7 days by default
+}
+
+// Notification is an email to an user, rendered and waiting in the outbox
+// until the provider accepts it
+type Notification struct {
+	Id          string
+	JobIds      []string // of the notified jobs, empty for replies and confirmations
+	Template    string
+	To          string
+	Subject     string
+	Text        string
+	Html        string
+	Headers     map[string]string
+	Status      NotificationStatus
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	MessageId   string // given by the provider
+	Created     time.Time
+	Sent        time.Time
+	Failed      time.Time // when it was given up
+}
+
+type OutboxRepository interface {
+	SaveNotification(n *Notification) error
+	GetNotification(id string) (*Notification, error)                     // nil if not found
+	ListNotifications(status NotificationStatus) ([]*Notification, error) // oldest first
+	DeleteNotification(id string) error
+	// DueNotifications returns the pending notifications due at now, and when
+	// the next one is due (zero if there are none)
+	DueNotifications(now time.Time) ([]*Notification, time.Time, error)
+}
+
+// BoltOutboxRepository stores the notifications, as json, in a bolt database.
+// The pending ones are indexed by their next attempt, so finding the due ones
+// doesn't read the sent ones.
+type BoltOutboxRepository struct {
+	DB *bolt.DB
+}
+
+var (
+	outboxBucket    = []byte("outbox")
+	outboxDueBucket = []byte("outbox-due") // next attempt and id of the pending notifications, to the id
+)
+
+func NewBoltOutboxRepository(db *bolt.DB) (*BoltOutboxRepository, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(outboxBucket)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(outboxDueBucket) != nil {
+			return nil
+		}
+		// databases from before the index
+		due, err := tx.CreateBucket(outboxDueBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			n := &Notification{}
+			if err := json.Unmarshal(v, n); err != nil {
+				return err
+			}
+			if n.Status != NotificationPending {
+				return nil
+			}
+			return due.Put(dueKey(n), k)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltOutboxRepository{db}, nil
+}
+
+// dueKey sorts the pending notifications by their next attempt
+func dueKey(n *Notification) []byte {
+	key := make([]byte, 8, 8+len(n.Id))
+	binary.BigEndian.PutUint64(key, uint64(n.NextAttempt.UnixNano()))
+	return append(key, n.Id...)
+}
+
+func (repo *BoltOutboxRepository) SaveNotification(n *Notification) error {
+	return repo.DB.Update(func(tx *bolt.Tx) error {
+		v, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		if err := unindexNotification(tx, n.Id); err != nil {
+			return err
+		}
+		if n.Status == NotificationPending {
+			if err := tx.Bucket(outboxDueBucket).Put(dueKey(n), []byte(n.Id)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(outboxBucket).Put([]byte(n.Id), v)
+	})
+}
+
+// unindexNotification removes the stored notification id from the due index
+func unindexNotification(tx *bolt.Tx, id string) error {
+	v := tx.Bucket(outboxBucket).Get([]byte(id))
+	if v == nil {
+		return nil
+	}
+	n := &Notification{}
+	if err := json.Unmarshal(v, n); err != nil {
+		return err
+	}
+	if n.Status != NotificationPending {
+		return nil
+	}
+	return tx.Bucket(outboxDueBucket).Delete(dueKey(n))
+}
+
+func (repo *BoltOutboxRepository) GetNotification(id string) (*Notification, error) {
+	var n *Notification
+	err := repo.DB.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(outboxBucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		n = &Notification{}
+		return json.Unmarshal(v, n)
+	})
+	return n, err
+}
+
+func (repo *BoltOutboxRepository) ListNotifications(status NotificationStatus) ([]*Notification, error) {
+	notifications := []*Notification{}
+	err := repo.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(k, v []byte) error {
+			n := &Notification{}
+			if err := json.Unmarshal(v, n); err != nil {
+				return err
+			}
+			if n.Status == status {
+				notifications = append(notifications, n)
+			}
+			return nil
+		})
+	})
+	sort.Slice(notifications, func(i, j int) bool { return notifications[i].Created.Before(notifications[j].Created) })
+	return notifications, err
+}
+
+func (repo *BoltOutboxRepository) DeleteNotification(id string) error {
+	return repo.DB.Update(func(tx *bolt.Tx) error {
+		if err := unindexNotification(tx, id); err != nil {
+			return err
+		}
+		return tx.Bucket(outboxBucket).Delete([]byte(id))
+	})
+}
+
+func (repo *BoltOutboxRepository) DueNotifications(now time.Time) ([]*Notification, time.Time, error) {
+	notifications := []*Notification{}
+	var next time.Time
+	err := repo.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		c := tx.Bucket(outboxDueBucket).Cursor()
+		for k, id := c.First(); k != nil; k, id = c.Next() {
+			n := &Notification{}
+			if err := json.Unmarshal(b.Get(id), n); err != nil {
+				return err
+			}
+			if n.NextAttempt.After(now) {
+				next = n.NextAttempt
+				break
+			}
+			notifications = append(notifications, n)
+		}
+		return nil
+	})
+	return notifications, next, err
+}
+
+// Outbox delivers the notifications in the background, retrying the failed
+// ones with exponential backoff until MaxAttempts
+type Outbox struct {
+	Repo   OutboxRepository
+	Jobs   JobRepository // where the message ids are recorded
+	Sender func(n *Notification) (string, error)
+	Now    func() time.Time
+
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	Retention   time.Duration
+
+	round  sync.Mutex // one delivery round at a time
+	mu     sync.Mutex // changes of the stored notifications
+	wake   chan struct{}
+	pruned time.Time
+}
+
+// how often the notifications past the retention are looked for
+const outboxPruneInterval = time.Hour
+
+func NewOutbox(repo OutboxRepository, jobs JobRepository, config *OutboxConfig) *Outbox {
+	outbox := &Outbox{Repo: repo, Jobs: jobs, Now: time.Now, wake: make(chan struct{}, 1)}
+	outbox.MaxAttempts = 8
+	if config.MaxAttempts != 0 {
+		outbox.MaxAttempts = config.MaxAttempts
+	}
+	outbox.Backoff = 30 * time.Second
+	if config.Backoff != 0 {
+		outbox.Backoff = time.Duration(config.Backoff) * time.Second
+	}
+	outbox.MaxBackoff = time.Hour
+	if config.MaxBackoff != 0 {
+		outbox.MaxBackoff = time.Duration(config.MaxBackoff) * time.Second
+	}
+	outbox.Retention = 7 * 24 * time.Hour
+	if config.Retention != 0 {
+		outbox.Retention = time.Duration(config.Retention) * time.Second
+	}
+	return outbox
+}
+
+// Enqueue stores n to be delivered as soon as possible
+func (outbox *Outbox) Enqueue(n *Notification) error {
+	id, err := NewJobId()
+	if err != nil {
+		return err
+	}
+	n.Id = id
+	n.Status = NotificationPending
+	n.Created = outbox.Now()
+	n.NextAttempt = n.Created
+	if err := outbox.Repo.SaveNotification(n); err != nil {
+		return err
+	}
+	outbox.Wake()
+	return nil
+}
+
+// Wake makes Run deliver the pending notifications now
+func (outbox *Outbox) Wake() {
+	select {
+	case outbox.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers the notifications until stop is closed
+func (outbox *Outbox) Run(stop <-chan struct{}) {
+	for {
+		wait := time.Minute
+		if next := outbox.DeliverDue(); !next.IsZero() && next.Sub(outbox.Now()) < wait {
+			wait = next.Sub(outbox.Now())
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-outbox.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// DeliverDue tries the pending notifications whose time has come, returning
+// when the next one is due (zero if there are none). They're sent without
+// holding the lock, so a resend doesn't wait for the round. It also forgets
+// the notifications sent or failed before the retention.
+func (outbox *Outbox) DeliverDue() time.Time {
+	outbox.round.Lock()
+	defer outbox.round.Unlock()
+	outbox.mu.Lock()
+	due, next, err := outbox.Repo.DueNotifications(outbox.Now())
+	outbox.mu.Unlock()
+	if err != nil {
+		log.Error("error reading the outbox: %s", err)
+		return outbox.Now().Add(outbox.Backoff)
+	}
+	for _, n := range due {
+		if outbox.deliver(n); n.Status == NotificationPending && (next.IsZero() || n.NextAttempt.Before(next)) {
+			next = n.NextAttempt
+		}
+	}
+	if outbox.Now().Sub(outbox.pruned) >= outboxPruneInterval {
+		outbox.prune()
+		outbox.pruned = outbox.Now()
+	}
+	return next
+}
+
+func (outbox *Outbox) deliver(n *Notification) {
+	n.Attempts++
+	id, err := outbox.Sender(n)
+	now := outbox.Now()
+	if err == nil {
+		n.Status = NotificationSent
+		n.MessageId = id
+		n.Sent = now
+		n.LastError = ""
+		for _, jobId := range n.JobIds {
+			outbox.Jobs.AddMessageId(jobId, id)
+		}
+		log.Debug("notification %s to %s sent: id=%s", n.Id, n.To, id)
+	} else {
+		n.LastError = err.Error()
+		if err == ErrBounced || n.Attempts >= outbox.MaxAttempts {
+			n.Status = NotificationFailed
+			n.Failed = now
+			log.Error("giving up on notification %s to %s after %d attempts: %s", n.Id, n.To, n.Attempts, err)
+		} else {
+			n.NextAttempt = now.Add(outbox.backoff(n.Attempts))
+			log.Warning("error sending notification %s to %s (attempt %d), retrying at %s: %s",
+				n.Id, n.To, n.Attempts, n.NextAttempt.Format(time.RFC3339), err)
+		}
+	}
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+	if err := outbox.Repo.SaveNotification(n); err != nil {
+		log.Error("error saving notification %s: %s", n.Id, err)
+	}
+}
+
+// backoff is the wait after a number of failed attempts
+func (outbox *Outbox) backoff(attempts int) time.Duration {
+	backoff := outbox.Backoff
+	for i := 1; i < attempts && backoff < outbox.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outbox.MaxBackoff {
+		backoff = outbox.MaxBackoff
+	}
+	return backoff
+}
+
+func (outbox *Outbox) prune() {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+	sent, err := outbox.Repo.ListNotifications(NotificationSent)
+	if err != nil {
+		log.Error("error reading the outbox: %s", err)
+		return
+	}
+	failed, err := outbox.Repo.ListNotifications(NotificationFailed)
+	if err != nil {
+		log.Error("error reading the outbox: %s", err)
+		return
+	}
+	for _, n := range append(sent, failed...) {
+		done := n.Sent
+		if n.Status == NotificationFailed {
+			done = n.Failed
+		}
+		if done.IsZero() {
+			done = n.Created
+		}
+		if outbox.Now().Sub(done) > outbox.Retention {
+			if err := outbox.Repo.DeleteNotification(n.Id); err != nil {
+				log.Error("error deleting notification %s: %s", n.Id, err)
+			}
+		}
+	}
+}
+
+// Resend queues again a failed notification, with its attempts reset
+func (outbox *Outbox) Resend(id string) (*Notification, error) {
+	outbox.mu.Lock()
+	n, err := outbox.Repo.GetNotification(id)
+	if err == nil && n == nil {
+		err = ErrNotificationNotFound
+	} else if err == nil && n.Status != NotificationFailed {
+		err = ErrNotificationNotFailed
+	}
+	if err != nil {
+		outbox.mu.Unlock()
+		return nil, err
+	}
+	n.Status = NotificationPending
+	n.Attempts = 0
+	n.NextAttempt = outbox.Now()
+	n.Failed = time.Time{}
+	err = outbox.Repo.SaveNotification(n)
+	outbox.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	outbox.Wake()
+	return n, nil
+}
+
+// notification representation in the http api (without the body)
+type NotificationInfo struct {
+	Id          string             `json:"id"`
+	JobIds      []string           `json:"jobIds,omitempty"`
+	Template    string             `json:"template"`
+	To          string             `json:"to"`
+	Subject     string             `json:"subject"`
+	Status      NotificationStatus `json:"status"`
+	Attempts    int                `json:"attempts"`
+	NextAttempt *time.Time         `json:"nextAttempt,omitempty"`
+	LastError   string             `json:"lastError,omitempty"`
+	MessageId   string             `json:"messageId,omitempty"`
+	Created     time.Time          `json:"created"`
+}
+
+func NewNotificationInfo(n *Notification) *NotificationInfo {
+	info := &NotificationInfo{Id: n.Id, JobIds: n.JobIds, Template: n.Template, To: n.To, Subject: n.Subject,
+		Status: n.Status, Attempts: n.Attempts, LastError: n.LastError, MessageId: n.MessageId, Created: n.Created}
+	if n.Status == NotificationPending {
+		next := n.NextAttempt
+		info.NextAttempt = &next
+	}
+	return info
+}
+
+// HandleListNotifications lists the notifications with the status of the
+// query, failed by default
+func (s *HttpServer) HandleListNotifications(w http.ResponseWriter, r *http.Request) {
+	status := NotificationStatus(r.URL.Query().Get("status"))
+	if status == "" {
+		status = NotificationFailed
+	}
+	if status != NotificationPending && status != NotificationSent && status != NotificationFailed {
+		http.Error(w, "invalid status", http.StatusBadRequest)
+		return
+	}
+	notifications, err := s.Outbox.Repo.ListNotifications(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := make([]*NotificationInfo, len(notifications))
+	for i, n := range notifications {
+		response[i] = NewNotificationInfo(n)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HttpServer) HandleResendNotification(w http.ResponseWriter, r *http.Request) {
+	n, err := s.Outbox.Resend(mux.Vars(r)["id"])
+	if err == ErrNotificationNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err == ErrNotificationNotFailed {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(NewNotificationInfo(n))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestOutbox(t *testing.T) (*Outbox, *MemoryJobRepository, func()) {
+	db, cleanup := newTestDB(t)
+	repo, err := NewBoltOutboxRepository(db)
+	require.Nil(t, err)
+	jobs := NewMemoryJobRepository()
+	outbox := NewOutbox(repo, jobs, &OutboxConfig{MaxAttempts: 3, Backoff: 10, MaxBackoff: 15})
+	return outbox, jobs, cleanup
+}
+
+func TestOutboxRetries(t *testing.T) {
+	outbox, jobs, cleanup := newTestOutbox(t)
+	defer cleanup()
+	now := time.Date(2016, 5, 8, 10, 0, 0, 0, time.UTC)
+	outbox.Now = func() time.Time { return now }
+	failures := 1
+	outbox.Sender = func(n *Notification) (string, error) {
+		if failures > 0 {
+			failures--
+			return "", errors.New("mailgun is down")
+		}
+		return "<20160508.1@mg.example.com>", nil
+	}
+	jobs.SaveJob(&DownloadVideo{Id: "job1", Status: JobDone})
+
+	assert.Nil(t, outbox.Enqueue(&Notification{JobIds: []string{"job1"}, To: "oskar@gmail.com", Subject: "listo"}))
+	next := outbox.DeliverDue()
+	assert.Equal(t, now.Add(10*time.Second), next)
+	pending, err := outbox.Repo.ListNotifications(NotificationPending)
+	assert.Nil(t, err)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, "mailgun is down", pending[0].LastError)
+
+	// not due yet
+	now = now.Add(5 * time.Second)
+	assert.Equal(t, next, outbox.DeliverDue())
+	now = now.Add(5 * time.Second)
+	assert.True(t, outbox.DeliverDue().IsZero())
+	n, err := outbox.Repo.GetNotification(pending[0].Id)
+	assert.Nil(t, err)
+	assert.Equal(t, NotificationSent, n.Status)
+	assert.Equal(t, 2, n.Attempts)
+	assert.Equal(t, []string{"<20160508.1@mg.example.com>"}, jobs.GetJob("job1").MessageIds)
+
+	// saving the job keeps them
+	jobs.SaveJob(&DownloadVideo{Id: "job1", Status: JobDone})
+	assert.Equal(t, []string{"<20160508.1@mg.example.com>"}, jobs.GetJob("job1").MessageIds)
+
+	// forgotten after the retention
+	now = now.Add(8 * 24 * time.Hour)
+	outbox.DeliverDue()
+	n, err = outbox.Repo.GetNotification(pending[0].Id)
+	assert.Nil(t, err)
+	assert.Nil(t, n)
+}
+
+func TestOutboxDeadLetter(t *testing.T) {
+	outbox, _, cleanup := newTestOutbox(t)
+	defer cleanup()
+	now := time.Date(2016, 5, 8, 10, 0, 0, 0, time.UTC)
+	outbox.Now = func() time.Time { return now }
+	sent := 0
+	outbox.Sender = func(n *Notification) (string, error) {
+		sent++
+		return "", errors.New("invalid recipient")
+	}
+
+	n := &Notification{To: "nobody@example.com", Subject: "listo"}
+	assert.Nil(t, outbox.Enqueue(n))
+	for i := 0; i < 5; i++ {
+		outbox.DeliverDue()
+		now = now.Add(time.Minute)
+	}
+	assert.Equal(t, 3, sent)
+	failed, err := outbox.Repo.ListNotifications(NotificationFailed)
+	assert.Nil(t, err)
+	assert.Len(t, failed, 1)
+	assert.Equal(t, 3, failed[0].Attempts)
+	assert.Equal(t, 15*time.Second, outbox.backoff(2))
+
+	resent, err := outbox.Resend(n.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, NotificationPending, resent.Status)
+	assert.Equal(t, 0, resent.Attempts)
+	_, err = outbox.Resend(n.Id)
+	assert.Equal(t, ErrNotificationNotFailed, err)
+	outbox.DeliverDue()
+	assert.Equal(t, 4, sent)
+	_, err = outbox.Resend(n.Id)
+	assert.Equal(t, ErrNotificationNotFailed, err)
+
+	_, err = outbox.Resend("asdf")
+	assert.Equal(t, ErrNotificationNotFound, err)
+
+	// forgotten after the retention too
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Minute)
+		outbox.DeliverDue()
+	}
+	failed, err = outbox.Repo.ListNotifications(NotificationFailed)
+	assert.Nil(t, err)
+	assert.Len(t, failed, 1)
+	now = now.Add(8 * 24 * time.Hour)
+	outbox.DeliverDue()
+	n, err = outbox.Repo.GetNotification(n.Id)
+	assert.Nil(t, err)
+	assert.Nil(t, n)
+}
+
+func TestOutboxResendDuringRound(t *testing.T) {
+	outbox, _, cleanup := newTestOutbox(t)
+	defer cleanup()
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	outbox.Sender = func(n *Notification) (string, error) {
+		close(sending)
+		<-release
+		return "<20160508.1@mg.example.com>", nil
+	}
+	failed := &Notification{Id: "failed1", To: "oskar@gmail.com", Status: NotificationFailed, Created: time.Now()}
+	require.Nil(t, outbox.Repo.SaveNotification(failed))
+	require.Nil(t, outbox.Enqueue(&Notification{To: "alma@wien.at", Subject: "listo"}))
+
+	done := make(chan struct{})
+	go func() {
+		outbox.DeliverDue()
+		close(done)
+	}()
+	<-sending
+	resent, err := outbox.Resend("failed1")
+	assert.Nil(t, err)
+	assert.Equal(t, NotificationPending, resent.Status)
+	close(release)
+	<-done
+}
+
+func TestBoltOutboxRepositoryDue(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	now := time.Date(2016, 5, 8, 10, 0, 0, 0, time.UTC)
+	// pending notifications stored before the index
+	require.Nil(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(outboxBucket)
+		if err != nil {
+			return err
+		}
+		for _, n := range []*Notification{
+			{Id: "n1", Status: NotificationPending, NextAttempt: now.Add(time.Minute)},
+			{Id: "n2", Status: NotificationPending, NextAttempt: now.Add(-time.Minute)},
+			{Id: "n3", Status: NotificationSent, NextAttempt: now.Add(-time.Hour)},
+		} {
+			v, err := json.Marshal(n)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(n.Id), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	repo, err := NewBoltOutboxRepository(db)
+	require.Nil(t, err)
+
+	due, next, err := repo.DueNotifications(now)
+	assert.Nil(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, "n2", due[0].Id)
+	assert.Equal(t, now.Add(time.Minute), next)
+
+	// saving moves them in the index
+	due[0].Status = NotificationSent
+	assert.Nil(t, repo.SaveNotification(due[0]))
+	n1, err := repo.GetNotification("n1")
+	require.Nil(t, err)
+	n1.NextAttempt = now
+	assert.Nil(t, repo.SaveNotification(n1))
+	due, next, err = repo.DueNotifications(now)
+	assert.Nil(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, "n1", due[0].Id)
+	assert.True(t, next.IsZero())
+	assert.Nil(t, repo.DeleteNotification("n1"))
+	due, _, err = repo.DueNotifications(now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Empty(t, due)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashPassword(t *testing.T) {
+	for _, algorithm := range []string{"bcrypt", "argon2id"} {
+		hash, err := HashPassword("secret", algorithm)
+		assert.Nil(t, err)
+		t.Logf("%s hash: %s", algorithm, hash)
+		assert.True(t, IsPasswordHash(hash))
+		assert.True(t, VerifyPassword(hash, "secret"))
+		assert.False(t, VerifyPassword(hash, "Secret"))
+		assert.False(t, VerifyPassword(hash, ""))
+	}
+	hash, err := HashPassword("secret", "argon2id")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=3,p=2$"))
+
+	_, err = HashPassword("secret", "md5")
+	assert.NotNil(t, err)
+}
+
+func TestVerifyPlaintextPassword(t *testing.T) {
+	assert.False(t, IsPasswordHash("secret"))
+	assert.True(t, VerifyPassword("secret", "secret"))
+	assert.False(t, VerifyPassword("secret", "secret2"))
+}
+
+func TestVerifyMalformedArgon2id(t *testing.T) {
+	assert.False(t, VerifyPassword("$argon2id$v=19$m=65536,t=3,p=2$bad", "secret"))
+	assert.False(t, VerifyPassword("$argon2id$v=18$m=65536,t=3,p=2$c2FsdA$a2V5", "secret"))
+	// would panic, take all the memory or match any password
+	assert.False(t, VerifyPassword("$argon2id$v=19$m=65536,t=0,p=2$c2FsdA$a2V5", "secret"))
+	assert.False(t, VerifyPassword("$argon2id$v=19$m=65536,t=3,p=0$c2FsdA$a2V5", "secret"))
+	assert.False(t, VerifyPassword("$argon2id$v=19$m=4294967295,t=3,p=2$c2FsdA$a2V5", "secret"))
+	assert.False(t, VerifyPassword("$argon2id$v=19$m=65536,t=3,p=2$c2FsdA$", "secret"))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/justinas/alice"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+var roles = []string{RoleUser, RoleAdmin}
+
+// limits of the users with a role
+type RoleConfig struct {
+	MaxConcurrent int "maxConcurrent" // jobs running at the same time, 0 = unlimited
+	DailyQuota    int "dailyQuota"    // jobs in the last 24 hours, 0 = unlimited
+}
+
+// QuotaError is returned when an user can't start more jobs
+type QuotaError struct {
+	Reason string
+}
+
+func (e *QuotaError) Error() string {
+	return e.Reason
+}
+
+func ValidRole(role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRole returns the role of the account, user if it has none
+func (account *ConfigUser) GetRole() string {
+	if account.Role == "" {
+		return RoleUser
+	}
+	return account.Role
+}
+
+// HasRole tells if the authenticated user of r has role, both in the token
+// claims and in the account (so a demoted user loses access before the token
+// expires)
+func HasRole(r *http.Request, role string) bool {
+	claimRole, _ := context.Get(r, "role").(string)
+	account, _ := context.Get(r, "account").(*ConfigUser)
+	return account != nil && claimRole == role && account.GetRole() == role
+}
+
+// RequireRole returns a middleware (after AuthenticationHandler) that only
+// lets through users with role
+func (s *HttpServer) RequireRole(role string) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if !HasRole(r, role) {
+				http.Error(w, fmt.Sprintf("%s role required", role), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// AddJob saves a new job of account, if the limits of its role allow it. The
+// check and the save are atomic, so parallel requests can't exceed them.
+func (s *HttpServer) AddJob(account *ConfigUser, video *DownloadVideo) error {
+	role := account.GetRole()
+	limits, ok := s.Settings().Roles[role]
+	if !ok || (limits.MaxConcurrent == 0 && limits.DailyQuota == 0) {
+		s.Jobs.SaveJob(video)
+		return nil
+	}
+	return s.Jobs.AddJob(video, func(jobs []*DownloadVideo) error {
+		return checkQuota(jobs, role, limits)
+	})
+}
+
+// checkQuota checks the limits of a role against the jobs of an user
+func checkQuota(jobs []*DownloadVideo, role string, limits RoleConfig) error {
+	running, today := 0, 0
+	since := time.Now().Add(-24 * time.Hour)
+	for _, job := range jobs {
+		if !job.Finished() {
+			running++
+		}
+		if job.Created.After(since) {
+			today++
+		}
+	}
+	if limits.MaxConcurrent > 0 && running >= limits.MaxConcurrent {
+		return &QuotaError{fmt.Sprintf("%d jobs running, the limit for role %s is %d", running, role, limits.MaxConcurrent)}
+	}
+	if limits.DailyQuota > 0 && today >= limits.DailyQuota {
+		return &QuotaError{fmt.Sprintf("%d jobs in the last 24 hours, the limit for role %s is %d", today, role, limits.DailyQuota)}
+	}
+	return nil
+}
+
+// HandleReloadConfig reads the config file again, applying the limits, roles
+// and url policy (the rest needs a restart)
+func (s *HttpServer) HandleReloadConfig(w http.ResponseWriter, r *http.Request) {
+	if s.ConfigFile == "" {
+		http.Error(w, "no config file to reload", http.StatusInternalServerError)
+		return
+	}
+	config, err := LoadConfig(s.ConfigFile)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error loading config from %s: %s", s.ConfigFile, err), http.StatusInternalServerError)
+		return
+	}
+	if err := config.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("invalid config %s, %s", s.ConfigFile, err), http.StatusInternalServerError)
+		return
+	}
+	s.ApplyConfig(config)
+	log.Info("config reloaded from %s", s.ConfigFile)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "reloaded"})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// environment variables youtube-dl keeps (the rest, including our secrets,
+// are removed)
+var sandboxEnv = []string{"PATH", "LANG", "LC_ALL", "TZ"}
+
+type SandboxConfig struct {
+	WorkDir   string   "workDir"   // jobs run in <workDir>/<job id>, defaults to a directory in $TMPDIR
+	Timeout   int      "timeout"   // seconds, the whole process tree is killed after it
+	CPUTime   uint64   "cpuTime"   // seconds (RLIMIT_CPU)
+	Memory    uint64   "memory"    // bytes of address space (RLIMIT_AS)
+	FileSize  uint64   "fileSize"  // bytes per file (RLIMIT_FSIZE)
+	User      string   "user"      // run youtube-dl as this user
+	PassEnv   []string "passEnv"   // extra variables kept from our environment (LANG, ...)
+	Env       []string "env"       // extra variables, NAME=value
+	ProxyPort int      "proxyPort" // of 127.0.0.1, for the proxy youtube-dl connects through; random if 0
+}
+
+// Sandbox runs youtube-dl in a restricted environment. Resource limits,
+// process groups and users are only supported on linux.
+type Sandbox struct {
+	SandboxConfig
+	Uid, Gid int // -1 to keep ours
+}
+
+func NewSandbox(config *SandboxConfig) (*Sandbox, error) {
+	sb := &Sandbox{SandboxConfig: *config, Uid: -1, Gid: -1}
+	if sb.WorkDir == "" {
+		sb.WorkDir = filepath.Join(os.TempDir(), "yutubaas-jobs")
+	}
+	if sb.User != "" {
+		u, err := user.Lookup(sb.User)
+		if err != nil {
+			return nil, err
+		}
+		if sb.Uid, err = strconv.Atoi(u.Uid); err != nil {
+			return nil, err
+		}
+		if sb.Gid, err = strconv.Atoi(u.Gid); err != nil {
+			return nil, err
+		}
+	}
+	if err := sb.checkRlimits(); err != nil {
+		return nil, err
+	}
+	// the user of the sandbox goes through it to the job directories (its
+	// own), without listing the others
+	if err := os.MkdirAll(sb.WorkDir, 0711); err != nil {
+		return nil, err
+	}
+	if sb.Uid != -1 {
+		if err := os.Chmod(sb.WorkDir, 0711); err != nil {
+			return nil, err
+		}
+	}
+	return sb, nil
+}
+
+// JobDir creates the working directory of a job
+func (sb *Sandbox) JobDir(id string) (string, error) {
+	dir := filepath.Join(sb.WorkDir, id)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	if sb.Uid != -1 {
+		if err := os.Chown(dir, sb.Uid, sb.Gid); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// Command returns the command to run in dir (or in WorkDir if empty), with
+// the resource limits
+func (sb *Sandbox) Command(dir string, name string, args ...string) *exec.Cmd {
+	name, args = sb.limitCommand(name, args)
+	cmd := exec.Command(name, args...)
+	if dir == "" {
+		dir = sb.WorkDir
+	}
+	cmd.Dir = dir
+	cmd.Env = []string{fmt.Sprintf("HOME=%s", dir)}
+	for _, name := range append(sandboxEnv, sb.PassEnv...) {
+		if value, ok := os.LookupEnv(name); ok {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+	cmd.Env = append(cmd.Env, sb.Env...)
+	sb.setSysProcAttr(cmd)
+	return cmd
+}
+
+// Start starts cmd, a command of the sandbox
+func (sb *Sandbox) Start(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
+
+// Wait waits for cmd, killing its whole process group after Timeout
+func (sb *Sandbox) Wait(cmd *exec.Cmd) error {
+	if sb.Timeout == 0 {
+		return cmd.Wait()
+	}
+	var mu sync.Mutex
+	timedOut := false
+	timer := time.AfterFunc(time.Duration(sb.Timeout)*time.Second, func() {
+		mu.Lock()
+		timedOut = true
+		mu.Unlock()
+		killProcessGroup(cmd)
+	})
+	err := cmd.Wait()
+	timer.Stop()
+	mu.Lock()
+	defer mu.Unlock()
+	if timedOut {
+		return fmt.Errorf("%s timed out after %ds", commandName(cmd), sb.Timeout)
+	}
+	return err
+}
+
+// commandName returns the name of the command cmd runs, after prlimit
+func commandName(cmd *exec.Cmd) string {
+	for i, arg := range cmd.Args {
+		if arg == "--" && filepath.Base(cmd.Path) == "prlimit" && i+1 < len(cmd.Args) {
+			return filepath.Base(cmd.Args[i+1])
+		}
+	}
+	return filepath.Base(cmd.Path)
+}
+
+func (sb *Sandbox) Run(cmd *exec.Cmd) error {
+	if err := sb.Start(cmd); err != nil {
+		return err
+	}
+	return sb.Wait(cmd)
+}
+
+// Output runs cmd and returns its standard output
+func (sb *Sandbox) Output(cmd *exec.Cmd) ([]byte, error) {
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	err := sb.Run(cmd)
+	return stdout.Bytes(), err
+}
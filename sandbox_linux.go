@@ -0,0 +1,56 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+func (sb *Sandbox) setSysProcAttr(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	// own process group, to kill youtube-dl and its children (ffmpeg) at once
+	cmd.SysProcAttr.Setpgid = true
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+	if sb.Uid != -1 {
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(sb.Uid), Gid: uint32(sb.Gid)}
+	}
+}
+
+// checkRlimits checks that prlimit, which applies the limits, is installed
+func (sb *Sandbox) checkRlimits() error {
+	if sb.CPUTime == 0 && sb.Memory == 0 && sb.FileSize == 0 {
+		return nil
+	}
+	if _, err := exec.LookPath("prlimit"); err != nil {
+		return fmt.Errorf("the resource limits of the sandbox need prlimit (util-linux): %s", err)
+	}
+	return nil
+}
+
+// limitCommand returns name and args run by prlimit, which sets the limits
+// before executing it (the children it creates inherit them)
+func (sb *Sandbox) limitCommand(name string, args []string) (string, []string) {
+	var limits []string
+	if sb.CPUTime != 0 {
+		limits = append(limits, fmt.Sprintf("--cpu=%d", sb.CPUTime))
+	}
+	if sb.Memory != 0 {
+		limits = append(limits, fmt.Sprintf("--as=%d", sb.Memory))
+	}
+	if sb.FileSize != 0 {
+		limits = append(limits, fmt.Sprintf("--fsize=%d", sb.FileSize))
+	}
+	if len(limits) == 0 {
+		return name, args
+	}
+	return "prlimit", append(append(limits, "--", name), args...)
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		log.Error("error killing process group %d: %s", cmd.Process.Pid, err)
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os/exec"
+)
+
+func (sb *Sandbox) setSysProcAttr(cmd *exec.Cmd) {
+	if sb.Uid != -1 {
+		log.Warning("running youtube-dl as %s is only supported on linux", sb.User)
+	}
+}
+
+func (sb *Sandbox) checkRlimits() error {
+	if sb.CPUTime != 0 || sb.Memory != 0 || sb.FileSize != 0 {
+		log.Warning("resource limits for youtube-dl are only supported on linux")
+	}
+	return nil
+}
+
+func (sb *Sandbox) limitCommand(name string, args []string) (string, []string) {
+	return name, args
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	if err := cmd.Process.Kill(); err != nil {
+		log.Error("error killing process %d: %s", cmd.Process.Pid, err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSandboxEnv(t *testing.T) {
+	os.Setenv("YUTUBAAS_TEST_SECRET", "secret")
+	defer os.Unsetenv("YUTUBAAS_TEST_SECRET")
+
+	sandbox, err := NewSandbox(&SandboxConfig{Env: []string{"FOO=bar"}})
+	assert.Nil(t, err)
+	out, err := sandbox.Output(sandbox.Command("", "env"))
+	assert.Nil(t, err)
+	env := string(out)
+	assert.False(t, strings.Contains(env, "YUTUBAAS_TEST_SECRET"))
+	assert.True(t, strings.Contains(env, "FOO=bar\n"))
+	assert.True(t, strings.Contains(env, "HOME="+sandbox.WorkDir+"\n"))
+}
+
+func TestSandboxTimeout(t *testing.T) {
+	sandbox, err := NewSandbox(&SandboxConfig{Timeout: 1})
+	assert.Nil(t, err)
+	start := time.Now()
+	// the child sleep must be killed too
+	err = sandbox.Run(sandbox.Command("", "sh", "-c", "sleep 10; echo done"))
+	assert.Equal(t, "sh timed out after 1s", err.Error())
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestSandboxWorkDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yutubaas-sandbox")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	sandbox, err := NewSandbox(&SandboxConfig{WorkDir: filepath.Join(dir, "jobs")})
+	assert.Nil(t, err)
+	// the user of the sandbox can get to its job directories
+	info, err := os.Stat(sandbox.WorkDir)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0711), info.Mode().Perm())
+	jobDir, err := sandbox.JobDir("job1")
+	assert.Nil(t, err)
+	info, err = os.Stat(jobDir)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+}
+
+func TestSandboxRlimits(t *testing.T) {
+	if _, err := exec.LookPath("prlimit"); runtime.GOOS != "linux" || err != nil {
+		t.Skip("resource limits need linux and prlimit")
+	}
+	sandbox, err := NewSandbox(&SandboxConfig{Timeout: 1, CPUTime: 7, FileSize: 4096})
+	assert.Nil(t, err)
+	// set before youtube-dl starts, not after
+	out, err := sandbox.Output(sandbox.Command("", "sh", "-c", "ulimit -t; ulimit -f"))
+	assert.Nil(t, err)
+	assert.Equal(t, "7\n8\n", string(out))
+
+	err = sandbox.Run(sandbox.Command("", "sh", "-c", "sleep 10"))
+	assert.Equal(t, "sh timed out after 1s", err.Error())
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"gopkg.in/dgrijalva/jwt-go.v2"
@@ -22,35 +25,79 @@ func (s *HttpServer) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	// rate limit the guesses
+	ip := s.LoginGuard.ClientIP(r)
+	if wait := s.LoginGuard.Check(credentials.Username, ip); wait > 0 {
+		seconds := int((wait + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		http.Error(w, fmt.Sprintf("too many failed logins, retry in %d seconds", seconds), http.StatusTooManyRequests)
+		return
+	}
 	// check credentials
-	if account, ok := s.Accounts[credentials.Username]; ok {
-		if account.Password != credentials.Password {
-			http.Error(w, "wrong username/password", http.StatusUnauthorized)
-			return
-		}
-	} else {
+	account, err := s.Accounts.GetUser(credentials.Username)
+	if err != nil {
+		s.LoginGuard.Release(credentials.Username, ip)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// accounts without password only log in with OpenID Connect. Unknown
+	// users check a dummy hash, to answer as slow as a wrong password.
+	if account == nil || account.Disabled || account.Password == "" {
+		VerifyPassword(dummyPasswordHash(), credentials.Password)
+		account = nil
+	} else if !VerifyPassword(account.Password, credentials.Password) {
+		account = nil
+	}
+	if account == nil {
+		s.LoginGuard.Fail(credentials.Username, ip)
 		http.Error(w, "wrong username/password", http.StatusUnauthorized)
 		return
 	}
-	// Create the token
-	token, err := GenerateToken(&credentials, time.Hour*3, s.HS256key)
+	s.LoginGuard.Success(credentials.Username, ip)
+	// Create the tokens
+	response, err := s.IssueTokens(account, "")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	// copy response to original request
 	w.Header().Set("Content-Type", "application/json")
-	response := make(map[string]string)
-	response["token"] = token
 	json.NewEncoder(w).Encode(response)
 }
 
-func GenerateToken(credentials *Credentials, expiration time.Duration, key []byte) (string, error) {
-	token := jwt.New(jwt.SigningMethodHS256)
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// dummyPasswordHash returns a hash of a random password, to verify the
+// logins of unknown users
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		password, err := randomHex(16)
+		if err == nil {
+			dummyHash, err = HashPassword(password, "bcrypt")
+		}
+		if err != nil {
+			log.Error("error creating dummy password hash: %s", err)
+		}
+	})
+	return dummyHash
+}
+
+func GenerateToken(account *ConfigUser, expiration time.Duration, keys *KeySet) (string, error) {
+	jti, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	token := jwt.New(keys.Current.Method)
 	// Set some claims
-	token.Claims["sub"] = credentials.Username
-	token.Claims["it"] = time.Now().Unix()
-	token.Claims["exp"] = time.Now().Add(expiration).Unix()
+	token.Claims["sub"] = account.Username
+	token.Claims["role"] = account.GetRole()
+	token.Claims["jti"] = jti // to revoke it
+	token.Claims["iat"] = now.Unix()
+	token.Claims["exp"] = now.Add(expiration).Unix()
 	// Sign and get the complete encoded token as a string
-	return token.SignedString(key)
+	return keys.Sign(token)
 }
@@ -6,12 +6,26 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/dgrijalva/jwt-go.v2"
 )
 
 func TestGenerateToken(t *testing.T) {
-	credentials := &Credentials{"jriquelme", "secret"}
-	key := []byte(strings.Repeat("s", 256))
-	token, err := GenerateToken(credentials, 2*time.Hour, key)
+	account := &ConfigUser{Username: "jriquelme", Role: RoleAdmin}
+	keys, err := NewKeySet(&SigningConfig{}, []byte(strings.Repeat("s", 256)))
+	assert.Nil(t, err)
+	token, err := GenerateToken(account, 2*time.Hour, keys)
 	assert.Nil(t, err)
 	t.Logf("token: %s", token)
+
+	parsed, err := jwt.Parse(token, keys.Keyfunc)
+	assert.Nil(t, err)
+	assert.Equal(t, "jriquelme", parsed.Claims["sub"])
+	assert.Equal(t, RoleAdmin, parsed.Claims["role"])
+	assert.NotEmpty(t, parsed.Claims["jti"])
+	assert.InDelta(t, time.Now().Unix(), parsed.Claims["iat"], 5)
+	assert.InDelta(t, time.Now().Add(2*time.Hour).Unix(), parsed.Claims["exp"], 5)
+
+	other, err := GenerateToken(account, 2*time.Hour, keys)
+	assert.Nil(t, err)
+	assert.NotEqual(t, token, other)
 }
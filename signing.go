@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sort"
+
+	"gopkg.in/dgrijalva/jwt-go.v2"
+)
+
+type SigningConfig struct {
+	Keys    []SigningKeyConfig "keys"
+	Current string             "current" // kid of the key signing new tokens, the first private key by default
+}
+
+type SigningKeyConfig struct {
+	Kid        string "kid"
+	Algorithm  string "algorithm"  // RS256 or ES256
+	PrivateKey string "privateKey" // PEM file, only for the keys signing tokens
+	PublicKey  string "publicKey"  // PEM file, for keys only verifying tokens (after a rotation)
+}
+
+// SigningKey signs or verifies tokens with a single algorithm
+type SigningKey struct {
+	Kid     string
+	Method  jwt.SigningMethod
+	Private interface{} // nil if it only verifies
+	Public  interface{}
+}
+
+// KeySet has the keys accepted in tokens, by kid. The HS256 key of the
+// config (if any) has no kid, for the tokens issued before the rotation to
+// asymmetric keys.
+type KeySet struct {
+	Keys    map[string]*SigningKey
+	Current *SigningKey
+}
+
+// NewKeySet loads the keys of the config. Without keys, tokens are signed
+// with hs256key.
+func NewKeySet(config *SigningConfig, hs256key []byte) (*KeySet, error) {
+	keys := &KeySet{Keys: make(map[string]*SigningKey)}
+	if len(hs256key) > 0 {
+		keys.Keys[""] = &SigningKey{"", jwt.SigningMethodHS256, hs256key, hs256key}
+		keys.Current = keys.Keys[""]
+	}
+	defaultKey := true // still the HS256 key or none
+	for i, keyConfig := range config.Keys {
+		if keyConfig.Kid == "" {
+			return nil, fmt.Errorf("missing kid in signing key %d", i)
+		}
+		if _, ok := keys.Keys[keyConfig.Kid]; ok {
+			return nil, fmt.Errorf("duplicated signing key %s", keyConfig.Kid)
+		}
+		key, err := LoadSigningKey(&keyConfig)
+		if err != nil {
+			return nil, fmt.Errorf("error loading signing key %s: %s", keyConfig.Kid, err)
+		}
+		keys.Keys[key.Kid] = key
+		if (config.Current == "" && defaultKey && key.Private != nil) || config.Current == key.Kid {
+			keys.Current = key
+			defaultKey = false
+		}
+	}
+	if config.Current != "" && defaultKey {
+		return nil, fmt.Errorf("unknown current signing key %s", config.Current)
+	}
+	if keys.Current == nil {
+		return nil, fmt.Errorf("no signing keys, set hs256key or signing.keys")
+	}
+	if keys.Current.Private == nil {
+		return nil, fmt.Errorf("current signing key %s has no private key", keys.Current.Kid)
+	}
+	return keys, nil
+}
+
+func LoadSigningKey(config *SigningKeyConfig) (*SigningKey, error) {
+	key := &SigningKey{Kid: config.Kid}
+	file := config.PrivateKey
+	if file == "" {
+		file = config.PublicKey
+	}
+	if file == "" {
+		return nil, fmt.Errorf("missing privateKey or publicKey")
+	}
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	switch config.Algorithm {
+	case "RS256":
+		key.Method = jwt.SigningMethodRS256
+		if config.PrivateKey != "" {
+			private, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			key.Private, key.Public = private, &private.PublicKey
+		} else if key.Public, err = jwt.ParseRSAPublicKeyFromPEM(pem); err != nil {
+			return nil, err
+		}
+	case "ES256":
+		key.Method = jwt.SigningMethodES256
+		var public *ecdsa.PublicKey
+		if config.PrivateKey != "" {
+			private, err := jwt.ParseECPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			key.Private, public = private, &private.PublicKey
+		} else if public, err = jwt.ParseECPublicKeyFromPEM(pem); err != nil {
+			return nil, err
+		}
+		if public.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ES256 needs a P-256 key")
+		}
+		key.Public = public
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", config.Algorithm)
+	}
+	return key, nil
+}
+
+// Sign signs token with the current key
+func (keys *KeySet) Sign(token *jwt.Token) (string, error) {
+	token.Method = keys.Current.Method
+	token.Header["alg"] = keys.Current.Method.Alg()
+	if keys.Current.Kid != "" {
+		token.Header["kid"] = keys.Current.Kid
+	}
+	return token.SignedString(keys.Current.Private)
+}
+
+// Keyfunc returns the key to verify token, only if its alg is the one of the
+// key with its kid (so a public key is never used as an HMAC secret)
+func (keys *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := keys.Keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method == nil || token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+	return key.Public, nil
+}
+
+// JSON Web Key, only public keys
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS returns the asymmetric keys, for other services verifying our tokens
+func (keys *KeySet) JWKS() []*JWK {
+	jwks := []*JWK{}
+	for _, key := range keys.Keys {
+		jwk := &JWK{Kid: key.Kid, Use: "sig", Alg: key.Method.Alg()}
+		switch public := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			jwk.Kty = "EC"
+			jwk.Crv = "P-256"
+			jwk.X = base64.RawURLEncoding.EncodeToString(padCoordinate(public.X))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(padCoordinate(public.Y))
+		default:
+			continue // the HS256 secret
+		}
+		jwks = append(jwks, jwk)
+	}
+	sort.Slice(jwks, func(i, j int) bool { return jwks[i].Kid < jwks[j].Kid })
+	return jwks
+}
+
+// P-256 coordinates are always 32 bytes in a JWK
+func padCoordinate(n *big.Int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+func (s *HttpServer) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]*JWK{"keys": s.Keys.JWKS()})
+}
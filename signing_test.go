@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dgrijalva/jwt-go.v2"
+)
+
+// writes a RSA and an EC key pair to dir, returning the PEM of the RSA public
+// key
+func writeTestKeys(t *testing.T, dir string) []byte {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	rsaPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "rsa.pem"), rsaPem, 0600))
+	public, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.Nil(t, err)
+	rsaPublicPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "rsa.pub.pem"), rsaPublicPem, 0600))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	assert.Nil(t, err)
+	ecPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "ec.pem"), ecPem, 0600))
+	return rsaPublicPem
+}
+
+func TestKeySet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yutubaas-keys")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	rsaPublicPem := writeTestKeys(t, dir)
+
+	config := &SigningConfig{Keys: []SigningKeyConfig{
+		{Kid: "2016-01", Algorithm: "RS256", PrivateKey: filepath.Join(dir, "rsa.pem")},
+		{Kid: "2016-02", Algorithm: "ES256", PrivateKey: filepath.Join(dir, "ec.pem")},
+	}}
+	keys, err := NewKeySet(config, []byte("secret"))
+	assert.Nil(t, err)
+	assert.Equal(t, "2016-01", keys.Current.Kid)
+	account := &ConfigUser{Username: "oskar"}
+	rsaToken, err := GenerateToken(account, time.Hour, keys)
+	assert.Nil(t, err)
+	parsed, err := jwt.Parse(rsaToken, keys.Keyfunc)
+	assert.Nil(t, err)
+	assert.Equal(t, "RS256", parsed.Header["alg"])
+	assert.Equal(t, "2016-01", parsed.Header["kid"])
+
+	// rotate, the old tokens are still valid
+	config.Current = "2016-02"
+	keys, err = NewKeySet(config, []byte("secret"))
+	assert.Nil(t, err)
+	ecToken, err := GenerateToken(account, time.Hour, keys)
+	assert.Nil(t, err)
+	parsed, err = jwt.Parse(ecToken, keys.Keyfunc)
+	assert.Nil(t, err)
+	assert.Equal(t, "ES256", parsed.Header["alg"])
+	_, err = jwt.Parse(rsaToken, keys.Keyfunc)
+	assert.Nil(t, err)
+
+	// only public keys in the JWKS
+	jwks := keys.JWKS()
+	assert.Equal(t, 2, len(jwks))
+	assert.Equal(t, "RSA", jwks[0].Kty)
+	assert.Equal(t, "AQAB", jwks[0].E)
+	assert.Equal(t, "EC", jwks[1].Kty)
+	assert.Equal(t, "P-256", jwks[1].Crv)
+
+	// alg confusion: HS256 with the RSA public key as secret
+	forged := jwt.New(jwt.SigningMethodHS256)
+	forged.Header["kid"] = "2016-01"
+	forged.Claims["sub"] = "jriquelme"
+	forgedToken, err := forged.SignedString(rsaPublicPem)
+	assert.Nil(t, err)
+	_, err = jwt.Parse(forgedToken, keys.Keyfunc)
+	assert.NotNil(t, err)
+
+	forged.Header["kid"] = "unknown"
+	forgedToken, err = forged.SignedString([]byte("secret"))
+	assert.Nil(t, err)
+	_, err = jwt.Parse(forgedToken, keys.Keyfunc)
+	assert.NotNil(t, err)
+}
+
+func TestKeySetErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yutubaas-keys")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeTestKeys(t, dir)
+
+	_, err = NewKeySet(&SigningConfig{}, nil)
+	assert.Equal(t, "no signing keys, set hs256key or signing.keys", err.Error())
+
+	// a verification only key can't sign
+	config := &SigningConfig{Keys: []SigningKeyConfig{
+		{Kid: "old", Algorithm: "RS256", PublicKey: filepath.Join(dir, "rsa.pub.pem")},
+	}}
+	_, err = NewKeySet(config, nil)
+	assert.Equal(t, "no signing keys, set hs256key or signing.keys", err.Error())
+	config.Current = "old"
+	_, err = NewKeySet(config, nil)
+	assert.Equal(t, "current signing key old has no private key", err.Error())
+	config.Current = ""
+	keys, err := NewKeySet(config, []byte("secret"))
+	assert.Nil(t, err)
+	assert.Equal(t, "", keys.Current.Kid)
+
+	config = &SigningConfig{Keys: []SigningKeyConfig{
+		{Kid: "ec", Algorithm: "RS256", PrivateKey: filepath.Join(dir, "ec.pem")},
+	}}
+	_, err = NewKeySet(config, nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// OpenDatabase opens (or creates) the bolt database at path
+func OpenDatabase(path string) (*bolt.DB, error) {
+	if path == "" {
+		path = "yutubaas.db"
+	}
+	return bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+}
+
+// deleteUserValues deletes the values (json with a Username) of username from
+// bucket
+func deleteUserValues(db *bolt.DB, bucket []byte, username string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		var keys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			value := struct{ Username string }{}
+			if err := json.Unmarshal(v, &value); err != nil {
+				return err
+			}
+			if value.Username == username {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
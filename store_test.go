@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDBFile returns the path of an empty temporary database, and a
+// function removing it
+func newTestDBFile(t *testing.T) (string, func()) {
+	dbFile, err := ioutil.TempFile("", "yutubaas-db")
+	require.Nil(t, err)
+	dbFile.Close()
+	return dbFile.Name(), func() {
+		os.Remove(dbFile.Name())
+	}
+}
+
+// newTestDB opens a temporary database, returning a function closing and
+// removing it
+func newTestDB(t *testing.T) (*bolt.DB, func()) {
+	path, remove := newTestDBFile(t)
+	db, err := OpenDatabase(path)
+	if err != nil {
+		remove()
+	}
+	require.Nil(t, err)
+	return db, func() {
+		db.Close()
+		remove()
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// the templates of the emails sent to users
+const (
+	TemplateSuccess   = "success"   // a video is ready, with a *DownloadVideo
+	TemplateError     = "error"     // a download failed, *DownloadVideo
+	TemplateCancelled = "cancelled" // a download was cancelled, *DownloadVideo
+	TemplateDigest    = "digest"    // several finished downloads, *NotificationDigest
+	TemplateSummary   = "summary"   // the reply to an email request, *MailReply
+	TemplateConfirm   = "confirm"   // the code to verify an address, *EmailConfirmation
+)
+
+// MailTemplates renders the emails sent to users in their language. The
+// templates are read from Dir/<language>/<name>.txt, the plain text body with
+// a {{define "subject"}}, and the optional html body <name>.html. A template
+// missing for a language is taken from its base language (es for es-cl),
+// then from the default Language and finally from the builtin ones (Spanish,
+// plain text).
+type MailTemplates struct {
+	Dir      string
+	Language string // default, for users without a language
+
+	locales map[string]map[string]*mailTemplate // by language and name
+	builtin map[string]*mailTemplate
+}
+
+type mailTemplate struct {
+	Text *template.Template
+	Html *htmltemplate.Template // nil for plain text emails
+}
+
+// MailContent is a rendered email
+type MailContent struct {
+	Subject string
+	Text    string
+	Html    string // empty for plain text emails
+}
+
+var mailTemplateFuncs = map[string]interface{}{
+	"duration":  func(d time.Duration) string { return FormatTimestamp(int64(d.Seconds())) },
+	"size":      FormatSize,
+	"timestamp": FormatTimestamp,
+	"join":      strings.Join,
+}
+
+func NewMailTemplates(dir string, language string) (*MailTemplates, error) {
+	templates := &MailTemplates{Dir: dir, Language: language}
+	if templates.Language == "" {
+		templates.Language = "es"
+	}
+	templates.builtin = make(map[string]*mailTemplate)
+	for name, text := range builtinMailTemplates {
+		t, err := template.New(name).Funcs(mailTemplateFuncs).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		templates.builtin[name] = &mailTemplate{Text: t}
+	}
+	templates.locales = make(map[string]map[string]*mailTemplate)
+	if dir == "" {
+		return templates, nil
+	}
+	dirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		locale, err := loadMailTemplates(filepath.Join(dir, d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		templates.locales[normalizeLanguage(d.Name())] = locale
+	}
+	return templates, nil
+}
+
+// loadMailTemplates parses the templates of a language directory
+func loadMailTemplates(dir string) (map[string]*mailTemplate, error) {
+	locale := make(map[string]*mailTemplate)
+	texts, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range texts {
+		name := strings.TrimSuffix(filepath.Base(file), ".txt")
+		t, err := template.New(filepath.Base(file)).Funcs(mailTemplateFuncs).ParseFiles(file)
+		if err != nil {
+			return nil, err
+		}
+		locale[name] = &mailTemplate{Text: t}
+	}
+	htmls, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range htmls {
+		name := strings.TrimSuffix(filepath.Base(file), ".html")
+		if locale[name] == nil {
+			return nil, fmt.Errorf("%s without %s.txt", file, name)
+		}
+		t, err := htmltemplate.New(filepath.Base(file)).Funcs(mailTemplateFuncs).ParseFiles(file)
+		if err != nil {
+			return nil, err
+		}
+		locale[name].Html = t
+	}
+	return locale, nil
+}
+
+// Locales returns the languages tried for an user with language, in order
+func (templates *MailTemplates) Locales(language string) []string {
+	var locales []string
+	for _, l := range []string{language, templates.Language} {
+		for l = normalizeLanguage(l); l != ""; {
+			if !containsString(locales, l) {
+				locales = append(locales, l)
+			}
+			i := strings.LastIndex(l, "-")
+			if i < 0 {
+				break
+			}
+			l = l[:i]
+		}
+	}
+	return locales
+}
+
+// Render executes the template name in the language of the user
+func (templates *MailTemplates) Render(name string, language string, data interface{}) (*MailContent, error) {
+	t := templates.builtin[name]
+	for _, locale := range templates.Locales(language) {
+		if found, ok := templates.locales[locale][name]; ok {
+			t = found
+			break
+		}
+	}
+	if t == nil {
+		return nil, fmt.Errorf("missing mail template %s", name)
+	}
+	content := &MailContent{}
+	buf := &bytes.Buffer{}
+	if t.Text.Lookup("subject") != nil {
+		if err := t.Text.ExecuteTemplate(buf, "subject", data); err != nil {
+			return nil, err
+		}
+	}
+	content.Subject = strings.TrimSpace(buf.String())
+	buf.Reset()
+	if err := t.Text.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	content.Text = buf.String()
+	if t.Html != nil {
+		buf.Reset()
+		if err := t.Html.Execute(buf, data); err != nil {
+			return nil, err
+		}
+		content.Html = buf.String()
+	}
+	return content, nil
+}
+
+// normalizeLanguage writes language tags as the directories of the
+// templates: es_CL and es-CL are es-cl
+func normalizeLanguage(language string) string {
+	return strings.ToLower(strings.Replace(language, "_", "-", -1))
+}
+
+// FormatSize writes a size in bytes for people
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// used without a templates directory, and for the templates it lacks
+var builtinMailTemplates = map[string]string{
+	TemplateSuccess: `{{define "subject"}}{{.Name}}, tu video {{.Title}} está listo{{end}}
+Hola {{.Name}}:
+
+Tu video "{{.Title}}" está listo, puedes descargarlo desde {{.DstUrl}}{{if not .Expires.IsZero}} hasta el {{.Expires.Format "02/01/2006 15:04"}}{{end}}.
+{{if .Duration}}
+Duración: {{duration .Duration}}{{end}}{{if .FileSize}}
+Tamaño: {{size .FileSize}}{{end}}
+
+saludos`,
+	TemplateError: `{{define "subject"}}{{.Name}}, hubo un error en la descarga de {{or .Title .SrcUrl}} :({{end}}
+Hola {{.Name}}:
+
+Hubo un error al descargar el video "{{.SrcUrl}}": {{.Error}}
+{{if .ErrorLines}}
+Últimos mensajes de error:
+{{range .ErrorLines}}
+  {{.}}{{end}}
+{{end}}
+
+saludos`,
+	TemplateCancelled: `{{define "subject"}}{{.Name}}, cancelamos la descarga de {{or .Title .SrcUrl}}{{end}}
+Hola {{.Name}}:
+
+La descarga del video "{{or .Title .SrcUrl}}" fue cancelada.
+
+saludos`,
+	TemplateDigest: `{{define "subject"}}{{.Name}}, terminaron {{len .Jobs}} descargas{{end}}
+Hola {{.Name}}:
+{{with .Done}}
+Videos listos:
+{{range .}}
+  {{.Title}}: {{.DstUrl}}{{if not .Expires.IsZero}} (hasta el {{.Expires.Format "02/01/2006 15:04"}}){{end}}{{end}}
+{{end}}{{with .Failed}}
+Descargas que no terminaron:
+{{range .}}
+  {{.SrcUrl}}: {{.Error}}{{end}}
+{{end}}
+saludos`,
+	TemplateSummary: `{{define "subject"}}{{if .Subject}}{{.ReplySubject}}{{else}}Re: tu solicitud de descarga{{end}}{{end}}
+Hola {{.Name}}:
+{{if .Error}}
+No pudimos procesar tu mensaje: {{template "error" .Error}}
+
+Para descargar videos, envía un email desde la dirección de tu cuenta con sus urls,
+y opcionalmente una línea por opción:
+
+  https://www.youtube.com/watch?v=bS5P_LAqiVg
+  audio                   (solo el audio, en mp3)
+  720p                    (resolución máxima)
+  from 1:30 to 4:00       (solo ese tramo)
+  subs es,en              (subtítulos)
+{{else}}
+Recibimos tu mensaje{{if not .Options.IsZero}} (opciones: {{template "options" .Options}}){{end}}:
+{{range .Jobs}}
+  {{.SrcUrl}}: {{if .Error}}rechazado, {{.Error}}{{else}}en cola{{end}}{{end}}
+
+Te avisaremos cuando los videos estén listos.
+{{end}}
+saludos
+{{define "options"}}{{if .Audio}}solo audio{{end}}
+{{- if .MaxHeight}}{{if .Audio}}, {{end}}hasta {{.MaxHeight}}p{{end}}
+{{- if or .Start .End}}{{if or .Audio .MaxHeight}}, {{end}}desde {{timestamp .Start}}{{if .End}} hasta {{timestamp .End}}{{end}}{{end}}
+{{- with .Subtitles}}{{if or $.Audio $.MaxHeight $.Start $.End}}, {{end}}subtítulos {{join . ","}}{{end}}{{end -}}
+{{define "error"}}{{if eq .Code "no-urls"}}el mensaje no tiene urls
+{{- else if eq .Code "invalid-url"}}"{{.Value}}" no es una url válida
+{{- else if eq .Code "invalid-time"}}"{{.Value}}" no es un tiempo válido
+{{- else if eq .Code "unexpected"}}no se esperaba "{{.Value}}" en "{{.Line}}"
+{{- else if eq .Code "negative-option"}}las opciones no pueden ser negativas
+{{- else if eq .Code "end-before-start"}}el final del video debe estar después de su inicio
+{{- else if eq .Code "audio-format"}}las descargas de audio no tienen resolución ni subtítulos
+{{- else if eq .Code "subtitles"}}"{{.Value}}" no es un idioma de subtítulos válido
+{{- else}}{{.}}{{end}}{{end -}}`,
+	TemplateConfirm: `{{define "subject"}}Confirma tu dirección de email{{end}}
+Hola {{.Name}}:
+
+Para agregar {{.Email}} a tu cuenta, confirma la dirección con este código:
+
+  {{.Code}}
+
+enviándolo a POST /account/emails/verify como {"code": "{{.Code}}"}.
+El código vence el {{.Expires.Format "02/01/2006 15:04"}}.
+
+Si no fuiste tú, ignora este mensaje.
+
+saludos`,
+}
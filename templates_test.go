@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTemplateVideo() *DownloadVideo {
+	video := &DownloadVideo{Name: "Oskar", Title: "Die Windsbraut", Duration: 272 * time.Second, FileSize: 25 << 20}
+	video.SrcUrl, _ = url.Parse("https://www.youtube.com/watch?v=bS5P_LAqiVg")
+	video.DstUrl, _ = url.Parse("https://s3.amazonaws.com/videos/windsbraut.mp4")
+	video.Thumbnail = "https://i.ytimg.com/vi/bS5P_LAqiVg/hqdefault.jpg"
+	video.Expires = time.Date(2016, 5, 8, 10, 30, 0, 0, time.UTC)
+	return video
+}
+
+func TestMailTemplatesBuiltin(t *testing.T) {
+	templates, err := NewMailTemplates("", "")
+	assert.Nil(t, err)
+	content, err := templates.Render(TemplateSuccess, "en", newTemplateVideo())
+	assert.Nil(t, err)
+	assert.Equal(t, "Oskar, tu video Die Windsbraut está listo", content.Subject)
+	assert.Contains(t, content.Text, `Tu video "Die Windsbraut" está listo, puedes descargarlo desde https://s3.amazonaws.com/videos/windsbraut.mp4 hasta el 08/05/2016 10:30.`)
+	assert.Contains(t, content.Text, "Duración: 4:32\nTamaño: 25.0 MB")
+	assert.Empty(t, content.Html)
+
+	reply := &MailReply{Name: "Oskar", Subject: "re: videos", Error: &RequestError{Code: ErrCodeNoUrls}}
+	content, err = templates.Render(TemplateSummary, "", reply)
+	assert.Nil(t, err)
+	assert.Equal(t, "re: videos", content.Subject)
+	assert.Contains(t, content.Text, "No pudimos procesar tu mensaje: el mensaje no tiene urls\n")
+	reply.Subject = ""
+	content, err = templates.Render(TemplateSummary, "", reply)
+	assert.Nil(t, err)
+	assert.Equal(t, "Re: tu solicitud de descarga", content.Subject)
+}
+
+func TestMailTemplatesDir(t *testing.T) {
+	templates, err := NewMailTemplates("templates", "es")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"en-us", "en", "es"}, templates.Locales("en_US"))
+
+	content, err := templates.Render(TemplateSuccess, "en-US", newTemplateVideo())
+	assert.Nil(t, err)
+	assert.Equal(t, "Oskar, your video Die Windsbraut is ready", content.Subject)
+	assert.Contains(t, content.Html, `<img src="https://i.ytimg.com/vi/bS5P_LAqiVg/hqdefault.jpg" alt="Die Windsbraut" width="320">`)
+	assert.Contains(t, content.Html, "<li>Size: 25.0 MB</li>")
+
+	// the default language for the others
+	video := newTemplateVideo()
+	video.Error = errors.New("exit status 1")
+	content, err = templates.Render(TemplateError, "pt-BR", video)
+	assert.Nil(t, err)
+	assert.Equal(t, "Oskar, hubo un error en la descarga de Die Windsbraut :(", content.Subject)
+	assert.Contains(t, content.Html, "exit status 1")
+}
+
+func TestMailTemplatesFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yutubaas-templates")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "de"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "de", "success.txt"),
+		[]byte(`{{define "subject"}}{{.Title}} ist fertig{{end}}{{.DstUrl}}`), 0644))
+
+	templates, err := NewMailTemplates(dir, "de")
+	assert.Nil(t, err)
+	content, err := templates.Render(TemplateSuccess, "", newTemplateVideo())
+	assert.Nil(t, err)
+	assert.Equal(t, &MailContent{Subject: "Die Windsbraut ist fertig", Text: "https://s3.amazonaws.com/videos/windsbraut.mp4"}, content)
+	// missing templates are the builtin ones
+	content, err = templates.Render(TemplateCancelled, "de", newTemplateVideo())
+	assert.Nil(t, err)
+	assert.Equal(t, "Oskar, cancelamos la descarga de Die Windsbraut", content.Subject)
+
+	// html templates need their text
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "de", "error.html"), []byte("<p>{{.Error}}</p>"), 0644))
+	_, err = NewMailTemplates(dir, "de")
+	assert.NotNil(t, err)
+}
+
+func TestMailTemplatesSummary(t *testing.T) {
+	templates, err := NewMailTemplates("templates", "es")
+	assert.Nil(t, err)
+	reply := &MailReply{Name: "Oskar", Jobs: []*DownloadVideo{newTemplateVideo()}}
+	reply.Options = DownloadOptions{Audio: true, Start: 90, End: 240}
+	content, err := templates.Render(TemplateSummary, "en", reply)
+	assert.Nil(t, err)
+	assert.Contains(t, content.Text, "We got your message (options: only audio, from 1:30 to 4:00):\n")
+	assert.True(t, strings.HasSuffix(content.Text, "regards\n"))
+	content, err = templates.Render(TemplateSummary, "es", reply)
+	assert.Nil(t, err)
+	assert.Contains(t, content.Text, "Recibimos tu mensaje (opciones: solo audio, desde 1:30 hasta 4:00):\n")
+
+	reply.Options = DownloadOptions{MaxHeight: 720, Start: 3723, Subtitles: []string{"es", "en"}}
+	content, err = templates.Render(TemplateSummary, "en", reply)
+	assert.Nil(t, err)
+	assert.Contains(t, content.Text, "(options: up to 720p, from 1:02:03, subtitles es,en)")
+	reply.Options = DownloadOptions{}
+	content, err = templates.Render(TemplateSummary, "en", reply)
+	assert.Nil(t, err)
+	assert.Contains(t, content.Text, "We got your message:\n")
+
+	// the errors in the language of the user
+	reply = &MailReply{Name: "Oskar", Error: &RequestError{Code: ErrCodeInvalidUrl, Value: "http://[::1"}}
+	content, err = templates.Render(TemplateSummary, "en", reply)
+	assert.Nil(t, err)
+	assert.Contains(t, content.Text, "We couldn't process your message: \"http://[::1\" isn't a valid url\n")
+	reply.Error = &RequestError{Code: ErrCodeEndBeforeStart}
+	for _, dir := range []string{"templates", ""} {
+		templates, err := NewMailTemplates(dir, "es")
+		assert.Nil(t, err)
+		content, err = templates.Render(TemplateSummary, "es", reply)
+		assert.Nil(t, err)
+		assert.Contains(t, content.Text, "No pudimos procesar tu mensaje: el final del video debe estar después de su inicio\n")
+		assert.True(t, strings.HasSuffix(content.Text, "saludos\n"))
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "512 B", FormatSize(512))
+	assert.Equal(t, "1.5 KB", FormatSize(1536))
+	assert.Equal(t, "2.0 GB", FormatSize(2<<30))
+}
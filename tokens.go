@@ -0,0 +1,384 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/context"
+)
+
+type TokensConfig struct {
+	AccessLifetime  int "accessLifetime"  // seconds, 15 minutes by default
+	RefreshLifetime int "refreshLifetime" // seconds, 30 days by default
+}
+
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// ErrRefreshTokenUsed is returned using a refresh token twice
+var ErrRefreshTokenUsed = errors.New("refresh token already used")
+
+// RefreshToken gets a new access token (and refresh token) without the
+// password. Every refresh rotates it: the tokens descending from the same
+// login share a Family, and using one twice revokes the whole family.
+type RefreshToken struct {
+	Id       string
+	Hash     string // sha256 of the secret, hex
+	Username string
+	Family   string
+	Expires  time.Time
+	Used     bool
+}
+
+// NewRefreshToken creates a refresh token for username, returning it with
+// the id.secret to give to the user. An empty family starts a new one.
+func NewRefreshToken(username string, family string, lifetime time.Duration) (*RefreshToken, string, error) {
+	id, err := randomHex(12)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	if family == "" {
+		family = id
+	}
+	token := &RefreshToken{id, hashSecret(secret), username, family, time.Now().Add(lifetime), false}
+	return token, id + "." + secret, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type TokenRepository interface {
+	SaveRefreshToken(token *RefreshToken) error
+	GetRefreshToken(id string) (*RefreshToken, error) // nil if not found
+	UseRefreshToken(id string) error
+	DeleteRefreshTokens(family string) error
+	DeleteUserRefreshTokens(username string) error // of every login of the user
+	RevokeToken(jti string, expires time.Time) error
+	IsRevoked(jti string) (bool, error)
+}
+
+// BoltTokenRepository stores the refresh tokens and the jti of the revoked
+// access tokens (until they expire) in a bolt database
+type BoltTokenRepository struct {
+	DB *bolt.DB
+}
+
+var (
+	refreshTokensBucket = []byte("refresh_tokens")
+	revokedTokensBucket = []byte("revoked_tokens")
+)
+
+func NewBoltTokenRepository(db *bolt.DB) (*BoltTokenRepository, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{refreshTokensBucket, revokedTokensBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltTokenRepository{db}, nil
+}
+
+// SaveRefreshToken stores token, forgetting the tokens not needed anymore
+func (repo *BoltTokenRepository) SaveRefreshToken(token *RefreshToken) error {
+	v, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return repo.DB.Update(func(tx *bolt.Tx) error {
+		// after the put, the token may keep its family
+		if err := tx.Bucket(refreshTokensBucket).Put([]byte(token.Id), v); err != nil {
+			return err
+		}
+		return pruneRefreshTokens(tx.Bucket(refreshTokensBucket), time.Now())
+	})
+}
+
+// UseRefreshToken marks the token as used, in the same transaction that
+// checks it wasn't, so only one of two concurrent refreshes gets it. Returns
+// ErrRefreshTokenUsed if it was, ErrInvalidRefreshToken if it doesn't exist.
+func (repo *BoltTokenRepository) UseRefreshToken(id string) error {
+	return repo.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(refreshTokensBucket)
+		v := bucket.Get([]byte(id))
+		if v == nil {
+			return ErrInvalidRefreshToken
+		}
+		token := &RefreshToken{}
+		if err := json.Unmarshal(v, token); err != nil {
+			return err
+		}
+		if token.Used {
+			return ErrRefreshTokenUsed
+		}
+		token.Used = true
+		v, err := json.Marshal(token)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), v)
+	})
+}
+
+// pruneRefreshTokens deletes the expired tokens, and the used ones of
+// families without a token left to use (kept until then to catch replays)
+func pruneRefreshTokens(bucket *bolt.Bucket, now time.Time) error {
+	var used []*RefreshToken
+	live := make(map[string]bool) // families with a token to use
+	var ids [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		token := &RefreshToken{}
+		if err := json.Unmarshal(v, token); err != nil {
+			return err
+		}
+		if token.Expires.Before(now) {
+			ids = append(ids, append([]byte(nil), k...))
+		} else if token.Used {
+			used = append(used, token)
+		} else {
+			live[token.Family] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, token := range used {
+		if !live[token.Family] {
+			ids = append(ids, []byte(token.Id))
+		}
+	}
+	for _, id := range ids {
+		if err := bucket.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo *BoltTokenRepository) GetRefreshToken(id string) (*RefreshToken, error) {
+	var token *RefreshToken
+	err := repo.DB.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(refreshTokensBucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		token = &RefreshToken{}
+		return json.Unmarshal(v, token)
+	})
+	return token, err
+}
+
+// DeleteRefreshTokens deletes the tokens of family, and any expired token
+func (repo *BoltTokenRepository) DeleteRefreshTokens(family string) error {
+	now := time.Now()
+	return repo.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(refreshTokensBucket)
+		var ids [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			token := &RefreshToken{}
+			if err := json.Unmarshal(v, token); err != nil {
+				return err
+			}
+			if token.Family == family || token.Expires.Before(now) {
+				ids = append(ids, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := bucket.Delete(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (repo *BoltTokenRepository) DeleteUserRefreshTokens(username string) error {
+	return deleteUserValues(repo.DB, refreshTokensBucket, username)
+}
+
+// RevokeToken adds jti to the revocation list, forgetting the revoked tokens
+// already expired
+func (repo *BoltTokenRepository) RevokeToken(jti string, expires time.Time) error {
+	now := time.Now()
+	return repo.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(revokedTokensBucket)
+		var expired [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			if len(v) == 8 && int64(binary.BigEndian.Uint64(v)) < now.Unix() {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(expires.Unix()))
+		return bucket.Put([]byte(jti), v)
+	})
+}
+
+func (repo *BoltTokenRepository) IsRevoked(jti string) (bool, error) {
+	revoked := false
+	err := repo.DB.View(func(tx *bolt.Tx) error {
+		revoked = tx.Bucket(revokedTokensBucket).Get([]byte(jti)) != nil
+		return nil
+	})
+	return revoked, err
+}
+
+// token pair returned by /login and /token/refresh
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int64  `json:"expiresIn"` // seconds of validity of the access token
+}
+
+// IssueTokens creates an access token and a refresh token (of family, or a
+// new one) for account
+func (s *HttpServer) IssueTokens(account *ConfigUser, family string) (*TokenResponse, error) {
+	token, err := GenerateToken(account, s.AccessLifetime, s.Keys)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, secret, err := NewRefreshToken(account.Username, family, s.RefreshLifetime)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Tokens.SaveRefreshToken(refreshToken); err != nil {
+		return nil, err
+	}
+	return &TokenResponse{token, secret, int64(s.AccessLifetime / time.Second)}, nil
+}
+
+// HandleRefreshToken exchanges a refresh token for a new pair of tokens
+func (s *HttpServer) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		RefreshToken string `json:"refreshToken"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json message.", http.StatusBadRequest)
+		return
+	}
+	refreshToken, err := s.CheckRefreshToken(req.RefreshToken)
+	if err == ErrInvalidRefreshToken {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.Tokens.UseRefreshToken(refreshToken.Id); err == ErrRefreshTokenUsed {
+		// stolen (or replayed) token, log out every session of this login
+		log.Warning("refresh token %s of %s used twice, revoking its family", refreshToken.Id, refreshToken.Username)
+		if err := s.Tokens.DeleteRefreshTokens(refreshToken.Family); err != nil {
+			log.Error("error revoking refresh tokens of %s: %s", refreshToken.Username, err)
+		}
+		http.Error(w, ErrInvalidRefreshToken.Error(), http.StatusUnauthorized)
+		return
+	} else if err == ErrInvalidRefreshToken {
+		// revoked meanwhile
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	account, err := s.Accounts.GetUser(refreshToken.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if account == nil || account.Disabled {
+		http.Error(w, "unknown or disabled user", http.StatusUnauthorized)
+		return
+	}
+	response, err := s.IssueTokens(account, refreshToken.Family)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// CheckRefreshToken returns the stored refresh token of an id.secret value,
+// if it's valid and not expired
+func (s *HttpServer) CheckRefreshToken(value string) (*RefreshToken, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidRefreshToken
+	}
+	refreshToken, err := s.Tokens.GetRefreshToken(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if refreshToken == nil || time.Now().After(refreshToken.Expires) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(parts[1])), []byte(refreshToken.Hash)) != 1 {
+		return nil, ErrInvalidRefreshToken
+	}
+	return refreshToken, nil
+}
+
+// HandleLogout revokes the access token of the request and, if sent, the
+// refresh tokens of its login
+func (s *HttpServer) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	jti, _ := context.Get(r, "jti").(string)
+	if jti == "" {
+		http.Error(w, "logout needs a token from /login", http.StatusBadRequest)
+		return
+	}
+	req := struct {
+		RefreshToken string `json:"refreshToken"`
+	}{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json message.", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := s.Tokens.RevokeToken(jti, context.Get(r, "exp").(time.Time)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.RefreshToken != "" {
+		refreshToken, err := s.CheckRefreshToken(req.RefreshToken)
+		if err == nil && refreshToken.Username == context.Get(r, "sub").(string) {
+			err = s.Tokens.DeleteRefreshTokens(refreshToken.Family)
+		}
+		if err != nil && err != ErrInvalidRefreshToken {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTokenRepository(t *testing.T) (*BoltTokenRepository, func()) {
+	db, cleanup := newTestDB(t)
+	repo, err := NewBoltTokenRepository(db)
+	require.Nil(t, err)
+	return repo, cleanup
+}
+
+func TestUseRefreshToken(t *testing.T) {
+	repo, cleanup := newTestTokenRepository(t)
+	defer cleanup()
+	token, _, err := NewRefreshToken("oskar", "", time.Hour)
+	assert.Nil(t, err)
+	assert.Nil(t, repo.SaveRefreshToken(token))
+
+	// concurrent refreshes, only one uses it
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- repo.UseRefreshToken(token.Id)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	used := 0
+	for err := range errs {
+		if err == nil {
+			used++
+		} else {
+			assert.Equal(t, ErrRefreshTokenUsed, err)
+		}
+	}
+	assert.Equal(t, 1, used)
+	stored, err := repo.GetRefreshToken(token.Id)
+	assert.Nil(t, err)
+	assert.True(t, stored.Used)
+	assert.Equal(t, ErrInvalidRefreshToken, repo.UseRefreshToken("asdf"))
+}
+
+func TestPruneRefreshTokens(t *testing.T) {
+	repo, cleanup := newTestTokenRepository(t)
+	defer cleanup()
+	save := func(token *RefreshToken) *RefreshToken {
+		assert.Nil(t, repo.SaveRefreshToken(token))
+		return token
+	}
+	expired := save(&RefreshToken{Id: "expired", Family: "a", Expires: time.Now().Add(-time.Minute)})
+	get := func(token *RefreshToken) *RefreshToken {
+		stored, err := repo.GetRefreshToken(token.Id)
+		assert.Nil(t, err)
+		return stored
+	}
+
+	// a used token is kept while its family has a token to use, to catch a
+	// replay
+	rotated := save(&RefreshToken{Id: "rotated", Family: "b", Expires: time.Now().Add(time.Hour)})
+	used := save(&RefreshToken{Id: "used", Family: "b", Expires: time.Now().Add(time.Hour), Used: true})
+	assert.Nil(t, get(expired))
+	assert.NotNil(t, get(used))
+
+	assert.Nil(t, repo.UseRefreshToken(rotated.Id))
+	save(&RefreshToken{Id: "other", Family: "c", Expires: time.Now().Add(time.Hour)})
+	assert.Nil(t, get(used))
+	assert.Nil(t, get(rotated))
+}
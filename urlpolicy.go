@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// address ranges youtube-dl is never allowed to reach (unless AllowPrivate)
+var privateNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+type URLPolicyConfig struct {
+	AllowSchemes    []string "allowSchemes" // http and https by default
+	DenySchemes     []string "denySchemes"
+	AllowHosts      []string "allowHosts" // *.domain matches the domain and its subdomains
+	DenyHosts       []string "denyHosts"
+	AllowExtractors []string "allowExtractors" // youtube-dl extractor names (Youtube, Vimeo, ...)
+	DenyExtractors  []string "denyExtractors"
+	AllowPrivate    bool     "allowPrivate" // allow private and loopback addresses
+}
+
+// URLPolicy decides which urls can be downloaded. Its config can be
+// replaced with Update while in use.
+type URLPolicy struct {
+	mu       sync.RWMutex
+	config   URLPolicyConfig
+	LookupIP func(host string) ([]net.IP, error)
+}
+
+// URLPolicyError is returned when a url is rejected by the policy
+type URLPolicyError struct {
+	Reason string
+}
+
+func (e *URLPolicyError) Error() string {
+	return e.Reason
+}
+
+func NewURLPolicy(config *URLPolicyConfig) *URLPolicy {
+	policy := &URLPolicy{LookupIP: net.LookupIP}
+	policy.Update(config)
+	return policy
+}
+
+// Update replaces the lists of the policy
+func (policy *URLPolicy) Update(config *URLPolicyConfig) {
+	policy.mu.Lock()
+	defer policy.mu.Unlock()
+	policy.config = *config
+	if len(policy.config.AllowSchemes) == 0 {
+		policy.config.AllowSchemes = []string{"http", "https"}
+	}
+}
+
+// Config returns the current config of the policy
+func (policy *URLPolicy) Config() URLPolicyConfig {
+	policy.mu.RLock()
+	defer policy.mu.RUnlock()
+	return policy.config
+}
+
+// CheckURL checks the scheme and host of u, before anything is downloaded
+func (policy *URLPolicy) CheckURL(u *url.URL) error {
+	config := policy.Config()
+	scheme := strings.ToLower(u.Scheme)
+	if !containsFold(config.AllowSchemes, scheme) || containsFold(config.DenySchemes, scheme) {
+		return &URLPolicyError{fmt.Sprintf("scheme %q not allowed", u.Scheme)}
+	}
+	host := urlHost(u)
+	if host == "" {
+		return &URLPolicyError{"missing host in url"}
+	}
+	// with allowed extractors, CheckExtractor has the last word
+	if len(config.AllowHosts) > 0 && len(config.AllowExtractors) == 0 && !matchHost(config.AllowHosts, host) {
+		return &URLPolicyError{fmt.Sprintf("host %s not allowed", host)}
+	}
+	return policy.CheckHost(host)
+}
+
+// CheckHost checks the hosts the server connects to besides the videos (the
+// chat webhooks): not denied and, unless allowed, resolving to public
+// addresses only
+func (policy *URLPolicy) CheckHost(host string) error {
+	config := policy.Config()
+	if matchHost(config.DenyHosts, host) {
+		return &URLPolicyError{fmt.Sprintf("host %s not allowed", host)}
+	}
+	if config.AllowPrivate {
+		return nil
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		ips, err = policy.LookupIP(host)
+		if err != nil {
+			return &URLPolicyError{fmt.Sprintf("can't resolve host %s", host)}
+		}
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return &URLPolicyError{fmt.Sprintf("host %s resolves to a private address", host)}
+		}
+	}
+	return nil
+}
+
+// HttpClient returns a client that only connects to addresses allowed by the
+// policy, checking every redirect too
+func (policy *URLPolicy) HttpClient(timeout time.Duration) *http.Client {
+	dialer := policy.Dialer(timeout)
+	// without proxies, the dialer checks the address of the host
+	transport := &http.Transport{
+		Dial:                  dialer.Dial,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+	}
+	client := &http.Client{Transport: transport}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return policy.CheckURL(req.URL)
+	}
+	return client
+}
+
+// Dialer returns a dialer refusing private addresses (unless allowed), checked
+// once resolved so the host can't change its address after CheckHost
+func (policy *URLPolicy) Dialer(timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout}
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); !policy.Config().AllowPrivate && (ip == nil || isPrivateIP(ip)) {
+			return &URLPolicyError{fmt.Sprintf("connection to private address %s not allowed", host)}
+		}
+		return nil
+	}
+	return dialer
+}
+
+// CheckExtractor checks the youtube-dl extractor that handles u, once the
+// metadata is available
+func (policy *URLPolicy) CheckExtractor(u *url.URL, extractor string) error {
+	config := policy.Config()
+	if containsFold(config.DenyExtractors, extractor) {
+		return &URLPolicyError{fmt.Sprintf("extractor %s not allowed", extractor)}
+	}
+	if len(config.AllowExtractors) == 0 || containsFold(config.AllowExtractors, extractor) {
+		return nil
+	}
+	if len(config.AllowHosts) > 0 && matchHost(config.AllowHosts, urlHost(u)) {
+		return nil
+	}
+	return &URLPolicyError{fmt.Sprintf("extractor %s not allowed", extractor)}
+}
+
+// lowercase host of u, without port
+func urlHost(u *url.URL) string {
+	host := strings.ToLower(u.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.Trim(host, "[]")
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			domain := pattern[2:]
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestURLPolicy(config *URLPolicyConfig) *URLPolicy {
+	policy := NewURLPolicy(config)
+	policy.LookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "intranet.example.com":
+			return []net.IP{net.ParseIP("10.1.2.3")}, nil
+		case "unknown.example.com":
+			return nil, errors.New("no such host")
+		}
+		return []net.IP{net.ParseIP("203.0.113.10")}, nil
+	}
+	return policy
+}
+
+func checkURL(policy *URLPolicy, rawurl string) error {
+	u, err := url.ParseRequestURI(rawurl)
+	if err != nil {
+		panic(err)
+	}
+	return policy.CheckURL(u)
+}
+
+func TestURLPolicyDefaults(t *testing.T) {
+	policy := newTestURLPolicy(&URLPolicyConfig{})
+	assert.Nil(t, checkURL(policy, "https://www.youtube.com/watch?v=bS5P_LAqiVg"))
+	assert.Equal(t, "scheme \"file\" not allowed", checkURL(policy, "file:///etc/passwd").Error())
+	assert.Equal(t, "host 127.0.0.1 resolves to a private address", checkURL(policy, "http://127.0.0.1:8080/video.mp4").Error())
+	assert.Equal(t, "host ::1 resolves to a private address", checkURL(policy, "http://[::1]/video.mp4").Error())
+	assert.Equal(t, "host intranet.example.com resolves to a private address", checkURL(policy, "http://intranet.example.com/video.mp4").Error())
+	assert.Equal(t, "can't resolve host unknown.example.com", checkURL(policy, "http://unknown.example.com/video.mp4").Error())
+}
+
+func TestURLPolicyHosts(t *testing.T) {
+	policy := newTestURLPolicy(&URLPolicyConfig{
+		AllowHosts: []string{"*.youtube.com", "youtu.be"},
+		DenyHosts:  []string{"music.youtube.com"},
+	})
+	assert.Nil(t, checkURL(policy, "https://www.youtube.com/watch?v=bS5P_LAqiVg"))
+	assert.Nil(t, checkURL(policy, "https://YouTube.com/watch?v=bS5P_LAqiVg"))
+	assert.Nil(t, checkURL(policy, "https://youtu.be/bS5P_LAqiVg"))
+	assert.Equal(t, "host music.youtube.com not allowed", checkURL(policy, "https://music.youtube.com/watch?v=x").Error())
+	assert.Equal(t, "host vimeo.com not allowed", checkURL(policy, "https://vimeo.com/1234").Error())
+	assert.Equal(t, "host fakeyoutube.com not allowed", checkURL(policy, "https://fakeyoutube.com/1234").Error())
+}
+
+func TestURLPolicyExtractors(t *testing.T) {
+	policy := newTestURLPolicy(&URLPolicyConfig{
+		AllowHosts:      []string{"*.youtube.com"},
+		AllowExtractors: []string{"Vimeo"},
+		DenyExtractors:  []string{"Generic"},
+	})
+	vimeo, _ := url.ParseRequestURI("https://vimeo.com/1234")
+	assert.Nil(t, policy.CheckURL(vimeo))
+	assert.Nil(t, policy.CheckExtractor(vimeo, "vimeo"))
+
+	youtube, _ := url.ParseRequestURI("https://www.youtube.com/watch?v=bS5P_LAqiVg")
+	assert.Nil(t, policy.CheckExtractor(youtube, "Youtube"))
+
+	other, _ := url.ParseRequestURI("https://example.com/video")
+	assert.Nil(t, policy.CheckURL(other))
+	assert.Equal(t, "extractor Generic not allowed", policy.CheckExtractor(other, "Generic").Error())
+	assert.Equal(t, "extractor Dailymotion not allowed", policy.CheckExtractor(other, "Dailymotion").Error())
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+var (
+	ErrUserExists   = errors.New("user already exists")
+	ErrUserNotFound = errors.New("user not found")
+	ErrEmailTaken   = errors.New("email address used by another user")
+
+	validUsername = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+)
+
+type UserRepository interface {
+	GetUser(username string) (*ConfigUser, error)     // nil if not found
+	GetUserByEmail(email string) (*ConfigUser, error) // by any of its addresses, normalized
+	GetUserByOIDC(id string) (*ConfigUser, error)     // by its linked OpenID Connect identity (issuer and subject)
+	ListUsers() ([]*ConfigUser, error)
+	CreateUser(user *ConfigUser) error // ErrUserExists if the username is taken, ErrEmailTaken for its addresses
+	SaveUser(user *ConfigUser) error   // ErrUserNotFound if it doesn't exist, ErrEmailTaken
+	DeleteUser(username string) error
+}
+
+// NormalizeEmail returns the address of an email (with or without a display
+// name) in lowercase and without the +tag of plus addressing, so the
+// different ways of writing it find the same account
+func NormalizeEmail(email string) (string, error) {
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return "", err
+	}
+	at := strings.LastIndex(address.Address, "@")
+	local, domain := address.Address[:at], address.Address[at+1:]
+	if plus := strings.Index(local, "+"); plus > 0 {
+		local = local[:plus]
+	}
+	return strings.ToLower(local + "@" + domain), nil
+}
+
+// Emails returns the primary address of the user and its verified aliases
+func (account *ConfigUser) Emails() []string {
+	return append([]string{account.Email}, account.Aliases...)
+}
+
+// BoltUserRepository stores the users, as json, in a bolt database, with an
+// index of their normalized addresses
+type BoltUserRepository struct {
+	DB *bolt.DB
+}
+
+var (
+	usersBucket  = []byte("users")
+	emailsBucket = []byte("emails") // normalized address -> username
+)
+
+func NewBoltUserRepository(db *bolt.DB) (*BoltUserRepository, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(usersBucket); err != nil {
+			return err
+		}
+		// rebuilt on every start, databases from older versions have no index
+		if err := tx.DeleteBucket(emailsBucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		emails, err := tx.CreateBucket(emailsBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			user := &ConfigUser{}
+			if err := json.Unmarshal(v, user); err != nil {
+				return err
+			}
+			return reindexEmails(emails, user)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltUserRepository{db}, nil
+}
+
+// Seed stores the accounts of the config, only if there are no users yet
+func (repo *BoltUserRepository) Seed(accounts map[string]ConfigUser) error {
+	return repo.DB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket).Stats().KeyN > 0 {
+			return nil
+		}
+		for username, account := range accounts {
+			log.Info("adding account %s from config", username)
+			account.Username = username
+			if err := putUser(tx, &account); err != nil {
+				return fmt.Errorf("account %s: %s", username, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (repo *BoltUserRepository) GetUser(username string) (*ConfigUser, error) {
+	var user *ConfigUser
+	err := repo.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		user, err = getUser(tx.Bucket(usersBucket), username)
+		return err
+	})
+	return user, err
+}
+
+func (repo *BoltUserRepository) GetUserByEmail(email string) (*ConfigUser, error) {
+	normalized, err := NormalizeEmail(email)
+	if err != nil {
+		return nil, nil
+	}
+	var user *ConfigUser
+	err = repo.DB.View(func(tx *bolt.Tx) error {
+		username := tx.Bucket(emailsBucket).Get([]byte(normalized))
+		if username == nil {
+			return nil
+		}
+		user, err = getUser(tx.Bucket(usersBucket), string(username))
+		return err
+	})
+	return user, err
+}
+
+func (repo *BoltUserRepository) GetUserByOIDC(identity string) (*ConfigUser, error) {
+	users, err := repo.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if user.OIDC == identity {
+			return user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (repo *BoltUserRepository) ListUsers() ([]*ConfigUser, error) {
+	var users []*ConfigUser
+	err := repo.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			user := &ConfigUser{}
+			if err := json.Unmarshal(v, user); err != nil {
+				return err
+			}
+			users = append(users, user)
+			return nil
+		})
+	})
+	return users, err
+}
+
+func (repo *BoltUserRepository) CreateUser(user *ConfigUser) error {
+	return repo.DB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket).Get([]byte(user.Username)) != nil {
+			return ErrUserExists
+		}
+		return putUser(tx, user)
+	})
+}
+
+func (repo *BoltUserRepository) SaveUser(user *ConfigUser) error {
+	return repo.DB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket).Get([]byte(user.Username)) == nil {
+			return ErrUserNotFound
+		}
+		return putUser(tx, user)
+	})
+}
+
+func (repo *BoltUserRepository) DeleteUser(username string) error {
+	return repo.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		old, err := getUser(bucket, username)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return ErrUserNotFound
+		}
+		if err := unindexEmails(tx.Bucket(emailsBucket), old); err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(username))
+	})
+}
+
+func getUser(bucket *bolt.Bucket, username string) (*ConfigUser, error) {
+	v := bucket.Get([]byte(username))
+	if v == nil {
+		return nil, nil
+	}
+	user := &ConfigUser{}
+	return user, json.Unmarshal(v, user)
+}
+
+// putUser stores user and updates the index of its addresses
+func putUser(tx *bolt.Tx, user *ConfigUser) error {
+	bucket, emails := tx.Bucket(usersBucket), tx.Bucket(emailsBucket)
+	old, err := getUser(bucket, user.Username)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		if err := unindexEmails(emails, old); err != nil {
+			return err
+		}
+	}
+	if err := indexEmails(emails, user); err != nil {
+		return err
+	}
+	v, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(user.Username), v)
+}
+
+func indexEmails(emails *bolt.Bucket, user *ConfigUser) error {
+	for _, email := range user.Emails() {
+		normalized, err := NormalizeEmail(email)
+		if err != nil {
+			continue // accounts from old configs, only found by username
+		}
+		if username := emails.Get([]byte(normalized)); username != nil && string(username) != user.Username {
+			return ErrEmailTaken
+		}
+		if err := emails.Put([]byte(normalized), []byte(user.Username)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindexEmails indexes the addresses of user when rebuilding the index. Older
+// versions let users share addresses: those stay with the first user (by
+// username), the others only find their accounts by username.
+func reindexEmails(emails *bolt.Bucket, user *ConfigUser) error {
+	for _, email := range user.Emails() {
+		normalized, err := NormalizeEmail(email)
+		if err != nil {
+			continue
+		}
+		if username := emails.Get([]byte(normalized)); username != nil && string(username) != user.Username {
+			log.Warning("email %s of user %s already belongs to user %s, ignored", email, user.Username, username)
+			continue
+		}
+		if err := emails.Put([]byte(normalized), []byte(user.Username)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexEmails removes the addresses of user from the index, if they're its
+// own (see reindexEmails)
+func unindexEmails(emails *bolt.Bucket, user *ConfigUser) error {
+	for _, email := range user.Emails() {
+		normalized, err := NormalizeEmail(email)
+		if err != nil || string(emails.Get([]byte(normalized))) != user.Username {
+			continue
+		}
+		if err := emails.Delete([]byte(normalized)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// user representation in the http api (no password)
+type UserInfo struct {
+	Username string   `json:"username"`
+	Name     string   `json:"name"`
+	Email    string   `json:"email"`
+	Aliases  []string `json:"aliases,omitempty"`
+	Language string   `json:"language,omitempty"`
+	Notify   string   `json:"notify"`
+	Chat     []string `json:"chat,omitempty"`
+	Bounced  []string `json:"bounced,omitempty"`
+	Role     string   `json:"role"`
+	Disabled bool     `json:"disabled"`
+}
+
+func NewUserInfo(user *ConfigUser) *UserInfo {
+	return &UserInfo{user.Username, user.Name, user.Email, user.Aliases, user.Language, user.GetNotify(), user.Chat,
+		user.Bounced, user.GetRole(), user.Disabled}
+}
+
+// body of user create/update requests, missing fields are left untouched
+type UserRequest struct {
+	Username string    `json:"username"`
+	Name     *string   `json:"name"`
+	Email    *string   `json:"email"`
+	Password *string   `json:"password"`
+	Language *string   `json:"language"`
+	Notify   *string   `json:"notify"`  // immediate, digest or none
+	Chat     *[]string `json:"chat"`    // webhook urls or team channels
+	Bounced  *[]string `json:"bounced"` // only to clear addresses, once fixed
+	Role     *string   `json:"role"`
+	Disabled *bool     `json:"disabled"`
+}
+
+// CheckUserRequest validates what Apply can't by itself: the hosts of the
+// chat webhooks, with the url policy
+func (s *HttpServer) CheckUserRequest(req *UserRequest) error {
+	if req.Chat == nil {
+		return nil
+	}
+	return s.CheckChatWebhooks(*req.Chat)
+}
+
+// Apply validates the request and copies its fields to user
+func (req *UserRequest) Apply(user *ConfigUser) error {
+	if req.Name != nil {
+		user.Name = *req.Name
+	}
+	if req.Email != nil {
+		if _, err := mail.ParseAddress(*req.Email); err != nil {
+			return errors.New("invalid email address")
+		}
+		user.Email = *req.Email
+		user.PruneBounced()
+	}
+	if req.Password != nil {
+		if *req.Password == "" {
+			return errors.New("empty password")
+		}
+		hash, err := HashPassword(*req.Password, "bcrypt")
+		if err != nil {
+			return err
+		}
+		user.Password = hash
+	}
+	if req.Language != nil {
+		if *req.Language != "" && !languageTag.MatchString(*req.Language) {
+			return errors.New("invalid language")
+		}
+		user.Language = *req.Language
+	}
+	if req.Notify != nil {
+		if !ValidNotify(*req.Notify) {
+			return errors.New("invalid notify, must be immediate, digest or none")
+		}
+		user.Notify = *req.Notify
+	}
+	if req.Chat != nil {
+		for _, webhook := range *req.Chat {
+			if !ValidChatWebhook(webhook) {
+				return errors.New("invalid chat webhook, must be an https url or a channel name")
+			}
+		}
+		user.Chat = *req.Chat
+	}
+	if req.Bounced != nil {
+		for _, email := range *req.Bounced {
+			if !user.IsBounced(email) {
+				return errors.New("bounced can only remove addresses")
+			}
+		}
+		user.Bounced = *req.Bounced
+	}
+	if req.Role != nil {
+		if !ValidRole(*req.Role) {
+			return errors.New("invalid role")
+		}
+		user.Role = *req.Role
+	}
+	if req.Disabled != nil {
+		user.Disabled = *req.Disabled
+	}
+	return nil
+}
+
+func (s *HttpServer) HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.Accounts.ListUsers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := make([]*UserInfo, len(users))
+	for i, user := range users {
+		response[i] = NewUserInfo(user)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HttpServer) HandleCreateUser(w http.ResponseWriter, r *http.Request) {
+	req := &UserRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, "invalid json message.", http.StatusBadRequest)
+		return
+	}
+	if !validUsername.MatchString(req.Username) {
+		http.Error(w, "invalid username", http.StatusBadRequest)
+		return
+	}
+	if req.Email == nil || req.Password == nil {
+		http.Error(w, "email and password required", http.StatusBadRequest)
+		return
+	}
+	user := &ConfigUser{Username: req.Username}
+	if err := s.CheckUserRequest(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.Apply(user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.Accounts.CreateUser(user); err == ErrUserExists || err == ErrEmailTaken {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/users/"+user.Username)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(NewUserInfo(user))
+}
+
+func (s *HttpServer) HandleGetUser(w http.ResponseWriter, r *http.Request) {
+	user := s.GetRequestUser(w, r)
+	if user == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewUserInfo(user))
+}
+
+// HandleUpdateUser changes the name, email, role or disabled state of
+// an user (and its password, though HandleResetPassword is clearer)
+func (s *HttpServer) HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	req := &UserRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, "invalid json message.", http.StatusBadRequest)
+		return
+	}
+	s.UpdateRequestUser(w, r, req)
+}
+
+func (s *HttpServer) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Password string `json:"password"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid json message.", http.StatusBadRequest)
+		return
+	}
+	s.UpdateRequestUser(w, r, &UserRequest{Password: &body.Password})
+}
+
+func (s *HttpServer) HandleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Email string `json:"email"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid json message.", http.StatusBadRequest)
+		return
+	}
+	s.UpdateRequestUser(w, r, &UserRequest{Email: &body.Email})
+}
+
+// HandleSetLanguage changes the language of the emails to the authenticated
+// user (empty for the default one)
+func (s *HttpServer) HandleSetLanguage(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Language string `json:"language"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid json message.", http.StatusBadRequest)
+		return
+	}
+	s.UpdateAccount(w, r, &UserRequest{Language: &body.Language})
+}
+
+// HandleSetNotify changes how the authenticated user hears about its
+// finished jobs: immediate, digest or none
+func (s *HttpServer) HandleSetNotify(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Notify string `json:"notify"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid json message.", http.StatusBadRequest)
+		return
+	}
+	s.UpdateAccount(w, r, &UserRequest{Notify: &body.Notify})
+}
+
+// HandleSetChat changes the chat webhooks (urls or team channels) notified
+// about the jobs of the authenticated user
+func (s *HttpServer) HandleSetChat(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Chat []string `json:"chat"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid json message.", http.StatusBadRequest)
+		return
+	}
+	s.UpdateAccount(w, r, &UserRequest{Chat: &body.Chat})
+}
+
+// UpdateAccount applies req (only preferences) to the authenticated user
+func (s *HttpServer) UpdateAccount(w http.ResponseWriter, r *http.Request, req *UserRequest) {
+	account := context.Get(r, "account").(*ConfigUser)
+	if err := s.CheckUserRequest(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.Apply(account); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.Accounts.SaveUser(account); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewUserInfo(account))
+}
+
+// HandleDeleteUser deletes an user with its api keys, refresh tokens and
+// pending email verifications, so an user created later with the same
+// username doesn't get them
+func (s *HttpServer) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	if user := s.GetRequestUser(w, r); user == nil {
+		return
+	}
+	// before the user, so a failure leaves nothing behind it
+	if err := s.DeleteUserCredentials(username); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.Accounts.DeleteUser(username); err == ErrUserNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteUserCredentials deletes the api keys, refresh tokens and pending email
+// verifications of username
+func (s *HttpServer) DeleteUserCredentials(username string) error {
+	if err := s.ApiKeys.DeleteUserApiKeys(username); err != nil {
+		return err
+	}
+	if err := s.Tokens.DeleteUserRefreshTokens(username); err != nil {
+		return err
+	}
+	return s.Emails.DeleteUserEmailVerifications(username)
+}
+
+// UpdateRequestUser applies req to the user of the {username} in the url
+func (s *HttpServer) UpdateRequestUser(w http.ResponseWriter, r *http.Request, req *UserRequest) {
+	user := s.GetRequestUser(w, r)
+	if user == nil {
+		return
+	}
+	if err := s.CheckUserRequest(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.Apply(user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.Accounts.SaveUser(user); err == ErrUserNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err == ErrEmailTaken {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// a new password or a disabled user ends the logins of the user
+	if req.Password != nil || (req.Disabled != nil && *req.Disabled) {
+		if err := s.Tokens.DeleteUserRefreshTokens(user.Username); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewUserInfo(user))
+}
+
+// GetRequestUser returns the user of the {username} in the url, writing the
+// error response if there isn't one
+func (s *HttpServer) GetRequestUser(w http.ResponseWriter, r *http.Request) *ConfigUser {
+	user, err := s.Accounts.GetUser(mux.Vars(r)["username"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if user == nil {
+		http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+		return nil
+	}
+	return user
+}
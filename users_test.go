@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestUserRepository(t *testing.T) (*BoltUserRepository, func()) {
+	db, cleanup := newTestDB(t)
+	repo, err := NewBoltUserRepository(db)
+	require.Nil(t, err)
+	return repo, cleanup
+}
+
+func TestBoltUserRepositorySeed(t *testing.T) {
+	repo, cleanup := newTestUserRepository(t)
+	defer cleanup()
+
+	accounts := map[string]ConfigUser{"kokoschka": ConfigUser{Name: "Oskar", Email: "oskar@gmail.com"}}
+	assert.Nil(t, repo.Seed(accounts))
+	user, err := repo.GetUser("kokoschka")
+	assert.Nil(t, err)
+	assert.Equal(t, "kokoschka", user.Username)
+	assert.Equal(t, "Oskar", user.Name)
+
+	// only seeded once
+	accounts = map[string]ConfigUser{"baudelaire": ConfigUser{Name: "Charles", Email: "charles@gmail.com"}}
+	assert.Nil(t, repo.Seed(accounts))
+	user, err = repo.GetUser("baudelaire")
+	assert.Nil(t, err)
+	assert.Nil(t, user)
+}
+
+func TestBoltUserRepository(t *testing.T) {
+	repo, cleanup := newTestUserRepository(t)
+	defer cleanup()
+
+	user := &ConfigUser{Username: "baudelaire", Name: "Charles", Email: "charles@gmail.com"}
+	assert.Nil(t, repo.CreateUser(user))
+	assert.Equal(t, ErrUserExists, repo.CreateUser(user))
+
+	user.Email = "charles@fleurs.fr"
+	assert.Nil(t, repo.SaveUser(user))
+	found, err := repo.GetUserByEmail("charles@fleurs.fr")
+	assert.Nil(t, err)
+	assert.Equal(t, user, found)
+	found, err = repo.GetUserByEmail("charles@gmail.com")
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+
+	assert.Nil(t, repo.DeleteUser("baudelaire"))
+	assert.Equal(t, ErrUserNotFound, repo.DeleteUser("baudelaire"))
+	assert.Equal(t, ErrUserNotFound, repo.SaveUser(user))
+	users, err := repo.ListUsers()
+	assert.Nil(t, err)
+	assert.Empty(t, users)
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	for _, email := range []string{"oskar@gmail.com", "Oskar@Gmail.com", `"Oskar" <oskar@gmail.com>`, "oskar+videos@gmail.com"} {
+		normalized, err := NormalizeEmail(email)
+		assert.Nil(t, err)
+		assert.Equal(t, "oskar@gmail.com", normalized, email)
+	}
+	_, err := NormalizeEmail("oskar")
+	assert.NotNil(t, err)
+}
+
+func TestBoltUserRepositoryAliases(t *testing.T) {
+	repo, cleanup := newTestUserRepository(t)
+	defer cleanup()
+
+	user := &ConfigUser{Username: "kokoschka", Email: "oskar@gmail.com", Aliases: []string{"Oskar@Wien.at"}}
+	assert.Nil(t, repo.CreateUser(user))
+	for _, email := range []string{"OSKAR@gmail.com", "Oskar <oskar+videos@gmail.com>", "oskar@wien.at"} {
+		found, err := repo.GetUserByEmail(email)
+		assert.Nil(t, err)
+		assert.Equal(t, user, found, email)
+	}
+
+	// the addresses belong to one user
+	other := &ConfigUser{Username: "alma", Email: "oskar@wien.at"}
+	assert.Equal(t, ErrEmailTaken, repo.CreateUser(other))
+	other.Email = "alma@wien.at"
+	assert.Nil(t, repo.CreateUser(other))
+	other.Aliases = []string{"oskar@gmail.com"}
+	assert.Equal(t, ErrEmailTaken, repo.SaveUser(other))
+
+	// removed aliases are free
+	user.Aliases = nil
+	assert.Nil(t, repo.SaveUser(user))
+	found, err := repo.GetUserByEmail("oskar@wien.at")
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+	assert.Nil(t, repo.DeleteUser("kokoschka"))
+	other.Aliases = []string{"oskar@gmail.com"}
+	assert.Nil(t, repo.SaveUser(other))
+
+	// the index is rebuilt when the database is opened again
+	repo, err = NewBoltUserRepository(repo.DB)
+	assert.Nil(t, err)
+	found, err = repo.GetUserByEmail("oskar@gmail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "alma", found.Username)
+}
+
+func TestBoltUserRepositoryMigration(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	// older versions didn't check the addresses of the users
+	err := db.Update(func(tx *bolt.Tx) error {
+		users, err := tx.CreateBucket(usersBucket)
+		if err != nil {
+			return err
+		}
+		for _, user := range []*ConfigUser{
+			{Username: "kokoschka", Email: "oskar@gmail.com"},
+			{Username: "alma", Email: "Oskar+alma@Gmail.com", Aliases: []string{"alma@wien.at"}},
+		} {
+			v, err := json.Marshal(user)
+			if err != nil {
+				return err
+			}
+			if err := users.Put([]byte(user.Username), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.Nil(t, err)
+
+	// the address stays with the first user, by username
+	repo, err := NewBoltUserRepository(db)
+	require.Nil(t, err)
+	found, err := repo.GetUserByEmail("oskar@gmail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "alma", found.Username)
+	found, err = repo.GetUserByEmail("alma@wien.at")
+	assert.Nil(t, err)
+	assert.Equal(t, "alma", found.Username)
+
+	// the other one can't take it saving its account
+	kokoschka, err := repo.GetUser("kokoschka")
+	require.Nil(t, err)
+	assert.Equal(t, ErrEmailTaken, repo.SaveUser(kokoschka))
+	found, err = repo.GetUserByEmail("oskar@gmail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "alma", found.Username)
+}
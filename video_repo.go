@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/mitchellh/goamz/aws"
 	"github.com/mitchellh/goamz/s3"
@@ -15,14 +17,16 @@ type VideoRepository interface {
 }
 
 type S3VideoRepository struct {
-	AwsAuth    aws.Auth
-	BucketName string
+	AwsAuth      aws.Auth
+	BucketName   string
+	LinkLifetime time.Duration // of the signed urls of private videos, public if zero
 }
 
 type S3VideoRepoConfig struct {
-	AccessKey  string
-	SecretKey  string
-	BucketName string
+	AccessKey    string
+	SecretKey    string
+	BucketName   string
+	LinkLifetime time.Duration
 }
 
 func NewS3VideoRepository(config *S3VideoRepoConfig) *S3VideoRepository {
@@ -32,6 +36,7 @@ func NewS3VideoRepository(config *S3VideoRepoConfig) *S3VideoRepository {
 		SecretKey: config.SecretKey,
 	}
 	repo.BucketName = config.BucketName
+	repo.LinkLifetime = config.LinkLifetime
 	return repo
 }
 
@@ -44,7 +49,7 @@ func (repo *S3VideoRepository) SaveVideo(video *DownloadVideo) error {
 	s3path := video.File
 
 	// open file
-	file, err := os.Open(video.File)
+	file, err := os.Open(filepath.Join(video.Dir, video.File))
 	if err != nil {
 		return err
 	}
@@ -55,7 +60,11 @@ func (repo *S3VideoRepository) SaveVideo(video *DownloadVideo) error {
 	if err != nil {
 		return err
 	}
-	multi, err := bucket.InitMulti(s3path, filetype, s3.ACL("public-read"))
+	acl := s3.ACL("public-read")
+	if repo.LinkLifetime > 0 {
+		acl = s3.ACL("private")
+	}
+	multi, err := bucket.InitMulti(s3path, filetype, acl)
 	if err != nil {
 		return err
 	}
@@ -71,7 +80,15 @@ func (repo *S3VideoRepository) SaveVideo(video *DownloadVideo) error {
 		return err
 	}
 
-	video.DstUrl, err = url.ParseRequestURI(fmt.Sprintf("https://s3.amazonaws.com/%s/%s", repo.BucketName, video.File))
+	if info, err := file.Stat(); err == nil {
+		video.FileSize = info.Size()
+	}
+	if repo.LinkLifetime > 0 {
+		video.Expires = time.Now().Add(repo.LinkLifetime)
+		video.DstUrl, err = url.ParseRequestURI(bucket.SignedURL(s3path, video.Expires))
+	} else {
+		video.DstUrl, err = url.ParseRequestURI(fmt.Sprintf("https://s3.amazonaws.com/%s/%s", repo.BucketName, video.File))
+	}
 	if err != nil {
 		return err
 	}